@@ -0,0 +1,270 @@
+// Package client is a Go client of the rq HTTP API. It publishes messages and consumes them over
+// streaming subscribe sessions, which are reconnected automatically if the connection to the
+// server is lost.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	// maxBatch is the largest amount of messages the server publishes in one request.
+	maxBatch = 1000
+
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+var (
+	ErrInvalidBatch = errors.New("batch messages can't be empty or contain newlines")
+	// ErrSessionClosed is returned when settling a delivery whose subscribe session has ended. The
+	// server returns the messages of a closed session to their topic, so the message is delivered
+	// again.
+	ErrSessionClosed = errors.New("subscribe session closed")
+)
+
+// StatusError is returned for requests the server rejected.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("rq: %s (%d)", e.Message, e.StatusCode)
+}
+
+// Client makes requests to an rq server. It's safe for concurrent use.
+type Client struct {
+	base       string
+	http       *http.Client
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client requests are made with. It defaults to
+// http.DefaultClient. Subscribe sessions are long-lived, so the client shouldn't have a timeout.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) {
+		cl.http = c
+	}
+}
+
+// WithBackoff sets the delays between attempts to reconnect a subscribe session. The delay starts
+// at min and doubles after every failed attempt up to max.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// New returns a client of the server at the given URL, such as http://localhost:8080.
+func New(server string, opts ...Option) *Client {
+	c := &Client{
+		base:       strings.TrimSuffix(server, "/"),
+		http:       http.DefaultClient,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Message is a message delivered by the server. Times which the message doesn't have are zero.
+type Message struct {
+	ID               string            `json:"id"`
+	Offset           uint64            `json:"offset"`
+	Dacks            uint32            `json:"dacks,omitempty"`
+	Priority         uint8             `json:"priority,omitempty"`
+	PublishedAt      time.Time         `json:"published_at"`
+	FirstDeliveredAt time.Time         `json:"first_delivered_at"`
+	ExpiresAt        time.Time         `json:"expires_at"`
+	GroupKey         string            `json:"group_key,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Value            []byte            `json:"value"`
+	DeadLetter       *DeadLetter       `json:"dead_letter,omitempty"`
+}
+
+// DeadLetter describes why a message was moved to a dead-letter topic.
+type DeadLetter struct {
+	Topic        string `json:"topic"`
+	Subscription string `json:"subscription,omitempty"`
+	Failures     uint32 `json:"failures"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// Receipt describes a published message. Offset is only set for messages published with an
+// idempotency key which weren't scheduled, and Duplicate is set if the key was already used.
+type Receipt struct {
+	ID        string
+	Offset    uint64
+	Duplicate bool
+}
+
+// PublishOption configures a publish.
+type PublishOption func(query url.Values, header http.Header)
+
+// WithPriority publishes messages with a priority, see store.MaxPriority for the highest one.
+func WithPriority(priority uint8) PublishOption {
+	return func(query url.Values, _ http.Header) {
+		query.Set("priority", strconv.Itoa(int(priority)))
+	}
+}
+
+// WithDelay delays the delivery of messages.
+func WithDelay(d time.Duration) PublishOption {
+	return func(query url.Values, _ http.Header) {
+		query.Set("delay", d.String())
+	}
+}
+
+// WithDeliverAt delivers messages once the given time has passed.
+func WithDeliverAt(t time.Time) PublishOption {
+	return func(query url.Values, _ http.Header) {
+		query.Set("deliver_at", t.Format(time.RFC3339))
+	}
+}
+
+// WithTTL sets how long messages are delivered before they expire.
+func WithTTL(d time.Duration) PublishOption {
+	return func(query url.Values, _ http.Header) {
+		query.Set("ttl", d.String())
+	}
+}
+
+// WithGroupKey publishes messages into a FIFO group, whose messages are delivered one at a time.
+func WithGroupKey(key string) PublishOption {
+	return func(query url.Values, _ http.Header) {
+		query.Set("group_key", key)
+	}
+}
+
+// WithIdempotencyKey deduplicates retries of a publish. The server rejects batches published with
+// an idempotency key.
+func WithIdempotencyKey(key string) PublishOption {
+	return func(_ url.Values, header http.Header) {
+		header.Set("Idempotency-Key", key)
+	}
+}
+
+// WithHeader sets a message header, which is returned with the message when it's consumed.
+func WithHeader(key, value string) PublishOption {
+	return func(_ url.Values, header http.Header) {
+		header.Set("X-Rq-"+key, value)
+	}
+}
+
+// WithContentType sets the Content-Type header of messages.
+func WithContentType(contentType string) PublishOption {
+	return func(_ url.Values, header http.Header) {
+		header.Set("Content-Type", contentType)
+	}
+}
+
+func publishRequest(topic string, opts []PublishOption) (url.Values, http.Header) {
+	query, header := url.Values{"topic": {topic}}, make(http.Header)
+	for _, opt := range opts {
+		opt(query, header)
+	}
+
+	return query, header
+}
+
+// Publish publishes a message to the topic.
+func (c *Client) Publish(ctx context.Context, topic string, value []byte, opts ...PublishOption) (*Receipt, error) {
+	query, header := publishRequest(topic, opts)
+
+	resp, err := c.do(ctx, http.MethodPost, "/publish", query, header, bytes.NewReader(value), http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	receipt := &Receipt{
+		ID:        resp.Header.Get("X-Rq-Id"),
+		Duplicate: resp.Header.Get("Idempotent-Replayed") == "true",
+	}
+	if v := resp.Header.Get("X-Rq-Offset"); v != "" {
+		receipt.Offset, _ = strconv.ParseUint(v, 10, 64)
+	}
+
+	return receipt, nil
+}
+
+// PublishBatch publishes the messages to the topic atomically and returns their IDs. Batches are
+// sent one message per line, so the messages can't contain newlines.
+func (c *Client) PublishBatch(ctx context.Context, topic string, values [][]byte, opts ...PublishOption) ([]string, error) {
+	if len(values) == 0 || len(values) > maxBatch {
+		return nil, ErrInvalidBatch
+	}
+	for _, value := range values {
+		if len(value) == 0 || bytes.ContainsAny(value, "\r\n") {
+			return nil, ErrInvalidBatch
+		}
+	}
+
+	query, header := publishRequest(topic, opts)
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/plain")
+	}
+
+	body := bytes.Join(values, []byte("\n"))
+	resp, err := c.do(ctx, http.MethodPost, "/publish/batch", query, header, bytes.NewReader(body), http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding batch response: %v", err)
+	}
+
+	return result.IDs, nil
+}
+
+// do sends a request and returns the response if it has one of the expected statuses. Other
+// responses are returned as a StatusError.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader, expect ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range expect {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
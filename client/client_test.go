@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nireo/rq/internal/rqtest"
+	"github.com/nireo/rq/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	srv := rqtest.NewServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	receipt, err := c.Publish(ctx, "orders", []byte("first"), WithHeader("Trace", "1"), WithIdempotencyKey("k"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, receipt.ID)
+	assert.False(t, receipt.Duplicate)
+
+	dup, err := c.Publish(ctx, "orders", []byte("first"), WithIdempotencyKey("k"))
+	require.NoError(t, err)
+	assert.True(t, dup.Duplicate)
+	assert.Equal(t, receipt.ID, dup.ID)
+
+	ids, err := c.PublishBatch(ctx, "orders", [][]byte{[]byte("second"), []byte("third")})
+	require.NoError(t, err)
+	assert.Len(t, ids, 2)
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub, err := c.Subscribe(subCtx, "orders")
+	require.NoError(t, err)
+	deliveries := sub.Deliveries()
+
+	d := receive(t, deliveries)
+	assert.Equal(t, "first", string(d.Value))
+	assert.Equal(t, receipt.ID, d.ID)
+	assert.Equal(t, map[string]string{"Trace": "1"}, d.Headers)
+	assert.False(t, d.PublishedAt.IsZero())
+	require.NoError(t, d.Ack())
+	require.Error(t, d.Ack())
+
+	d = receive(t, deliveries)
+	assert.Equal(t, "second", string(d.Value))
+	require.NoError(t, d.Nack("retry"))
+
+	// the nacked message is delivered again before the rest of the topic.
+	d = receive(t, deliveries)
+	assert.Equal(t, "second", string(d.Value))
+	assert.Equal(t, uint32(1), d.Dacks)
+	require.NoError(t, d.Ack())
+
+	d = receive(t, deliveries)
+	assert.Equal(t, "third", string(d.Value))
+	require.NoError(t, d.Ack())
+
+	// messages published later are delivered by the waiting next.
+	_, err = c.Publish(ctx, "orders", []byte("fourth"))
+	require.NoError(t, err)
+	assert.Equal(t, "fourth", string(receive(t, deliveries).Value))
+
+	cancel()
+	for range deliveries {
+	}
+	assert.NoError(t, sub.Err())
+}
+
+func TestSubscribe_Reconnect(t *testing.T) {
+	srv := rqtest.NewServer(t)
+	c := New(srv.URL, WithBackoff(time.Millisecond, 10*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := c.Publish(ctx, "orders", []byte("value"))
+	require.NoError(t, err)
+
+	sub, err := c.Subscribe(ctx, "orders")
+	require.NoError(t, err)
+	deliveries := sub.Deliveries()
+
+	d := receive(t, deliveries)
+	srv.CloseClientConnections()
+
+	// the message of the lost session is returned to the topic and delivered by the new session.
+	redelivered := receive(t, deliveries)
+	assert.Equal(t, d.ID, redelivered.ID)
+	require.ErrorIs(t, d.Ack(), ErrSessionClosed)
+	require.NoError(t, redelivered.Ack())
+}
+
+func TestSubscribe_ErrorFrame(t *testing.T) {
+	srv := rqtest.NewServer(t)
+	c := New(srv.URL)
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/topics/events", strings.NewReader(`{"mode":"stream"}`))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// messages of a stream topic can't be leased, which ends the subscription instead of retrying.
+	sub, err := c.Subscribe(context.Background(), "events")
+	require.NoError(t, err)
+
+	select {
+	case _, ok := <-sub.Deliveries():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "subscription didn't end")
+	}
+	assert.ErrorContains(t, sub.Err(), store.ErrStream.Error())
+}
+
+func TestErrors(t *testing.T) {
+	srv := rqtest.NewServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	_, err := c.Publish(ctx, "orders", []byte("value"), WithPriority(200))
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+
+	_, err = c.PublishBatch(ctx, "orders", [][]byte{[]byte("a\nb")})
+	require.ErrorIs(t, err, ErrInvalidBatch)
+
+	_, err = c.PublishBatch(ctx, "orders", [][]byte{[]byte("a")}, WithIdempotencyKey("k"))
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+
+	_, err = c.Subscribe(ctx, "orders", WithGroup("group", ""))
+	require.ErrorAs(t, err, &statusErr)
+
+	_, err = c.Subscribe(ctx, "orders", WithPrefetch(0))
+	require.Error(t, err)
+}
+
+func receive(t *testing.T, deliveries <-chan *Delivery) *Delivery {
+	t.Helper()
+
+	select {
+	case d, ok := <-deliveries:
+		require.True(t, ok, "deliveries closed")
+		return d
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no delivery")
+		return nil
+	}
+}
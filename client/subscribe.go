@@ -0,0 +1,351 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(query url.Values)
+
+// WithSubscription consumes a durable subscription of a fan-out topic.
+func WithSubscription(name string) SubscribeOption {
+	return func(query url.Values) {
+		query.Set("subscription", name)
+	}
+}
+
+// WithGroup joins a consumer group of a fan-out topic as the member.
+func WithGroup(group, member string) SubscribeOption {
+	return func(query url.Values) {
+		query.Set("group", group)
+		query.Set("member", member)
+	}
+}
+
+// WithPrefetch sets how many delivered messages can be left unsettled at once. It defaults to 1.
+func WithPrefetch(n int) SubscribeOption {
+	return func(query url.Values) {
+		query.Set("prefetch", strconv.Itoa(n))
+	}
+}
+
+// Delivery is a message delivered by Subscribe, which is settled with Ack or Nack.
+type Delivery struct {
+	Message
+
+	sub *Subscription
+	gen uint64
+}
+
+// Ack acknowledges the message, removing it from its topic.
+func (d *Delivery) Ack() error {
+	return d.sub.settle(d, command{Cmd: "ack", Offset: d.Offset})
+}
+
+// Nack returns the message to its topic to be delivered again. The reason is recorded if the
+// message ends up in a dead-letter topic.
+func (d *Delivery) Nack(reason string) error {
+	return d.sub.settle(d, command{Cmd: "nack", Offset: d.Offset, Reason: reason})
+}
+
+type command struct {
+	Cmd    string `json:"cmd"`
+	Offset uint64 `json:"offset"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// errEmpty is the error a session answers a next with if it ended without a message, which
+// happens when the next is interrupted by another command.
+const errEmpty = "topic has no ready messages"
+
+type frame struct {
+	Message
+	Cmd   string `json:"cmd"`
+	Error string `json:"error,omitempty"`
+}
+
+// settleRequest asks the session of a subscription to ack or nack a delivery of session gen.
+type settleRequest struct {
+	gen  uint64
+	cmd  command
+	done chan error
+}
+
+// Subscription delivers the messages of a topic over a subscribe session, which is reconnected
+// with backoff whenever the connection fails. A single goroutine owns the session, since the
+// session answers its commands in order. Messages which were delivered by a failed session are
+// returned to the topic by the server and can't be settled afterwards.
+type Subscription struct {
+	c        *Client
+	ctx      context.Context
+	query    url.Values
+	prefetch int
+	out      chan *Delivery
+	settles  chan settleRequest
+	done     chan struct{}
+	err      error
+	// gen is the generation of the current session, incremented on every reconnect.
+	gen uint64
+}
+
+// Subscribe consumes the messages of a topic until ctx is cancelled or the server answers the
+// subscription with an error. Connecting the first session fails with the error of the server,
+// while sessions whose connection fails later are reconnected.
+func (c *Client) Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (*Subscription, error) {
+	query := url.Values{"topic": {topic}}
+	for _, opt := range opts {
+		opt(query)
+	}
+
+	prefetch := 1
+	if v := query.Get("prefetch"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, errors.New("rq: invalid prefetch")
+		}
+		prefetch = n
+	}
+
+	s := &Subscription{
+		c:        c,
+		ctx:      ctx,
+		query:    query,
+		prefetch: prefetch,
+		out:      make(chan *Delivery),
+		settles:  make(chan settleRequest),
+		done:     make(chan struct{}),
+	}
+
+	sess, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	go s.run(sess)
+
+	return s, nil
+}
+
+// Deliveries returns the channel the messages are delivered on. It's closed once the
+// subscription ends.
+func (s *Subscription) Deliveries() <-chan *Delivery {
+	return s.out
+}
+
+// Err returns the error which ended the subscription, or nil if its context was cancelled.
+func (s *Subscription) Err() error {
+	<-s.done
+	return s.err
+}
+
+func (s *Subscription) settle(d *Delivery, cmd command) error {
+	req := settleRequest{gen: d.gen, cmd: cmd, done: make(chan error, 1)}
+	select {
+	case s.settles <- req:
+	case <-s.done:
+		return ErrSessionClosed
+	}
+
+	return <-req.done
+}
+
+// run serves sessions until the subscription's context is cancelled or a session fails with an
+// error of the server, reconnecting sessions whose connection failed.
+func (s *Subscription) run(sess *session) {
+	defer close(s.out)
+	defer close(s.done)
+
+	for {
+		err := s.serve(sess)
+		sess.close()
+		s.gen++
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		if sess = s.reconnect(); sess == nil {
+			return
+		}
+	}
+}
+
+// reconnect connects a new session, waiting for the backoff between attempts. It returns nil if
+// the subscription's context is cancelled first.
+func (s *Subscription) reconnect() *session {
+	backoff := s.c.minBackoff
+	for {
+		timer := time.NewTimer(backoff)
+	wait:
+		for {
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return nil
+			case req := <-s.settles:
+				req.done <- ErrSessionClosed
+			case <-timer.C:
+				break wait
+			}
+		}
+
+		sess, err := s.connect()
+		if err == nil {
+			return sess
+		}
+		backoff = min(backoff*2, s.c.maxBackoff)
+	}
+}
+
+// serve asks the session for messages while the prefetch window has room and settles deliveries
+// until the session fails or the context is cancelled. A next waits on the server until a message
+// is ready; commands settling deliveries interrupt it, after which it's sent again. serve returns
+// the error of the server if it answers a next with anything other than a message or errEmpty.
+func (s *Subscription) serve(sess *session) error {
+	var (
+		outstanding int
+		pending     *Delivery
+		waiting     bool
+		// answers holds the settle requests whose commands were sent, in order, where nil stands
+		// for a next.
+		answers []*settleRequest
+	)
+	defer func() {
+		for _, req := range answers {
+			if req != nil {
+				req.done <- ErrSessionClosed
+			}
+		}
+	}()
+
+	for {
+		if pending == nil && !waiting && outstanding < s.prefetch {
+			if err := sess.encoder.Encode(command{Cmd: "next"}); err != nil {
+				return nil
+			}
+			waiting = true
+			answers = append(answers, nil)
+		}
+
+		var out chan<- *Delivery
+		if pending != nil {
+			out = s.out
+		}
+
+		select {
+		case out <- pending:
+			pending = nil
+		case f, ok := <-sess.frames:
+			// frames only answer commands, so the session has ended.
+			if !ok || len(answers) == 0 {
+				return nil
+			}
+
+			req := answers[0]
+			answers = answers[1:]
+			if req == nil {
+				waiting = false
+				switch f.Error {
+				case "":
+					pending = &Delivery{Message: f.Message, sub: s, gen: s.gen}
+					outstanding++
+				case errEmpty:
+				default:
+					return fmt.Errorf("rq: %s", f.Error)
+				}
+				continue
+			}
+
+			// a settle which failed didn't change the prefetch window of the server.
+			if f.Error != "" {
+				req.done <- fmt.Errorf("rq: %s", f.Error)
+			} else {
+				outstanding--
+				req.done <- nil
+			}
+		case req := <-s.settles:
+			if req.gen != s.gen {
+				req.done <- ErrSessionClosed
+				continue
+			}
+
+			if err := sess.encoder.Encode(req.cmd); err != nil {
+				req.done <- ErrSessionClosed
+				return nil
+			}
+			answers = append(answers, &req)
+		case <-s.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// session is a streaming subscribe session. Commands are written to the request body and every
+// command is answered with a frame in the response body. The frames are read by a goroutine of
+// their own, so that a lost connection is noticed while the session is idle.
+type session struct {
+	w       *io.PipeWriter
+	body    io.ReadCloser
+	encoder *json.Encoder
+	frames  chan *frame
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (s *Subscription) connect() (*session, error) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	r, w := io.Pipe()
+
+	resp, err := s.c.do(ctx, http.MethodPost, "/subscribe", s.query, nil, r, http.StatusOK)
+	if err != nil {
+		cancel()
+		w.Close()
+		return nil, err
+	}
+
+	sess := &session{
+		w:       w,
+		body:    resp.Body,
+		encoder: json.NewEncoder(w),
+		frames:  make(chan *frame),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	go sess.read()
+
+	return sess, nil
+}
+
+// read decodes frames until the response body ends, which closes the frames channel.
+func (s *session) read() {
+	defer close(s.frames)
+
+	decoder := json.NewDecoder(s.body)
+	for {
+		var f frame
+		if err := decoder.Decode(&f); err != nil {
+			return
+		}
+
+		select {
+		case s.frames <- &f:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// close ends the session. The server returns the messages which weren't settled to their topic.
+func (s *session) close() {
+	s.cancel()
+	s.w.Close()
+	s.body.Close()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// api makes requests to the HTTP API of a server.
+type api struct {
+	base   string
+	client *http.Client
+}
+
+func newAPI(server string) *api {
+	return &api{base: strings.TrimSuffix(server, "/"), client: http.DefaultClient}
+}
+
+// frame is a message delivered by the server, see the frame of the http package.
+type frame struct {
+	Cmd              string            `json:"cmd,omitempty"`
+	Offset           uint64            `json:"offset"`
+	ID               string            `json:"id,omitempty"`
+	Dacks            uint32            `json:"dacks,omitempty"`
+	Priority         uint8             `json:"priority,omitempty"`
+	PublishedAt      *time.Time        `json:"published_at,omitempty"`
+	FirstDeliveredAt *time.Time        `json:"first_delivered_at,omitempty"`
+	ExpiresAt        *time.Time        `json:"expires_at,omitempty"`
+	GroupKey         string            `json:"group_key,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Value            []byte            `json:"value,omitempty"`
+	DeadLetter       json.RawMessage   `json:"dead_letter,omitempty"`
+	Error            string            `json:"error,omitempty"`
+}
+
+// statusError is the error of a request the server answered with an unexpected status.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	if e.msg == "" {
+		return http.StatusText(e.status)
+	}
+
+	return fmt.Sprintf("%s (%d)", e.msg, e.status)
+}
+
+// do sends a request and returns the response if it has one of the expected statuses. The body of
+// other responses is returned as a statusError.
+func (a *api) do(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader, expect ...int) (*http.Response, error) {
+	u := a.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range expect {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &statusError{status: resp.StatusCode, msg: strings.TrimSpace(string(msg))}
+}
+
+// getJSON decodes the JSON response of a request into v.
+func (a *api) getJSON(ctx context.Context, method, path string, query url.Values, v any) error {
+	resp, err := a.do(ctx, method, path, query, nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// session is a streaming consume session opened with /subscribe. Commands are written to the
+// request body and every command is answered with a frame.
+type session struct {
+	w       *io.PipeWriter
+	resp    *http.Response
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+func (a *api) subscribe(ctx context.Context, query url.Values) (*session, error) {
+	r, w := io.Pipe()
+	resp, err := a.do(ctx, http.MethodPost, "/subscribe", query, nil, r, http.StatusOK)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return &session{w: w, resp: resp, encoder: json.NewEncoder(w), decoder: json.NewDecoder(resp.Body)}, nil
+}
+
+// send writes a command and returns the frame answering it.
+func (s *session) send(cmd any) (*frame, error) {
+	if err := s.encoder.Encode(cmd); err != nil {
+		return nil, err
+	}
+
+	var f frame
+	if err := s.decoder.Decode(&f); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("session closed by the server")
+		}
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// close ends the session. Messages which weren't acked are returned to the topic by the server.
+func (s *session) close() error {
+	s.encoder.Encode(map[string]any{"cmd": "close"})
+	s.w.Close()
+	io.Copy(io.Discard, s.resp.Body)
+
+	return s.resp.Body.Close()
+}
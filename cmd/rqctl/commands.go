@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/nireo/rq/internal/store"
+)
+
+const (
+	// maxBatch is the largest amount of messages the server publishes or returns in one request.
+	maxBatch = 1000
+	// errEmpty is the error a subscribe session answers a next with if its wait ends before a
+	// message is ready.
+	errEmpty = "topic has no ready messages"
+	// followWait is how long a single read of a followed stream waits for new messages.
+	followWait = 30 * time.Second
+)
+
+// headerFlags collects repeated -H key=value flags.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	h[key] = value
+
+	return nil
+}
+
+func publish(ctx context.Context, e *env, args []string) error {
+	fs := e.flagSet("publish", "[flags] topic [file...]",
+		"Publishes the contents of every file, or of standard input, as a message.")
+	var (
+		priority    = fs.Uint("priority", 0, "priority of the messages")
+		delay       = fs.Duration("delay", 0, "delay the delivery of the messages")
+		at          = fs.String("at", "", "deliver the messages at an RFC 3339 time")
+		ttl         = fs.Duration("ttl", 0, "time to live of the messages")
+		groupKey    = fs.String("group-key", "", "FIFO group of the messages")
+		key         = fs.String("key", "", "idempotency key of the message")
+		contentType = fs.String("content-type", "", "content type of the messages")
+		lines       = fs.Bool("lines", false, "publish every line of the input as a message")
+		headers     = make(headerFlags)
+	)
+	fs.Var(headers, "H", "message header as key=value, can be repeated")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return usageError(fs, "no topic given")
+	}
+
+	query := url.Values{"topic": {fs.Arg(0)}}
+	if *priority > 0 {
+		query.Set("priority", strconv.FormatUint(uint64(*priority), 10))
+	}
+	if *delay > 0 {
+		query.Set("delay", delay.String())
+	}
+	if *at != "" {
+		query.Set("deliver_at", *at)
+	}
+	if *ttl > 0 {
+		query.Set("ttl", ttl.String())
+	}
+	if *groupKey != "" {
+		query.Set("group_key", *groupKey)
+	}
+
+	header := make(http.Header)
+	for k, v := range headers {
+		header.Set("X-Rq-"+k, v)
+	}
+	if *contentType != "" {
+		header.Set("Content-Type", *contentType)
+	}
+
+	payloads, err := e.readInputs(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	if *lines {
+		if *key != "" {
+			return usageError(fs, "-key can't be used with -lines")
+		}
+		if *contentType == "" {
+			header.Set("Content-Type", "text/plain")
+		}
+		return e.publishLines(ctx, query, header, bytes.Join(payloads, []byte("\n")))
+	}
+
+	if *key != "" {
+		if len(payloads) > 1 {
+			return usageError(fs, "-key can only be used with a single message")
+		}
+		header.Set("Idempotency-Key", *key)
+	}
+
+	var published []publishResult
+	for _, payload := range payloads {
+		resp, err := e.api.do(ctx, http.MethodPost, "/publish", query, header, bytes.NewReader(payload), http.StatusCreated)
+		if err != nil {
+			return fmt.Errorf("publishing: %w", err)
+		}
+		resp.Body.Close()
+
+		published = append(published, publishResult{
+			ID:        resp.Header.Get("X-Rq-Id"),
+			Duplicate: resp.Header.Get("Idempotent-Replayed") == "true",
+		})
+	}
+
+	return e.out.print(published, func(t *table) {
+		t.row("ID", "DUPLICATE")
+		for _, p := range published {
+			t.row(p.ID, p.Duplicate)
+		}
+	})
+}
+
+type publishResult struct {
+	ID        string `json:"id"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// publishLines publishes every line of the body as a message, in batches of up to maxBatch lines.
+func (e *env) publishLines(ctx context.Context, query url.Values, header http.Header, body []byte) error {
+	var lines [][]byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if line = bytes.TrimSuffix(line, []byte("\r")); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return errors.New("no lines to publish")
+	}
+
+	var published []publishResult
+	for len(lines) > 0 {
+		batch := lines[:min(len(lines), maxBatch)]
+		lines = lines[len(batch):]
+
+		resp, err := e.api.do(ctx, http.MethodPost, "/publish/batch", query, header,
+			bytes.NewReader(bytes.Join(batch, []byte("\n"))), http.StatusCreated)
+		if err != nil {
+			return fmt.Errorf("publishing batch: %w", err)
+		}
+
+		var result struct {
+			IDs []string `json:"ids"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decoding batch response: %v", err)
+		}
+
+		for _, id := range result.IDs {
+			published = append(published, publishResult{ID: id})
+		}
+	}
+
+	return e.out.print(published, func(t *table) {
+		t.row("ID")
+		for _, p := range published {
+			t.row(p.ID)
+		}
+	})
+}
+
+func consume(ctx context.Context, e *env, args []string) error {
+	fs := e.flagSet("consume", "[flags] topic",
+		"Consumes messages of a topic over a subscribe session. Messages which aren't acked are\n"+
+			"returned to the topic when the command exits.")
+	var (
+		n            = fs.Int("n", 1, "number of messages to consume, 0 consumes until the topic is empty")
+		ack          = fs.Bool("ack", false, "acknowledge the consumed messages")
+		wait         = fs.Duration("wait", 0, "how long to wait for messages if the topic is empty")
+		follow       = fs.Bool("f", false, "keep consuming messages as they're published")
+		subscription = fs.String("subscription", "", "durable subscription of a fan-out topic")
+		group        = fs.String("group", "", "consumer group to join, requires -member")
+		member       = fs.String("member", "", "member name within the consumer group")
+	)
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected a single topic")
+	}
+	if *n < 0 {
+		return usageError(fs, "-n can't be negative")
+	}
+
+	query := url.Values{"topic": {fs.Arg(0)}}
+	if *subscription != "" {
+		query.Set("subscription", *subscription)
+	}
+	if *group != "" {
+		query.Set("group", *group)
+		query.Set("member", *member)
+	}
+	// messages which aren't acked stay outstanding, so they all have to fit in the prefetch window.
+	if !*ack {
+		if *n == 0 || *n > maxBatch || *follow {
+			return usageError(fs, fmt.Sprintf("consuming without -ack is limited to -n %d", maxBatch))
+		}
+		query.Set("prefetch", strconv.Itoa(*n))
+	}
+
+	sess, err := e.api.subscribe(ctx, query)
+	if err != nil {
+		return fmt.Errorf("subscribing: %w", err)
+	}
+	defer sess.close()
+
+	stream := e.out.stream(frameColumns)
+	deadline := time.Now().Add(*wait)
+	for consumed := 0; *n == 0 || consumed < *n; {
+		// the server waits for a message until the deadline, or as long as the session lasts when
+		// following.
+		cmd := map[string]any{"cmd": "next"}
+		if !*follow {
+			cmd["wait"] = max(time.Until(deadline), 0).String()
+		}
+
+		f, err := sess.send(cmd)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if f.Error == errEmpty {
+			if *follow {
+				continue
+			}
+			break
+		}
+		if f.Error != "" {
+			return fmt.Errorf("consuming: %s", f.Error)
+		}
+
+		if err := stream.write(f, frameRow(f)...); err != nil {
+			return err
+		}
+		consumed++
+
+		if *ack {
+			resp, err := sess.send(map[string]any{"cmd": "ack", "offset": f.Offset})
+			if err != nil {
+				return err
+			}
+			if resp.Error != "" {
+				return fmt.Errorf("acking offset %d: %s", f.Offset, resp.Error)
+			}
+		}
+	}
+
+	return nil
+}
+
+func tail(ctx context.Context, e *env, args []string) error {
+	fs := e.flagSet("tail", "[flags] topic",
+		"Prints the last messages of a stream topic.")
+	var (
+		n      = fs.Uint64("n", 10, "number of messages to print")
+		from   = fs.String("from", "", "position to read from instead: earliest, latest, an offset or an RFC 3339 time")
+		follow = fs.Bool("f", false, "keep printing messages as they're published")
+	)
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected a single topic")
+	}
+	topic := fs.Arg(0)
+
+	start := *from
+	if start == "" {
+		var stats store.TopicStats
+		if err := e.api.getJSON(ctx, http.MethodGet, "/topics/"+url.PathEscape(topic), nil, &stats); err != nil {
+			return fmt.Errorf("getting stream bounds: %w", err)
+		}
+		start = strconv.FormatUint(max(stats.Head, stats.Tail-min(stats.Tail, *n)), 10)
+	}
+
+	stream := e.out.stream(frameColumns)
+	var printed uint64
+	for *follow || printed < *n {
+		query := url.Values{"topic": {topic}, "from": {start}}
+		if *follow {
+			query.Set("wait", followWait.String())
+		} else {
+			query.Set("n", strconv.FormatUint(min(*n-printed, maxBatch), 10))
+		}
+
+		resp, err := e.api.do(ctx, http.MethodGet, "/read", query, nil, nil, http.StatusOK, http.StatusNoContent)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading stream: %w", err)
+		}
+
+		var frames []*frame
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&frames)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decoding messages: %v", err)
+		}
+
+		if next := resp.Header.Get("X-Rq-Next-Offset"); next != "" {
+			start = next
+		}
+		if len(frames) == 0 && !*follow {
+			break
+		}
+
+		for _, f := range frames {
+			if err := stream.write(f, frameRow(f)...); err != nil {
+				return err
+			}
+		}
+		printed += uint64(len(frames))
+	}
+
+	return nil
+}
+
+func topics(ctx context.Context, e *env, args []string) error {
+	fs := e.flagSet("topics", "[flags]", "Lists the topics of the server.")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	var names []string
+	if err := e.api.getJSON(ctx, http.MethodGet, "/topics", nil, &names); err != nil {
+		return fmt.Errorf("listing topics: %w", err)
+	}
+
+	return e.out.print(names, func(t *table) {
+		t.row("TOPIC")
+		for _, name := range names {
+			t.row(name)
+		}
+	})
+}
+
+func stats(ctx context.Context, e *env, args []string) error {
+	fs := e.flagSet("stats", "[flags] topic", "Prints the stats of a topic and its subscriptions.")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected a single topic")
+	}
+
+	var s store.TopicStats
+	if err := e.api.getJSON(ctx, http.MethodGet, "/topics/"+url.PathEscape(fs.Arg(0)), nil, &s); err != nil {
+		return fmt.Errorf("getting stats: %w", err)
+	}
+
+	return e.out.print(&s, func(t *table) {
+		t.row("TOPIC", "MODE", "READY", "UNACKED", "SCHEDULED", "HELD", "BYTES", "DROPPED", "EXPIRED")
+		row := func(s *store.TopicStats, name string) {
+			t.row(name, s.Mode, s.Ready, s.Unacked, s.Scheduled, s.Held, s.Bytes, s.Dropped, s.Expired)
+		}
+		row(&s, s.Topic)
+		for _, sub := range s.Subscriptions {
+			row(sub, s.Topic+"/"+sub.Topic)
+		}
+	})
+}
+
+func purge(ctx context.Context, e *env, args []string) error {
+	fs := e.flagSet("purge", "[flags] topic", "Removes all ready messages of a topic.")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected a single topic")
+	}
+
+	var result struct {
+		Purged uint64 `json:"purged"`
+	}
+	path := "/topics/" + url.PathEscape(fs.Arg(0)) + "/purge"
+	if err := e.api.getJSON(ctx, http.MethodPost, path, nil, &result); err != nil {
+		return fmt.Errorf("purging topic: %w", err)
+	}
+
+	return e.out.print(&result, func(t *table) {
+		t.row("PURGED")
+		t.row(result.Purged)
+	})
+}
+
+func dlq(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 || args[0] != "redrive" {
+		return usageError(e.flagSet("dlq", "redrive [flags] topic", ""), "unknown dlq command")
+	}
+
+	fs := e.flagSet("dlq redrive", "[flags] topic",
+		"Moves the messages of a dead-letter topic back to the topics they failed in.")
+	maxMoved := fs.Uint64("max", 0, "maximum number of messages to move, 0 moves all of them")
+	if err := e.parse(fs, args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected a single dead-letter topic")
+	}
+
+	var query url.Values
+	if *maxMoved > 0 {
+		query = url.Values{"max": {strconv.FormatUint(*maxMoved, 10)}}
+	}
+
+	var result struct {
+		Redriven map[string]uint64 `json:"redriven"`
+	}
+	path := "/topics/" + url.PathEscape(fs.Arg(0)) + "/redrive"
+	if err := e.api.getJSON(ctx, http.MethodPost, path, query, &result); err != nil {
+		return fmt.Errorf("redriving topic: %w", err)
+	}
+
+	topics := make([]string, 0, len(result.Redriven))
+	for topic := range result.Redriven {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return e.out.print(&result, func(t *table) {
+		t.row("TOPIC", "MOVED")
+		for _, topic := range topics {
+			t.row(topic, result.Redriven[topic])
+		}
+	})
+}
+
+// readInputs reads the payloads of the named files, or of standard input if no files are given.
+// The name - also reads standard input.
+func (e *env) readInputs(names []string) ([][]byte, error) {
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+
+	payloads := make([][]byte, 0, len(names))
+	for _, name := range names {
+		var (
+			b   []byte
+			err error
+		)
+		if name == "-" {
+			b, err = io.ReadAll(e.stdin)
+		} else {
+			b, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", name, err)
+		}
+		payloads = append(payloads, b)
+	}
+
+	return payloads, nil
+}
+
+var frameColumns = []any{"OFFSET", "ID", "PRIORITY", "VALUE"}
+
+func frameRow(f *frame) []any {
+	return []any{f.Offset, f.ID, f.Priority, string(f.Value)}
+}
+
+func usageError(fs *flag.FlagSet, msg string) error {
+	fs.Usage()
+	return fmt.Errorf("%s: %s", fs.Name(), msg)
+}
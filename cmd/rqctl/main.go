@@ -0,0 +1,122 @@
+// Command rqctl operates a running rq server over its HTTP API. It publishes and consumes
+// messages, follows stream topics and runs the admin operations of topics, printing the results as
+// tables or as JSON with -o json. The server defaults to RQ_SERVER or http://localhost:8080.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const defaultServer = "http://localhost:8080"
+
+// commands are the subcommands of rqctl.
+var commands = map[string]func(ctx context.Context, e *env, args []string) error{
+	"publish": publish,
+	"consume": consume,
+	"tail":    tail,
+	"topics":  topics,
+	"stats":   stats,
+	"purge":   purge,
+	"dlq":     dlq,
+}
+
+const usage = `usage: rqctl <command> [flags] [args]
+
+commands:
+  publish     publish messages from files or standard input
+  consume     consume messages of a topic
+  tail        print the last messages of a stream topic
+  topics      list topics
+  stats       print the stats of a topic
+  purge       remove all ready messages of a topic
+  dlq redrive move messages of a dead-letter topic back to their topics
+
+Run rqctl <command> -h for the flags of a command.
+`
+
+// env holds what commands share: the flags common to every command, the API client and the
+// standard streams.
+type env struct {
+	server string
+	format string
+	api    *api
+	out    *output
+	stdin  io.Reader
+	stderr io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "rqctl: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "help" {
+		fmt.Fprint(stderr, usage)
+		return flag.ErrHelp
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	e := &env{out: &output{w: stdout}, stdin: stdin, stderr: stderr}
+	return cmd(ctx, e, args[1:])
+}
+
+// flagSet returns the flag set of a command with the common flags registered.
+func (e *env) flagSet(name, args, desc string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(e.stderr, "usage: rqctl %s %s\n", name, args)
+		if desc != "" {
+			fmt.Fprintf(e.stderr, "\n%s\n", desc)
+		}
+		fmt.Fprintln(e.stderr, "\nflags:")
+		fs.PrintDefaults()
+	}
+
+	server := os.Getenv("RQ_SERVER")
+	if server == "" {
+		server = defaultServer
+	}
+	fs.StringVar(&e.server, "server", server, "URL of the server")
+	fs.StringVar(&e.format, "o", formatTable, "output format, table or json")
+
+	return fs
+}
+
+// parse parses the flags of a command and sets up the API client and the output.
+func (e *env) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch e.format {
+	case formatTable:
+	case formatJSON:
+		e.out.json = true
+	default:
+		return usageError(fs, fmt.Sprintf("unknown output format %q", e.format))
+	}
+	e.api = newAPI(e.server)
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/nireo/rq/internal/rqtest"
+	"github.com/nireo/rq/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishConsume(t *testing.T) {
+	srv := rqtest.NewServer(t)
+
+	path := filepath.Join(t.TempDir(), "payload")
+	require.NoError(t, os.WriteFile(path, []byte("from file"), 0o644))
+
+	out := rqctl(t, srv, "from stdin", "publish", "-o", "json", "-H", "Trace=1", "orders", path, "-")
+	var published []publishResult
+	require.NoError(t, json.Unmarshal([]byte(out), &published))
+	require.Len(t, published, 2)
+
+	rqctl(t, srv, "a\nb\n\nc\n", "publish", "-lines", "orders")
+
+	out = rqctl(t, srv, "", "stats", "-o", "json", "orders")
+	var s store.TopicStats
+	require.NoError(t, json.Unmarshal([]byte(out), &s))
+	assert.Equal(t, uint64(5), s.Ready)
+
+	// messages consumed without -ack are returned to the topic.
+	out = rqctl(t, srv, "", "consume", "-n", "2", "orders")
+	assert.Contains(t, out, "from file")
+	assert.Contains(t, out, "from stdin")
+
+	out = rqctl(t, srv, "", "consume", "-o", "json", "-ack", "-n", "0", "orders")
+	var values []string
+	decoder := json.NewDecoder(strings.NewReader(out))
+	for decoder.More() {
+		var f frame
+		require.NoError(t, decoder.Decode(&f))
+		values = append(values, string(f.Value))
+	}
+	// the messages returned by the first consume are back at the head of the topic.
+	assert.ElementsMatch(t, []string{"from file", "from stdin"}, values[:2])
+	assert.Equal(t, []string{"a", "b", "c"}, values[2:])
+
+	out = rqctl(t, srv, "", "stats", "orders")
+	assert.Regexp(t, `orders\s+queue\s+0\s+0`, out)
+
+	out = rqctl(t, srv, "", "topics")
+	assert.Equal(t, "TOPIC\norders\n", out)
+}
+
+func TestConsume_Wait(t *testing.T) {
+	srv := rqtest.NewServer(t)
+
+	// the server holds the next until the message is published.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		resp, err := http.Post(srv.URL+"/publish?topic=orders", "", strings.NewReader("late"))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	out := rqctl(t, srv, "", "consume", "-ack", "-wait", "5s", "orders")
+	assert.Contains(t, out, "late")
+
+	start := time.Now()
+	out = rqctl(t, srv, "", "consume", "-wait", "100ms", "orders")
+	assert.Empty(t, out)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestTail(t *testing.T) {
+	srv := rqtest.NewServer(t)
+
+	declareTopic(t, srv, "events", `{"mode":"stream"}`)
+
+	rqctl(t, srv, "1\n2\n3\n4\n", "publish", "-lines", "events")
+
+	out := rqctl(t, srv, "", "tail", "-n", "2", "events")
+	assert.Regexp(t, `^OFFSET\s+ID\s+PRIORITY\s+VALUE\n2\s+\S+\s+0\s+3\n3\s+\S+\s+0\s+4\n$`, out)
+
+	out = rqctl(t, srv, "", "tail", "-from", "earliest", "-n", "100", "events")
+	assert.Equal(t, 5, strings.Count(out, "\n"))
+}
+
+func TestPurgeRedrive(t *testing.T) {
+	srv := rqtest.NewServer(t)
+
+	rqctl(t, srv, "x\ny\n", "publish", "-lines", "orders")
+	assert.Equal(t, "PURGED\n2\n", rqctl(t, srv, "", "purge", "orders"))
+
+	// a message returned unacked by a consumer reaches the dead-letter topic after one delivery.
+	declareTopic(t, srv, "orders", `{"mode":"queue","max_deliveries":1}`)
+	rqctl(t, srv, "z", "publish", "orders")
+	rqctl(t, srv, "", "consume", "orders")
+
+	out := rqctl(t, srv, "", "dlq", "redrive", "-o", "json", "orders.dlq")
+	assert.JSONEq(t, `{"redriven":{"orders":1}}`, out)
+
+	var stderr bytes.Buffer
+	err := run(context.Background(), []string{"purge", "-server", srv.URL, "missing"}, nil, io.Discard, &stderr)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+
+	err = run(context.Background(), []string{"unknown"}, nil, io.Discard, &stderr)
+	require.Error(t, err)
+}
+
+// rqctl runs a command against the server and returns its output.
+func rqctl(t *testing.T, srv *httptest.Server, stdin string, args ...string) string {
+	t.Helper()
+
+	// the common flags follow the command, which for dlq is two words.
+	n := 1
+	if args[0] == "dlq" {
+		n = 2
+	}
+	args = append(append(args[:n:n], "-server", srv.URL), args[n:]...)
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+	require.NoError(t, err, stderr.String())
+
+	return stdout.String()
+}
+
+func declareTopic(t *testing.T, srv *httptest.Server, topic, cfg string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/topics/"+topic, strings.NewReader(cfg))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// output writes the results of commands either as aligned tables or as JSON.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// table is a table with aligned columns.
+type table struct {
+	tw *tabwriter.Writer
+}
+
+func newTable(w io.Writer) *table {
+	return &table{tw: tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)}
+}
+
+func (t *table) row(cols ...any) {
+	for i, col := range cols {
+		if i > 0 {
+			fmt.Fprint(t.tw, "\t")
+		}
+		fmt.Fprint(t.tw, col)
+	}
+	fmt.Fprintln(t.tw)
+}
+
+func (t *table) flush() error {
+	return t.tw.Flush()
+}
+
+// print writes v as indented JSON, or as the table written by fn.
+func (o *output) print(v any, fn func(t *table)) error {
+	if o.json {
+		encoder := json.NewEncoder(o.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	t := newTable(o.w)
+	fn(t)
+	return t.flush()
+}
+
+// stream returns a writer of results which arrive one at a time, such as consumed messages. They're
+// written as newline-delimited JSON, or as table rows below a header of the given columns.
+func (o *output) stream(columns []any) *resultStream {
+	return &resultStream{out: o, columns: columns}
+}
+
+type resultStream struct {
+	out     *output
+	columns []any
+	header  bool
+}
+
+// write writes a result, which is v in JSON and the columns in a table. Rows are flushed as they're
+// written, so their alignment is only kept for values of similar widths.
+func (s *resultStream) write(v any, cols ...any) error {
+	if s.out.json {
+		return json.NewEncoder(s.out.w).Encode(v)
+	}
+
+	t := newTable(s.out.w)
+	if !s.header {
+		t.row(s.columns...)
+		s.header = true
+	}
+	t.row(cols...)
+	return t.flush()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/nireo/rq/internal/store"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration of the daemon. Settings are read from the YAML config file, then
+// from the RQ_* environment variables and finally from the command-line flags, each overriding
+// the previous ones. Topics are only read from the file: their settings are nested per topic,
+// which doesn't map onto flat variables or flags, and they can be declared over HTTP as well.
+type config struct {
+	DataDir string `yaml:"data_dir"`
+	Listen  string `yaml:"listen"`
+	// DrainTimeout is how long in-flight requests are given to finish on shutdown before their
+	// connections are closed.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	Limits       limits        `yaml:"limits"`
+	Encryption   encryption    `yaml:"encryption"`
+	// Topics are declared with their configs on startup. The settings use the names of the topic
+	// config's JSON encoding, e.g. visibility_timeout or max_bytes.
+	Topics map[string]*store.TopicConfig `yaml:"-"`
+}
+
+type limits struct {
+	// MaxBodyBytes limits the size of request bodies. Zero disables the limit.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// MaxMessageBytes limits the size of published messages once they're decompressed.
+	MaxMessageBytes   int64         `yaml:"max_message_bytes"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	JanitorInterval   time.Duration `yaml:"janitor_interval"`
+	ReapInterval      time.Duration `yaml:"reap_interval"`
+	ScheduleInterval  time.Duration `yaml:"schedule_interval"`
+}
+
+// encryption selects the keyring values are encrypted with. Encryption is disabled if neither is
+// set.
+type encryption struct {
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		DataDir:      "data",
+		Listen:       ":8080",
+		DrainTimeout: 30 * time.Second,
+		Limits: limits{
+			MaxBodyBytes:      8 << 20,
+			MaxMessageBytes:   store.DefaultMaxMessageSize,
+			ReadHeaderTimeout: 10 * time.Second,
+			JanitorInterval:   time.Minute,
+			ReapInterval:      time.Second,
+			ScheduleInterval:  time.Second,
+		},
+	}
+}
+
+// loadConfig builds the config from the config file named by the -config flag or RQ_CONFIG, the
+// environment and the flags in args.
+func loadConfig(args []string, getenv func(string) string) (*config, error) {
+	fs := flag.NewFlagSet("rqd", flag.ContinueOnError)
+	var (
+		path         = fs.String("config", getenv("RQ_CONFIG"), "path of the YAML config file")
+		dataDir      = fs.String("data-dir", "", "directory of the database")
+		listen       = fs.String("listen", "", "address the HTTP server listens on")
+		drainTimeout = fs.Duration("drain-timeout", 0, "how long in-flight requests are drained on shutdown")
+		maxBodyBytes = fs.Int64("max-body-bytes", 0, "maximum size of a request body")
+		maxMsgBytes  = fs.Int64("max-message-bytes", 0, "maximum size of a decompressed message")
+		readHeader   = fs.Duration("read-header-timeout", 0, "how long reading the headers of a request may take")
+		janitor      = fs.Duration("janitor-interval", 0, "how often expired messages are removed")
+		reap         = fs.Duration("reap-interval", 0, "how often expired leases are reaped")
+		schedule     = fs.Duration("schedule-interval", 0, "how often scheduled messages are promoted")
+		keyFile      = fs.String("key-file", "", "file holding the encryption keyring")
+		keyEnv       = fs.String("key-env", "", "environment variable holding the encryption keyring")
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+	if *path != "" {
+		b, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %v", err)
+		}
+
+		if err := cfg.parse(b); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %v", *path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+
+	// only flags which were given override the config.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "listen":
+			cfg.Listen = *listen
+		case "drain-timeout":
+			cfg.DrainTimeout = *drainTimeout
+		case "max-body-bytes":
+			cfg.Limits.MaxBodyBytes = *maxBodyBytes
+		case "max-message-bytes":
+			cfg.Limits.MaxMessageBytes = *maxMsgBytes
+		case "read-header-timeout":
+			cfg.Limits.ReadHeaderTimeout = *readHeader
+		case "janitor-interval":
+			cfg.Limits.JanitorInterval = *janitor
+		case "reap-interval":
+			cfg.Limits.ReapInterval = *reap
+		case "schedule-interval":
+			cfg.Limits.ScheduleInterval = *schedule
+		case "key-file":
+			cfg.Encryption.KeyFile = *keyFile
+		case "key-env":
+			cfg.Encryption.KeyEnv = *keyEnv
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// parse reads a YAML config over the current settings. The topic configs are converted to JSON
+// so that they're decoded like the configs declared over HTTP.
+func (c *config) parse(b []byte) error {
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return err
+	}
+
+	var file struct {
+		Topics map[string]map[string]any `yaml:"topics"`
+	}
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return err
+	}
+
+	if len(file.Topics) > 0 {
+		c.Topics = make(map[string]*store.TopicConfig, len(file.Topics))
+	}
+	for name, settings := range file.Topics {
+		encoded, err := json.Marshal(settings)
+		if err != nil {
+			return fmt.Errorf("topic %s: %v", name, err)
+		}
+
+		topicCfg := store.DefaultTopicConfig()
+		if err := json.Unmarshal(encoded, topicCfg); err != nil {
+			return fmt.Errorf("topic %s: %v", name, err)
+		}
+		c.Topics[name] = topicCfg
+	}
+
+	return nil
+}
+
+func (c *config) applyEnv(getenv func(string) string) error {
+	if v := getenv("RQ_DATA_DIR"); v != "" {
+		c.DataDir = v
+	}
+	if v := getenv("RQ_LISTEN"); v != "" {
+		c.Listen = v
+	}
+	durations := []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"RQ_DRAIN_TIMEOUT", &c.DrainTimeout},
+		{"RQ_READ_HEADER_TIMEOUT", &c.Limits.ReadHeaderTimeout},
+		{"RQ_JANITOR_INTERVAL", &c.Limits.JanitorInterval},
+		{"RQ_REAP_INTERVAL", &c.Limits.ReapInterval},
+		{"RQ_SCHEDULE_INTERVAL", &c.Limits.ScheduleInterval},
+	}
+	for _, d := range durations {
+		v := getenv(d.env)
+		if v == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", d.env, err)
+		}
+		*d.dst = parsed
+	}
+	if v := getenv("RQ_MAX_BODY_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing RQ_MAX_BODY_BYTES: %v", err)
+		}
+		c.Limits.MaxBodyBytes = n
+	}
+	if v := getenv("RQ_MAX_MESSAGE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing RQ_MAX_MESSAGE_BYTES: %v", err)
+		}
+		c.Limits.MaxMessageBytes = n
+	}
+	if v := getenv("RQ_KEY_FILE"); v != "" {
+		c.Encryption.KeyFile = v
+	}
+	if v := getenv("RQ_KEY_ENV"); v != "" {
+		c.Encryption.KeyEnv = v
+	}
+
+	return nil
+}
+
+func (c *config) validate() error {
+	if c.DataDir == "" {
+		return errors.New("data dir is required")
+	}
+	if c.Listen == "" {
+		return errors.New("listen address is required")
+	}
+	l := c.Limits
+	if c.DrainTimeout < 0 || l.MaxBodyBytes < 0 || l.ReadHeaderTimeout < 0 || l.JanitorInterval < 0 ||
+		l.ReapInterval < 0 || l.ScheduleInterval < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if c.Limits.MaxMessageBytes <= 0 {
+		return errors.New("max message bytes has to be positive")
+	}
+	if c.Encryption.KeyFile != "" && c.Encryption.KeyEnv != "" {
+		return errors.New("only one of the key file and key env can be set")
+	}
+
+	return nil
+}
+
+// keys returns the configured keyring, or nil if encryption is disabled.
+func (c *config) keys() (store.KeyProvider, error) {
+	var (
+		keys *store.Keyring
+		err  error
+	)
+	switch {
+	case c.Encryption.KeyFile != "":
+		keys, err = store.LoadKeyFile(c.Encryption.KeyFile)
+	case c.Encryption.KeyEnv != "":
+		keys, err = store.LoadKeyEnv(c.Encryption.KeyEnv)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nireo/rq/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+data_dir: /var/lib/rq
+listen: :9000
+drain_timeout: 5s
+limits:
+  max_body_bytes: 1024
+  reap_interval: 2s
+topics:
+  orders:
+    mode: queue
+    visibility_timeout: 30s
+    max_deliveries: 3
+    compression: zstd
+  events:
+    mode: stream
+    max_age: 24h
+`
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rqd.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testConfig), 0o644))
+
+	env := map[string]string{
+		"RQ_LISTEN":            ":9001",
+		"RQ_MAX_BODY_BYTES":    "2048",
+		"RQ_JANITOR_INTERVAL":  "5m",
+		"RQ_SCHEDULE_INTERVAL": "3s",
+	}
+	args := []string{"-config", path, "-listen", ":9002", "-schedule-interval", "4s", "-read-header-timeout", "2s"}
+	cfg, err := loadConfig(args, func(k string) string { return env[k] })
+	require.NoError(t, err)
+
+	assert.Equal(t, "/var/lib/rq", cfg.DataDir)
+	// flags override the environment, which overrides the file.
+	assert.Equal(t, ":9002", cfg.Listen)
+	assert.Equal(t, int64(2048), cfg.Limits.MaxBodyBytes)
+	assert.Equal(t, int64(store.DefaultMaxMessageSize), cfg.Limits.MaxMessageBytes)
+	assert.Equal(t, 5*time.Second, cfg.DrainTimeout)
+	assert.Equal(t, 2*time.Second, cfg.Limits.ReapInterval)
+	assert.Equal(t, 5*time.Minute, cfg.Limits.JanitorInterval)
+	assert.Equal(t, 4*time.Second, cfg.Limits.ScheduleInterval)
+	assert.Equal(t, 2*time.Second, cfg.Limits.ReadHeaderTimeout)
+
+	require.Len(t, cfg.Topics, 2)
+	assert.Equal(t, &store.TopicConfig{
+		Mode:              store.ModeQueue,
+		VisibilityTimeout: store.Duration(30 * time.Second),
+		MaxDeliveries:     3,
+		Compression:       store.CompressionZstd,
+	}, cfg.Topics["orders"])
+	assert.Equal(t, store.ModeStream, cfg.Topics["events"].Mode)
+	assert.Equal(t, store.Duration(24*time.Hour), cfg.Topics["events"].MaxAge)
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	_, err := loadConfig([]string{"-key-file", "keys", "-key-env", "RQ_KEYS"}, noEnv)
+	require.Error(t, err)
+
+	_, err = loadConfig(nil, func(k string) string {
+		return map[string]string{"RQ_DRAIN_TIMEOUT": "soon"}[k]
+	})
+	require.Error(t, err)
+
+	_, err = loadConfig([]string{"-max-message-bytes", "0"}, noEnv)
+	require.Error(t, err)
+
+	_, err = loadConfig([]string{"-reap-interval", "-1s"}, noEnv)
+	require.Error(t, err)
+
+	_, err = loadConfig(nil, func(k string) string {
+		return map[string]string{"RQ_SCHEDULE_INTERVAL": "often"}[k]
+	})
+	require.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "rqd.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("topics:\n  orders:\n    visibility_timeout: 30\n"), 0o644))
+	_, err = loadConfig([]string{"-config", path}, noEnv)
+	require.Error(t, err)
+
+	cfg, err := loadConfig(nil, noEnv)
+	require.NoError(t, err)
+	assert.Equal(t, defaultConfig(), cfg)
+}
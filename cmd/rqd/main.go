@@ -0,0 +1,135 @@
+// Command rqd runs the rq HTTP server over a store in a local directory. It's configured with a
+// YAML file, RQ_* environment variables and flags, see config. On SIGINT or SIGTERM the server
+// stops accepting connections, ends the subscriptions of connected consumers and gives in-flight
+// requests until the drain timeout to finish before the store is closed.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	nethttp "net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nireo/rq/internal/broker"
+	"github.com/nireo/rq/internal/http"
+	"github.com/nireo/rq/internal/store"
+)
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rqd: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, cfg); err != nil {
+		log.Fatalf("rqd: %v", err)
+	}
+}
+
+// run serves the broker until ctx is cancelled and then drains the server.
+func run(ctx context.Context, cfg *config) error {
+	keys, err := cfg.keys()
+	if err != nil {
+		return err
+	}
+
+	storeOpts := []store.Option{store.WithJanitorInterval(cfg.Limits.JanitorInterval)}
+	if keys != nil {
+		storeOpts = append(storeOpts, store.WithKeyProvider(keys))
+	}
+
+	st, err := store.NewStore(cfg.DataDir, storeOpts...)
+	if err != nil {
+		return fmt.Errorf("opening store: %v", err)
+	}
+
+	b := broker.NewBroker(st,
+		broker.WithReapInterval(cfg.Limits.ReapInterval),
+		broker.WithScheduleInterval(cfg.Limits.ScheduleInterval),
+	)
+	defer func() {
+		if err := b.Close(); err != nil {
+			log.Printf("closing broker: %v", err)
+		}
+	}()
+
+	for topic, topicCfg := range cfg.Topics {
+		if err := b.DeclareTopic(topic, topicCfg); err != nil {
+			return fmt.Errorf("declaring topic %s: %v", topic, err)
+		}
+	}
+
+	srvOpts := []http.Option{http.WithMaxMessageSize(int(cfg.Limits.MaxMessageBytes))}
+	var handler nethttp.Handler = http.NewServer(b, srvOpts...).Handler()
+	if cfg.Limits.MaxBodyBytes > 0 {
+		handler = limitBodies(handler, cfg.Limits.MaxBodyBytes)
+	}
+
+	// requests get a context which is cancelled when draining starts, so that subscriptions and
+	// waiting requests end instead of holding the shutdown until the drain timeout.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := &nethttp.Server{
+		Addr:              cfg.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Limits.ReadHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+	srv.RegisterOnShutdown(cancelRequests)
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("rqd listening on %s with data in %s", ln.Addr(), cfg.DataDir)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("draining connections for up to %s", cfg.DrainTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(drainCtx); err != nil {
+		log.Printf("drain timed out, closing connections: %v", err)
+		srv.Close()
+	}
+
+	if err := <-errc; !errors.Is(err, nethttp.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// limitBodies limits the size of request bodies to n bytes. Subscribe sessions are left out: their
+// body is the stream of commands of a session which lives as long as the consumer is connected,
+// and each command is decoded on its own.
+func limitBodies(h nethttp.Handler, n int64) nethttp.Handler {
+	limited := nethttp.MaxBytesHandler(h, n)
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path == "/subscribe" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitBodies(t *testing.T) {
+	h := limitBodies(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(nethttp.StatusRequestEntityTooLarge)
+		}
+	}), 4)
+
+	for path, want := range map[string]int{
+		"/publish":   nethttp.StatusRequestEntityTooLarge,
+		"/subscribe": nethttp.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(nethttp.MethodPost, path, strings.NewReader("too long")))
+		assert.Equal(t, want, rec.Code, path)
+	}
+}
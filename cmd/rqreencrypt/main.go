@@ -0,0 +1,59 @@
+// Command rqreencrypt rewrites the values of a stored database under the current key of a keyring,
+// encrypting values stored in plaintext and rewrapping the data keys of values encrypted with older
+// keys. The keyring is read from a key file or an environment variable in the id:base64-key format,
+// with the current key first. The database must not be in use while the command runs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nireo/rq/internal/store"
+)
+
+func main() {
+	var (
+		path    = flag.String("path", "", "path of the database")
+		keyFile = flag.String("key-file", "", "file holding the keyring")
+		keyEnv  = flag.String("key-env", "", "environment variable holding the keyring")
+	)
+	flag.Parse()
+
+	if err := run(*path, *keyFile, *keyEnv); err != nil {
+		fmt.Fprintf(os.Stderr, "rqreencrypt: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(path, keyFile, keyEnv string) error {
+	if path == "" {
+		return fmt.Errorf("-path is required")
+	}
+
+	var (
+		keys *store.Keyring
+		err  error
+	)
+	switch {
+	case keyFile != "" && keyEnv != "":
+		return fmt.Errorf("only one of -key-file and -key-env can be set")
+	case keyFile != "":
+		keys, err = store.LoadKeyFile(keyFile)
+	case keyEnv != "":
+		keys, err = store.LoadKeyEnv(keyEnv)
+	default:
+		return fmt.Errorf("one of -key-file and -key-env is required")
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := store.Reencrypt(path, keys)
+	if err != nil {
+		return fmt.Errorf("reencrypting %s: %v", path, err)
+	}
+
+	fmt.Printf("rewrote %d values under key %q\n", n, keys.CurrentKeyID())
+	return nil
+}
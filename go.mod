@@ -1,16 +1,19 @@
 module github.com/nireo/rq
 
-go 1.20
+go 1.21
+
+require (
+	github.com/goccy/go-json v0.10.2
+	github.com/golang/mock v1.6.0
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
+	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.17.11
+	github.com/stretchr/testify v1.8.2
+	github.com/syndtr/goleveldb v1.0.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/goccy/go-json v0.10.2 // indirect
-	github.com/golang/mock v1.6.0 // indirect
-	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/objx v0.5.0 // indirect
-	github.com/stretchr/testify v1.8.2 // indirect
-	github.com/syndtr/goleveldb v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
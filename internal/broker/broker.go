@@ -1,8 +1,12 @@
 package broker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/nireo/rq/internal/consumer"
@@ -11,29 +15,216 @@ import (
 
 //go:generate mockgen -source=$GOFILE -destination=broker_mock.go -package=broker
 type Broker interface {
-	Publish(topic string, value *store.Value) error
-	Subscribe(topic string) *consumer.Consumer
+	Publish(topic string, value *store.Value, opts ...PublishOption) error
+	PublishBatch(topic string, values []*store.Value, opts ...PublishOption) error
+	PublishIdempotent(topic, key string, value *store.Value, opts ...PublishOption) (*store.Receipt, error)
+	Subscribe(topic string) (*consumer.Consumer, error)
+	SubscribeDurable(topic, name string) (*consumer.Consumer, error)
+	JoinGroup(topic, group, member string) (*consumer.Consumer, error)
+	LeaveGroup(topic, group, member string) error
+	Groups(topic string) ([]*store.Group, error)
+	ReadStream(ctx context.Context, topic string, offset uint64, n int) ([]*store.Message, error)
+	Seek(topic string, pos store.Position) (uint64, error)
+	CommitOffset(topic, consumer string, offset uint64) error
+	CommittedOffset(topic, consumer string) (uint64, error)
 	Unsubscribe(topic, id string) error
+	DeclareTopic(topic string, cfg *store.TopicConfig) error
+	TopicConfig(topic string) (*store.TopicConfig, error)
+	Redrive(dlq string, max uint64) (map[string]uint64, error)
+	Next(ctx context.Context, c *consumer.Consumer) (*store.Value, uint64, error)
+	NextN(ctx context.Context, c *consumer.Consumer, n int) ([]*store.Message, error)
+	Ack(topic, subscription string, offset uint64) error
+	Nack(topic, subscription string, offset uint64, reason string) error
+	Topics() ([]string, error)
+	Stats(topic string) (*store.TopicStats, error)
+	Purge(topic string) (uint64, error)
+	DeleteTopic(topic string) error
+	Close() error
 }
 
+// ReasonUnsubscribed is the nack reason of messages outstanding when their consumer unsubscribes.
+const ReasonUnsubscribed = "consumer unsubscribed"
+
+const (
+	// defaultReapInterval is how often expired leases are returned to their topics.
+	defaultReapInterval = time.Second
+	// defaultScheduleInterval is how often scheduled messages that are due are delivered.
+	defaultScheduleInterval = time.Second
+)
+
 type broker struct {
-	store     store.Store
-	consumers map[string][]*consumer.Consumer
+	store            store.Store
+	consumers        map[string][]*consumer.Consumer
+	reapInterval     time.Duration
+	scheduleInterval time.Duration
+	done             chan struct{}
+	closeOnce        sync.Once
+	wg               sync.WaitGroup
 	sync.RWMutex
 }
 
-func NewBroker(store store.Store) Broker {
-	return &broker{
-		store:     store,
-		consumers: make(map[string][]*consumer.Consumer),
+type Option func(*broker)
+
+// WithReapInterval sets how often the broker checks for messages whose visibility timeout has
+// expired. A zero interval disables the check.
+func WithReapInterval(d time.Duration) Option {
+	return func(b *broker) {
+		b.reapInterval = d
+	}
+}
+
+// WithScheduleInterval sets how often the broker delivers scheduled messages whose delivery time
+// has passed. A zero interval disables delivery of scheduled messages.
+func WithScheduleInterval(d time.Duration) Option {
+	return func(b *broker) {
+		b.scheduleInterval = d
 	}
 }
 
+// PublishOption changes how a single message is published.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	deliverAt time.Time
+	ttl       time.Duration
+	groupKey  string
+}
+
+// WithDelay delays the delivery of the message by the given duration.
+func WithDelay(d time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.deliverAt = time.Now().Add(d)
+	}
+}
+
+// WithDeliverAt delays the delivery of the message until the given time.
+func WithDeliverAt(t time.Time) PublishOption {
+	return func(o *publishOptions) {
+		o.deliverAt = t
+	}
+}
+
+// WithGroupKey puts the message into a message group. Messages of the same group are delivered one
+// at a time in publish order, while messages of other groups are delivered to other consumers in
+// the meantime.
+func WithGroupKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.groupKey = key
+	}
+}
+
+// WithTTL expires the message if it isn't delivered within the given duration. The duration
+// starts when the message can first be delivered, so delayed messages don't expire while they
+// wait. Messages published without a TTL use the topic's default.
+func WithTTL(d time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.ttl = d
+	}
+}
+
+func NewBroker(store store.Store, opts ...Option) Broker {
+	b := &broker{
+		store:            store,
+		consumers:        make(map[string][]*consumer.Consumer),
+		reapInterval:     defaultReapInterval,
+		scheduleInterval: defaultScheduleInterval,
+		done:             make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.reapInterval > 0 {
+		b.wg.Add(1)
+		go b.reap()
+	}
+
+	if b.scheduleInterval > 0 {
+		b.wg.Add(1)
+		go b.schedule()
+	}
+
+	return b
+}
+
+// Close stops the broker's background work and closes the store.
 func (b *broker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+	b.wg.Wait()
+
 	return b.store.Close()
 }
 
-func (b *broker) Publish(topic string, val *store.Value) error {
+// reap periodically returns messages with expired leases to their topics and wakes up the
+// consumers of those topics.
+func (b *broker) reap() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			topics, err := b.store.RequeueExpired(now)
+			if err != nil {
+				log.Printf("requeueing expired leases: %v", err)
+				continue
+			}
+
+			for _, topic := range topics {
+				b.Notify(string(topic), consumer.EvRet)
+			}
+		}
+	}
+}
+
+// schedule periodically delivers the scheduled messages that are due and wakes up the consumers of
+// their topics. Messages which became due while the broker was stopped are delivered right away.
+func (b *broker) schedule() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.scheduleInterval)
+	defer ticker.Stop()
+
+	b.promoteDue(time.Now())
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			b.promoteDue(now)
+		}
+	}
+}
+
+func (b *broker) promoteDue(now time.Time) {
+	// values which failed stay scheduled, while the topics which received values are notified.
+	topics, err := b.store.PromoteDue(now)
+	if err != nil {
+		log.Printf("promoting scheduled messages: %v", err)
+	}
+
+	for _, topic := range topics {
+		b.Notify(string(topic), consumer.EvPub)
+	}
+}
+
+// Publish inserts the value into the topic and wakes up the topic's consumers. The value's ID and
+// publish time are set unless the caller has set them already. Messages published with a delay
+// are stored until they're due and delivered by the broker's scheduler. A *store.RetentionError is
+// returned if the topic is full and rejects publishes.
+func (b *broker) Publish(topic string, val *store.Value, opts ...PublishOption) error {
+	o := preparePublish([]*store.Value{val}, opts)
+	if o.deliverAt.After(time.Now()) {
+		return b.store.Schedule([]byte(topic), val, o.deliverAt)
+	}
+
 	if err := b.store.Insert([]byte(topic), val); err != nil {
 		return err
 	}
@@ -42,40 +233,343 @@ func (b *broker) Publish(topic string, val *store.Value) error {
 	return nil
 }
 
-func (b *broker) Subscribe(topic string) *consumer.Consumer {
-	c := &consumer.Consumer{
-		ID:          uuid.New().String(),
-		Topic:       []byte(topic),
-		AckOffset:   0,
-		Store:       b.store,
-		EvChan:      make(chan consumer.EvType),
-		Outstanding: false,
+// PublishBatch inserts all of the values into the topic atomically and wakes up the topic's
+// consumers once. The options apply to every value.
+func (b *broker) PublishBatch(topic string, vals []*store.Value, opts ...PublishOption) error {
+	o := preparePublish(vals, opts)
+	if o.deliverAt.After(time.Now()) {
+		return b.store.ScheduleBatch([]byte(topic), vals, o.deliverAt)
+	}
+
+	if err := b.store.InsertBatch([]byte(topic), vals); err != nil {
+		return err
+	}
+
+	b.Notify(topic, consumer.EvPub)
+	return nil
+}
+
+// PublishIdempotent publishes a value unless the idempotency key was already used for the topic
+// within its dedup window, in which case the receipt of the original message is returned with
+// Duplicate set. Publishers retrying a failed publish with the same key enqueue the message at
+// most once.
+func (b *broker) PublishIdempotent(topic, key string, val *store.Value, opts ...PublishOption) (*store.Receipt, error) {
+	o := preparePublish([]*store.Value{val}, opts)
+
+	receipt, err := b.store.InsertIdempotent([]byte(topic), []byte(key), val, o.deliverAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if !receipt.Duplicate && !receipt.Scheduled {
+		b.Notify(topic, consumer.EvPub)
+	}
+
+	return receipt, nil
+}
+
+// preparePublish sets the IDs, publish times and expiry times of the values and applies the
+// publish options.
+func preparePublish(vals []*store.Value, opts []PublishOption) publishOptions {
+	var o publishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	now := time.Now().UTC()
+	deliverable := now
+	if o.deliverAt.After(now) {
+		deliverable = o.deliverAt.UTC()
+	}
+
+	for _, val := range vals {
+		if val.ID == uuid.Nil {
+			val.ID = uuid.New()
+		}
+		if val.PublishedAt.IsZero() {
+			val.PublishedAt = now
+		}
+		if o.ttl > 0 && val.ExpiresAt.IsZero() {
+			val.ExpiresAt = deliverable.Add(o.ttl)
+		}
+		if o.groupKey != "" {
+			val.GroupKey = o.groupKey
+		}
+	}
+
+	return o
+}
+
+// Subscribe adds a consumer to the topic. On a queue topic the consumers compete for the messages,
+// while on a fan-out topic every consumer gets its own subscription which is removed once the
+// consumer unsubscribes.
+func (b *broker) Subscribe(topic string) (*consumer.Consumer, error) {
+	cfg, err := b.store.TopicConfig([]byte(topic))
+	if err != nil {
+		return nil, fmt.Errorf("getting config of topic [%s]: %w", topic, err)
+	}
+
+	c := b.newConsumer(topic)
+	if cfg.Mode == store.ModeFanout {
+		if err := b.store.AddSubscription([]byte(topic), []byte(c.ID), false); err != nil {
+			return nil, fmt.Errorf("adding subscription to topic [%s]: %w", topic, err)
+		}
+		c.Subscription = c.ID
+		c.Topic = store.SubscriptionTopic([]byte(topic), []byte(c.ID))
+	}
+
+	b.addConsumer(topic, c)
+	return c, nil
+}
+
+// SubscribeDurable adds a consumer to a named subscription of a fan-out topic. The subscription is
+// created if it doesn't exist and keeps receiving messages while no consumers are connected to it.
+// Consumers sharing a subscription compete for its messages.
+func (b *broker) SubscribeDurable(topic, name string) (*consumer.Consumer, error) {
+	if err := b.store.AddSubscription([]byte(topic), []byte(name), true); err != nil {
+		return nil, fmt.Errorf("adding subscription to topic [%s]: %w", topic, err)
+	}
+
+	c := b.newConsumer(topic)
+	c.Subscription = name
+	c.Topic = store.SubscriptionTopic([]byte(topic), []byte(name))
+
+	b.addConsumer(topic, c)
+	return c, nil
+}
+
+// JoinGroup adds a consumer to a consumer group of a fan-out topic as the given member. The group
+// receives every message of the topic and its consumers compete for them. The membership is kept
+// when the consumer unsubscribes, so a member can reconnect with several consumers over time.
+func (b *broker) JoinGroup(topic, group, member string) (*consumer.Consumer, error) {
+	if err := b.store.AddMember([]byte(topic), []byte(group), []byte(member)); err != nil {
+		return nil, fmt.Errorf("joining group [%s] of topic [%s]: %w", group, topic, err)
+	}
+
+	c := b.newConsumer(topic)
+	c.Subscription = group
+	c.Member = member
+	c.Topic = store.SubscriptionTopic([]byte(topic), []byte(group))
+
+	b.addConsumer(topic, c)
+	return c, nil
+}
+
+// LeaveGroup removes a member from a consumer group and unsubscribes the member's consumers, which
+// returns their outstanding messages to the group.
+func (b *broker) LeaveGroup(topic, group, member string) error {
+	if err := b.store.RemoveMember([]byte(topic), []byte(group), []byte(member)); err != nil {
+		return err
+	}
+
+	var ids []string
+	b.RLock()
+	for _, c := range b.consumers[topic] {
+		if c.Subscription == group && c.Member == member {
+			ids = append(ids, c.ID)
+		}
+	}
+	b.RUnlock()
+
+	for _, id := range ids {
+		if err := b.Unsubscribe(topic, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Groups returns the consumer groups of a topic along with the connected consumers and
+// outstanding messages of each member.
+func (b *broker) Groups(topic string) ([]*store.Group, error) {
+	groups, err := b.store.Groups([]byte(topic))
+	if err != nil {
+		return nil, err
 	}
 
+	b.RLock()
+	defer b.RUnlock()
+
+	for _, g := range groups {
+		for _, m := range g.Members {
+			for _, c := range b.consumers[topic] {
+				if c.Subscription == g.Name && c.Member == m.Name {
+					m.Connections++
+					m.Outstanding += len(c.Outstanding())
+				}
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+func (b *broker) newConsumer(topic string) *consumer.Consumer {
+	return &consumer.Consumer{
+		ID:    uuid.New().String(),
+		Topic: []byte(topic),
+		Notify: func(ev consumer.EvType) {
+			b.Notify(topic, ev)
+		},
+		Store: b.store,
+		// a single buffered event is enough to wake up the consumer, further events are dropped.
+		EvChan:   make(chan consumer.EvType, 1),
+		Prefetch: 1,
+	}
+}
+
+// Next leases the next message for the consumer, blocking until a message is published to the
+// consumer's topic or the context is done. The consumer must have been created by this broker.
+func (b *broker) Next(ctx context.Context, c *consumer.Consumer) (*store.Value, uint64, error) {
+	for {
+		val, offset, err := c.Next()
+		if err == nil {
+			return val, offset, nil
+		}
+		if !errors.Is(err, store.ErrEmpty) {
+			return nil, 0, err
+		}
+
+		select {
+		case <-c.EvChan:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+// NextN leases up to n messages for the consumer, limited by its prefetch window, blocking until
+// at least one message is available or the context is done.
+func (b *broker) NextN(ctx context.Context, c *consumer.Consumer, n int) ([]*store.Message, error) {
+	for {
+		msgs, err := c.NextN(n)
+		if err == nil {
+			return msgs, nil
+		}
+		if !errors.Is(err, store.ErrEmpty) {
+			return nil, err
+		}
+
+		select {
+		case <-c.EvChan:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ReadStream reads up to n messages of a stream topic starting at offset, blocking until a message
+// at or after the offset is published or the context is done. Reading doesn't change the stream,
+// so the same messages can be read any number of times.
+func (b *broker) ReadStream(ctx context.Context, topic string, offset uint64, n int) ([]*store.Message, error) {
+	// the reader is registered before the first read so that no publish is missed while waiting.
+	c := b.newConsumer(topic)
+	b.addConsumer(topic, c)
+	defer b.removeConsumer(topic, c.ID)
+
+	for {
+		msgs, err := b.store.Read([]byte(topic), offset, n)
+		if err == nil {
+			return msgs, nil
+		}
+		if !errors.Is(err, store.ErrEmpty) {
+			return nil, err
+		}
+
+		select {
+		case <-c.EvChan:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Seek resolves a position of a stream topic to the offset to read from.
+func (b *broker) Seek(topic string, pos store.Position) (uint64, error) {
+	return b.store.Seek([]byte(topic), pos)
+}
+
+// CommitOffset stores the offset a named stream consumer continues reading from.
+func (b *broker) CommitOffset(topic, consumer string, offset uint64) error {
+	return b.store.CommitOffset([]byte(topic), []byte(consumer), offset)
+}
+
+// CommittedOffset returns the offset committed by a named stream consumer.
+func (b *broker) CommittedOffset(topic, consumer string) (uint64, error) {
+	return b.store.CommittedOffset([]byte(topic), []byte(consumer))
+}
+
+// Ack acknowledges a leased message by its offset, without going through the consumer that
+// leased it. The subscription has to be set for messages of fan-out topics.
+func (b *broker) Ack(topic, subscription string, offset uint64) error {
+	if err := b.store.Ack(queueTopic(topic, subscription), offset); err != nil {
+		return err
+	}
+
+	b.Notify(topic, consumer.EvAck)
+	return nil
+}
+
+// Nack returns a leased message to its topic by its offset, without going through the consumer
+// that leased it.
+func (b *broker) Nack(topic, subscription string, offset uint64, reason string) error {
+	if err := b.store.Nack(queueTopic(topic, subscription), offset, reason); err != nil {
+		return err
+	}
+
+	b.Notify(topic, consumer.EvNack)
+	return nil
+}
+
+func queueTopic(topic, subscription string) []byte {
+	if subscription == "" {
+		return []byte(topic)
+	}
+
+	return store.SubscriptionTopic([]byte(topic), []byte(subscription))
+}
+
+func (b *broker) addConsumer(topic string, c *consumer.Consumer) {
 	b.Lock()
 	b.consumers[topic] = append(b.consumers[topic], c)
 	b.Unlock()
+}
+
+func (b *broker) removeConsumer(topic, id string) {
+	b.Lock()
+	defer b.Unlock()
 
-	return c
+	cons := b.consumers[topic]
+	for idx, c := range cons {
+		if c.ID == id {
+			cons[idx] = cons[len(cons)-1]
+			b.consumers[topic] = cons[:len(cons)-1]
+			return
+		}
+	}
 }
 
+// Unsubscribe removes the consumer from the topic and returns every message it has outstanding to
+// the topic.
 func (b *broker) Unsubscribe(topic, id string) error {
 	b.RLock()
 	cons := b.consumers[topic]
 	b.RUnlock()
 
-	for idx, con := range cons {
+	for _, con := range cons {
 		if con.ID == id {
-			if con.Outstanding {
-				con.Nack()
-			}
+			// messages the consumer didn't settle are given to other consumers.
+			con.NackAll(ReasonUnsubscribed)
 
-			b.Lock()
-			ln := len(b.consumers[topic])
-			b.consumers[topic][idx] = b.consumers[topic][ln-1]
-			b.consumers[topic] = b.consumers[topic][:ln-1]
-			b.Unlock()
+			// subscriptions named after the consumer are only used by it.
+			if con.Subscription == con.ID {
+				if err := b.store.RemoveSubscription([]byte(topic), []byte(con.ID)); err != nil {
+					return fmt.Errorf("removing subscription of consumer [%s]: %v", id, err)
+				}
+			}
 
+			b.removeConsumer(topic, id)
 			return nil
 		}
 	}
@@ -83,6 +577,61 @@ func (b *broker) Unsubscribe(topic, id string) error {
 	return fmt.Errorf("consumer with id [%s] not found for topic: %s", id, topic)
 }
 
+// DeclareTopic stores the config of a topic, creating the topic if it doesn't exist.
+func (b *broker) DeclareTopic(topic string, cfg *store.TopicConfig) error {
+	return b.store.SetTopicConfig([]byte(topic), cfg)
+}
+
+// TopicConfig returns the config of a topic or the default config if none has been set.
+func (b *broker) TopicConfig(topic string) (*store.TopicConfig, error) {
+	return b.store.TopicConfig([]byte(topic))
+}
+
+// Redrive moves up to max messages from a dead-letter topic back to their original topics and
+// wakes up the consumers of those topics.
+func (b *broker) Redrive(dlq string, max uint64) (map[string]uint64, error) {
+	moved, err := b.store.Redrive([]byte(dlq), max)
+	if err != nil {
+		return nil, err
+	}
+
+	for topic := range moved {
+		b.Notify(topic, consumer.EvPub)
+	}
+
+	return moved, nil
+}
+
+func (b *broker) Topics() ([]string, error) {
+	topics, err := b.store.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = string(topic)
+	}
+
+	return names, nil
+}
+
+func (b *broker) Stats(topic string) (*store.TopicStats, error) {
+	return b.store.Stats([]byte(topic))
+}
+
+func (b *broker) Purge(topic string) (uint64, error) {
+	return b.store.Purge([]byte(topic))
+}
+
+// DeleteTopic removes the topic from the store. Consumers of the topic stay subscribed, but their
+// outstanding messages can no longer be acknowledged.
+func (b *broker) DeleteTopic(topic string) error {
+	return b.store.DeleteTopic([]byte(topic))
+}
+
+// Notify wakes up every consumer of the topic. Consumers which already have a pending event are
+// skipped, so the event is never lost for a consumer waiting in Next.
 func (b *broker) Notify(topic string, ev consumer.EvType) {
 	b.RLock()
 	defer b.RUnlock()
@@ -90,9 +639,8 @@ func (b *broker) Notify(topic string, ev consumer.EvType) {
 	for _, c := range b.consumers[topic] {
 		select {
 		case c.EvChan <- ev:
-			return
 		default:
-			// failed to send message to consumer
+			// the consumer already has a pending event
 		}
 	}
 }
@@ -5,6 +5,7 @@
 package broker
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -35,26 +36,320 @@ func (m *MockBroker) EXPECT() *MockBrokerMockRecorder {
 	return m.recorder
 }
 
+// Ack mocks base method.
+func (m *MockBroker) Ack(topic, subscription string, offset uint64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Ack", topic, subscription, offset)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Ack indicates an expected call of Ack.
+func (mr *MockBrokerMockRecorder) Ack(topic, subscription, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockBroker)(nil).Ack), topic, subscription, offset)
+}
+
+// Close mocks base method.
+func (m *MockBroker) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockBrokerMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockBroker)(nil).Close))
+}
+
+// CommitOffset mocks base method.
+func (m *MockBroker) CommitOffset(topic, consumer string, offset uint64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CommitOffset", topic, consumer, offset)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CommitOffset indicates an expected call of CommitOffset.
+func (mr *MockBrokerMockRecorder) CommitOffset(topic, consumer, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CommitOffset", reflect.TypeOf((*MockBroker)(nil).CommitOffset), topic, consumer, offset)
+}
+
+// CommittedOffset mocks base method.
+func (m *MockBroker) CommittedOffset(topic, consumer string) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CommittedOffset", topic, consumer)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CommittedOffset indicates an expected call of CommittedOffset.
+func (mr *MockBrokerMockRecorder) CommittedOffset(topic, consumer interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CommittedOffset", reflect.TypeOf((*MockBroker)(nil).CommittedOffset), topic, consumer)
+}
+
+// DeclareTopic mocks base method.
+func (m *MockBroker) DeclareTopic(topic string, cfg *store.TopicConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeclareTopic", topic, cfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeclareTopic indicates an expected call of DeclareTopic.
+func (mr *MockBrokerMockRecorder) DeclareTopic(topic, cfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeclareTopic", reflect.TypeOf((*MockBroker)(nil).DeclareTopic), topic, cfg)
+}
+
+// DeleteTopic mocks base method.
+func (m *MockBroker) DeleteTopic(topic string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteTopic", topic)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteTopic indicates an expected call of DeleteTopic.
+func (mr *MockBrokerMockRecorder) DeleteTopic(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteTopic", reflect.TypeOf((*MockBroker)(nil).DeleteTopic), topic)
+}
+
+// Groups mocks base method.
+func (m *MockBroker) Groups(topic string) ([]*store.Group, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Groups", topic)
+	ret0, _ := ret[0].([]*store.Group)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Groups indicates an expected call of Groups.
+func (mr *MockBrokerMockRecorder) Groups(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Groups", reflect.TypeOf((*MockBroker)(nil).Groups), topic)
+}
+
+// JoinGroup mocks base method.
+func (m *MockBroker) JoinGroup(topic, group, member string) (*consumer.Consumer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "JoinGroup", topic, group, member)
+	ret0, _ := ret[0].(*consumer.Consumer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// JoinGroup indicates an expected call of JoinGroup.
+func (mr *MockBrokerMockRecorder) JoinGroup(topic, group, member interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "JoinGroup", reflect.TypeOf((*MockBroker)(nil).JoinGroup), topic, group, member)
+}
+
+// LeaveGroup mocks base method.
+func (m *MockBroker) LeaveGroup(topic, group, member string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LeaveGroup", topic, group, member)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// LeaveGroup indicates an expected call of LeaveGroup.
+func (mr *MockBrokerMockRecorder) LeaveGroup(topic, group, member interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LeaveGroup", reflect.TypeOf((*MockBroker)(nil).LeaveGroup), topic, group, member)
+}
+
+// Nack mocks base method.
+func (m *MockBroker) Nack(topic, subscription string, offset uint64, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Nack", topic, subscription, offset, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Nack indicates an expected call of Nack.
+func (mr *MockBrokerMockRecorder) Nack(topic, subscription, offset, reason interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockBroker)(nil).Nack), topic, subscription, offset, reason)
+}
+
+// Next mocks base method.
+func (m *MockBroker) Next(ctx context.Context, c *consumer.Consumer) (*store.Value, uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Next", ctx, c)
+	ret0, _ := ret[0].(*store.Value)
+	ret1, _ := ret[1].(uint64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Next indicates an expected call of Next.
+func (mr *MockBrokerMockRecorder) Next(ctx, c interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Next", reflect.TypeOf((*MockBroker)(nil).Next), ctx, c)
+}
+
+// NextN mocks base method.
+func (m *MockBroker) NextN(ctx context.Context, c *consumer.Consumer, n int) ([]*store.Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NextN", ctx, c, n)
+	ret0, _ := ret[0].([]*store.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NextN indicates an expected call of NextN.
+func (mr *MockBrokerMockRecorder) NextN(ctx, c, n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NextN", reflect.TypeOf((*MockBroker)(nil).NextN), ctx, c, n)
+}
+
 // Publish mocks base method.
-func (m *MockBroker) Publish(topic string, value *store.Value) error {
+func (m *MockBroker) Publish(topic string, value *store.Value, opts ...PublishOption) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Publish", topic, value)
+	varargs := []interface{}{topic, value}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Publish", varargs...)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Publish indicates an expected call of Publish.
-func (mr *MockBrokerMockRecorder) Publish(topic, value interface{}) *gomock.Call {
+func (mr *MockBrokerMockRecorder) Publish(topic, value interface{}, opts ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{topic, value}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*MockBroker)(nil).Publish), varargs...)
+}
+
+// PublishBatch mocks base method.
+func (m *MockBroker) PublishBatch(topic string, values []*store.Value, opts ...PublishOption) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{topic, values}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "PublishBatch", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PublishBatch indicates an expected call of PublishBatch.
+func (mr *MockBrokerMockRecorder) PublishBatch(topic, values interface{}, opts ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*MockBroker)(nil).Publish), topic, value)
+	varargs := append([]interface{}{topic, values}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishBatch", reflect.TypeOf((*MockBroker)(nil).PublishBatch), varargs...)
+}
+
+// PublishIdempotent mocks base method.
+func (m *MockBroker) PublishIdempotent(topic, key string, value *store.Value, opts ...PublishOption) (*store.Receipt, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{topic, key, value}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "PublishIdempotent", varargs...)
+	ret0, _ := ret[0].(*store.Receipt)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PublishIdempotent indicates an expected call of PublishIdempotent.
+func (mr *MockBrokerMockRecorder) PublishIdempotent(topic, key, value interface{}, opts ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{topic, key, value}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishIdempotent", reflect.TypeOf((*MockBroker)(nil).PublishIdempotent), varargs...)
+}
+
+// Purge mocks base method.
+func (m *MockBroker) Purge(topic string) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Purge", topic)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Purge indicates an expected call of Purge.
+func (mr *MockBrokerMockRecorder) Purge(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Purge", reflect.TypeOf((*MockBroker)(nil).Purge), topic)
+}
+
+// ReadStream mocks base method.
+func (m *MockBroker) ReadStream(ctx context.Context, topic string, offset uint64, n int) ([]*store.Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadStream", ctx, topic, offset, n)
+	ret0, _ := ret[0].([]*store.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadStream indicates an expected call of ReadStream.
+func (mr *MockBrokerMockRecorder) ReadStream(ctx, topic, offset, n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadStream", reflect.TypeOf((*MockBroker)(nil).ReadStream), ctx, topic, offset, n)
+}
+
+// Redrive mocks base method.
+func (m *MockBroker) Redrive(dlq string, max uint64) (map[string]uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Redrive", dlq, max)
+	ret0, _ := ret[0].(map[string]uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Redrive indicates an expected call of Redrive.
+func (mr *MockBrokerMockRecorder) Redrive(dlq, max interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Redrive", reflect.TypeOf((*MockBroker)(nil).Redrive), dlq, max)
+}
+
+// Seek mocks base method.
+func (m *MockBroker) Seek(topic string, pos store.Position) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Seek", topic, pos)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Seek indicates an expected call of Seek.
+func (mr *MockBrokerMockRecorder) Seek(topic, pos interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Seek", reflect.TypeOf((*MockBroker)(nil).Seek), topic, pos)
+}
+
+// Stats mocks base method.
+func (m *MockBroker) Stats(topic string) (*store.TopicStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats", topic)
+	ret0, _ := ret[0].(*store.TopicStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stats indicates an expected call of Stats.
+func (mr *MockBrokerMockRecorder) Stats(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*MockBroker)(nil).Stats), topic)
 }
 
 // Subscribe mocks base method.
-func (m *MockBroker) Subscribe(topic string) *consumer.Consumer {
+func (m *MockBroker) Subscribe(topic string) (*consumer.Consumer, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Subscribe", topic)
 	ret0, _ := ret[0].(*consumer.Consumer)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // Subscribe indicates an expected call of Subscribe.
@@ -63,6 +358,51 @@ func (mr *MockBrokerMockRecorder) Subscribe(topic interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*MockBroker)(nil).Subscribe), topic)
 }
 
+// SubscribeDurable mocks base method.
+func (m *MockBroker) SubscribeDurable(topic, name string) (*consumer.Consumer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SubscribeDurable", topic, name)
+	ret0, _ := ret[0].(*consumer.Consumer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SubscribeDurable indicates an expected call of SubscribeDurable.
+func (mr *MockBrokerMockRecorder) SubscribeDurable(topic, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SubscribeDurable", reflect.TypeOf((*MockBroker)(nil).SubscribeDurable), topic, name)
+}
+
+// TopicConfig mocks base method.
+func (m *MockBroker) TopicConfig(topic string) (*store.TopicConfig, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopicConfig", topic)
+	ret0, _ := ret[0].(*store.TopicConfig)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TopicConfig indicates an expected call of TopicConfig.
+func (mr *MockBrokerMockRecorder) TopicConfig(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopicConfig", reflect.TypeOf((*MockBroker)(nil).TopicConfig), topic)
+}
+
+// Topics mocks base method.
+func (m *MockBroker) Topics() ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Topics")
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Topics indicates an expected call of Topics.
+func (mr *MockBrokerMockRecorder) Topics() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Topics", reflect.TypeOf((*MockBroker)(nil).Topics))
+}
+
 // Unsubscribe mocks base method.
 func (m *MockBroker) Unsubscribe(topic, id string) error {
 	m.ctrl.T.Helper()
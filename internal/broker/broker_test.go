@@ -1,9 +1,12 @@
 package broker
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
 	"github.com/nireo/rq/internal/consumer"
 	"github.com/nireo/rq/internal/store"
 	"github.com/stretchr/testify/require"
@@ -18,7 +21,7 @@ func TestPublish(t *testing.T) {
   mockStore := store.NewMockStore(ctrl)
   mockStore.EXPECT().Insert([]byte("test_topic"), val)
 
-  b := NewBroker(mockStore)
+  b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
 
   require.NoError(t, b.Publish("test_topic", val))
 }
@@ -28,10 +31,12 @@ func TestSubscribe(t *testing.T) {
   defer ctrl.Finish()
 
   mockStore := store.NewMockStore(ctrl)
+  mockStore.EXPECT().TopicConfig([]byte("test_topic")).Return(store.DefaultTopicConfig(), nil)
 
-  b := NewBroker(mockStore)
-  cons := b.Subscribe("test_topic")
+  b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+  cons, err := b.Subscribe("test_topic")
 
+  require.NoError(t, err)
   require.IsType(t, &consumer.Consumer{}, cons)
 }
 
@@ -47,11 +52,13 @@ func TestUnsubscribe(t *testing.T) {
       name: "removes consumer from topic",
       fn: func(t *testing.T) {
         b := broker{
+          store:     newQueueStore(t),
           consumers: map[string][]*consumer.Consumer{},
         }
 
-        c := b.Subscribe(topic)
-        err := b.Unsubscribe(topic, c.ID)
+        c, err := b.Subscribe(topic)
+        require.NoError(t, err)
+        err = b.Unsubscribe(topic, c.ID)
 
         require.NoError(t, err)
         require.Len(t, b.consumers[topic], 0)
@@ -61,13 +68,16 @@ func TestUnsubscribe(t *testing.T) {
       name: "removes correct consumer from many",
       fn: func(t *testing.T) {
         b := broker{
+          store:     newQueueStore(t),
           consumers: map[string][]*consumer.Consumer{},
         }
 
-        c1 := b.Subscribe(topic)
-        c2 := b.Subscribe(topic)
+        c1, err := b.Subscribe(topic)
+        require.NoError(t, err)
+        c2, err := b.Subscribe(topic)
+        require.NoError(t, err)
 
-        err := b.Unsubscribe(topic, c1.ID)
+        err = b.Unsubscribe(topic, c1.ID)
         require.NoError(t, err)
         require.Len(t, b.consumers[topic], 1)
         require.Equal(t, c2.ID, b.consumers[topic][0].ID)
@@ -77,6 +87,7 @@ func TestUnsubscribe(t *testing.T) {
       name: "error if consumer non existant consumer",
       fn: func(t *testing.T) {
         b := broker{
+          store:     newQueueStore(t),
           consumers: map[string][]*consumer.Consumer{},
         }
 
@@ -90,3 +101,331 @@ func TestUnsubscribe(t *testing.T) {
     t.Run(testCase.name, testCase.fn)
   }
 }
+
+// newQueueStore returns a mock store in which every topic is a queue topic.
+func newQueueStore(t *testing.T) *store.MockStore {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().TopicConfig(gomock.Any()).Return(store.DefaultTopicConfig(), nil).AnyTimes()
+
+	return mockStore
+}
+
+func TestSubscribe_Fanout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().TopicConfig(topic).Return(&store.TopicConfig{Mode: store.ModeFanout}, nil)
+	mockStore.EXPECT().AddSubscription(topic, gomock.Any(), false).Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	c, err := b.Subscribe(string(topic))
+	require.NoError(t, err)
+	require.Equal(t, c.ID, c.Subscription)
+	require.Equal(t, store.SubscriptionTopic(topic, []byte(c.ID)), c.Topic)
+
+	mockStore.EXPECT().RemoveSubscription(topic, []byte(c.ID)).Return(nil)
+	require.NoError(t, b.Unsubscribe(string(topic), c.ID))
+}
+
+func TestNotify(t *testing.T) {
+	topic := "test_topic"
+	newConsumer := func(sub string) *consumer.Consumer {
+		return &consumer.Consumer{Subscription: sub, EvChan: make(chan consumer.EvType, 1)}
+	}
+
+	consumers := []*consumer.Consumer{newConsumer("a"), newConsumer("a"), newConsumer("b")}
+	b := broker{
+		consumers: map[string][]*consumer.Consumer{topic: consumers},
+	}
+
+	b.Notify(topic, consumer.EvPub)
+	b.Notify(topic, consumer.EvPub)
+
+	for _, c := range consumers {
+		require.Len(t, c.EvChan, 1)
+	}
+}
+
+func TestReap(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := "test_topic"
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().RequeueExpired(gomock.Any()).Return([][]byte{[]byte(topic)}, nil).MinTimes(1)
+	mockStore.EXPECT().Close().Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(time.Millisecond), WithScheduleInterval(0)).(*broker)
+	c := &consumer.Consumer{EvChan: make(chan consumer.EvType)}
+	b.addConsumer(topic, c)
+
+	select {
+	case ev := <-c.EvChan:
+		require.Equal(t, consumer.EvRet, ev)
+	case <-time.After(time.Second):
+		t.Fatal("consumer was not notified about requeued messages")
+	}
+
+	require.NoError(t, b.Close())
+}
+
+func TestPublish_Delay(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	val := store.NewValue([]byte("test_value"))
+	deliverAt := time.Now().Add(time.Hour)
+
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().Schedule(topic, val, deliverAt).Return(nil)
+	mockStore.EXPECT().Insert(topic, val).Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	require.NoError(t, b.Publish(string(topic), val, WithDeliverAt(deliverAt)))
+	require.NoError(t, b.Publish(string(topic), val, WithDelay(-time.Second)))
+}
+
+func TestPublishBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	vals := []*store.Value{store.NewValue([]byte("value_1")), store.NewValue([]byte("value_2"))}
+
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().InsertBatch(topic, vals).Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0)).(*broker)
+	c := &consumer.Consumer{EvChan: make(chan consumer.EvType, 1)}
+	b.addConsumer(string(topic), c)
+
+	require.NoError(t, b.PublishBatch(string(topic), vals))
+	require.Equal(t, consumer.EvPub, <-c.EvChan)
+	for _, val := range vals {
+		require.NotEqual(t, uuid.Nil, val.ID)
+		require.False(t, val.PublishedAt.IsZero())
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := "test_topic"
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().PromoteDue(gomock.Any()).Return([][]byte{[]byte(topic)}, nil).MinTimes(1)
+	mockStore.EXPECT().Close().Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(time.Millisecond)).(*broker)
+	c := &consumer.Consumer{EvChan: make(chan consumer.EvType)}
+	b.addConsumer(topic, c)
+
+	select {
+	case ev := <-c.EvChan:
+		require.Equal(t, consumer.EvPub, ev)
+	case <-time.After(time.Second):
+		t.Fatal("consumer was not notified about scheduled messages")
+	}
+
+	require.NoError(t, b.Close())
+}
+
+func TestNext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	val := store.NewValue([]byte("test_value"))
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().TopicConfig(topic).Return(store.DefaultTopicConfig(), nil)
+	gomock.InOrder(
+		mockStore.EXPECT().GetNext(topic).Return(nil, uint64(0), store.ErrEmpty),
+		mockStore.EXPECT().Insert(topic, val).Return(nil),
+		mockStore.EXPECT().GetNext(topic).Return(val, uint64(3), nil),
+	)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	c, err := b.Subscribe(string(topic))
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Publish(string(topic), val)
+	}()
+
+	got, offset, err := b.Next(context.Background(), c)
+	require.NoError(t, err)
+	require.Equal(t, val, got)
+	require.Equal(t, uint64(3), offset)
+	require.Equal(t, []uint64{3}, c.Outstanding())
+}
+
+func TestUnsubscribe_NacksOutstanding(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	val := store.NewValue([]byte("test_value"))
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().TopicConfig(topic).Return(store.DefaultTopicConfig(), nil)
+	mockStore.EXPECT().GetNextN(topic, 2).Return([]*store.Message{
+		{Offset: 1, Value: val},
+		{Offset: 2, Value: val},
+	}, nil)
+	mockStore.EXPECT().Nack(topic, uint64(1), ReasonUnsubscribed).Return(nil)
+	mockStore.EXPECT().Nack(topic, uint64(2), ReasonUnsubscribed).Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	c, err := b.Subscribe(string(topic))
+	require.NoError(t, err)
+	c.Prefetch = 2
+
+	msgs, err := b.NextN(context.Background(), c, 5)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+
+	require.NoError(t, b.Unsubscribe(string(topic), c.ID))
+	require.Empty(t, c.Outstanding())
+}
+
+func TestNext_ContextDone(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().TopicConfig(topic).Return(store.DefaultTopicConfig(), nil)
+	mockStore.EXPECT().GetNext(topic).Return(nil, uint64(0), store.ErrEmpty)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	c, err := b.Subscribe(string(topic))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, _, err = b.Next(ctx, c)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestGroups(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	group := []byte("group")
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().AddMember(topic, group, []byte("member_1")).Return(nil).Times(2)
+	mockStore.EXPECT().AddMember(topic, group, []byte("member_2")).Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	c1, err := b.JoinGroup(string(topic), string(group), "member_1")
+	require.NoError(t, err)
+	require.Equal(t, store.SubscriptionTopic(topic, group), c1.Topic)
+	require.Equal(t, string(group), c1.Subscription)
+	require.Equal(t, "member_1", c1.Member)
+	_, err = b.JoinGroup(string(topic), string(group), "member_1")
+	require.NoError(t, err)
+	_, err = b.JoinGroup(string(topic), string(group), "member_2")
+	require.NoError(t, err)
+
+	mockStore.EXPECT().GetNext(c1.Topic).Return(store.NewValue([]byte("value")), uint64(1), nil)
+	_, _, err = c1.Next()
+	require.NoError(t, err)
+
+	mockStore.EXPECT().Groups(topic).Return([]*store.Group{{
+		Name:    string(group),
+		Members: []*store.Member{{Name: "member_1"}, {Name: "member_2"}, {Name: "member_3"}},
+	}}, nil)
+	groups, err := b.Groups(string(topic))
+	require.NoError(t, err)
+	require.Equal(t, 2, groups[0].Members[0].Connections)
+	require.Equal(t, 1, groups[0].Members[0].Outstanding)
+	require.Equal(t, 1, groups[0].Members[1].Connections)
+	require.Equal(t, 0, groups[0].Members[2].Connections)
+
+	mockStore.EXPECT().RemoveMember(topic, group, []byte("member_1")).Return(nil)
+	mockStore.EXPECT().Nack(c1.Topic, uint64(1), ReasonUnsubscribed).Return(nil)
+	require.NoError(t, b.LeaveGroup(string(topic), string(group), "member_1"))
+	require.Len(t, b.(*broker).consumers[string(topic)], 1)
+	require.Empty(t, c1.Outstanding())
+}
+
+func TestReadStream(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	val := store.NewValue([]byte("test_value"))
+	mockStore := store.NewMockStore(ctrl)
+	gomock.InOrder(
+		mockStore.EXPECT().Read(topic, uint64(4), 10).Return(nil, store.ErrEmpty),
+		mockStore.EXPECT().Insert(topic, val).Return(nil),
+		mockStore.EXPECT().Read(topic, uint64(4), 10).Return([]*store.Message{{Offset: 4, Value: val}}, nil),
+	)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Publish(string(topic), val)
+	}()
+
+	msgs, err := b.ReadStream(context.Background(), string(topic), 4, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Empty(t, b.(*broker).consumers[string(topic)])
+
+	mockStore.EXPECT().Read(topic, uint64(5), 10).Return(nil, store.ErrEmpty)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = b.ReadStream(ctx, string(topic), 5, 10)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestPublish_TTL(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	val := store.NewValue([]byte("test_value"))
+	delayed := store.NewValue([]byte("test_value"))
+	deliverAt := time.Now().Add(time.Hour)
+
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().Insert(topic, val).Return(nil)
+	mockStore.EXPECT().Schedule(topic, delayed, deliverAt).Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	require.NoError(t, b.Publish(string(topic), val, WithTTL(time.Minute)))
+	require.Equal(t, val.PublishedAt.Add(time.Minute), val.ExpiresAt)
+
+	require.NoError(t, b.Publish(string(topic), delayed, WithDeliverAt(deliverAt), WithTTL(time.Minute)))
+	require.True(t, delayed.ExpiresAt.Equal(deliverAt.Add(time.Minute)))
+}
+
+func TestPublishIdempotent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	key := []byte("test_key")
+	val := store.NewValue([]byte("test_value"))
+	receipt := &store.Receipt{Offset: 3}
+
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().InsertIdempotent(topic, key, val, time.Time{}).Return(receipt, nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	got, err := b.PublishIdempotent(string(topic), string(key), val)
+	require.NoError(t, err)
+	require.Equal(t, receipt, got)
+	require.NotEqual(t, uuid.Nil, val.ID)
+}
+
+func TestPublish_GroupKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	val := store.NewValue([]byte("test_value"))
+
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().Insert(topic, val).Return(nil)
+
+	b := NewBroker(mockStore, WithReapInterval(0), WithScheduleInterval(0))
+	require.NoError(t, b.Publish(string(topic), val, WithGroupKey("order-123")))
+	require.Equal(t, "order-123", val.GroupKey)
+}
@@ -1,7 +1,11 @@
 package consumer
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/nireo/rq/internal/store"
 )
@@ -12,31 +16,245 @@ const (
 	EvPub EvType = iota
 	EvNack
 	EvRet
+	// EvAck is sent after a message is acknowledged, which releases the next message of its
+	// group.
+	EvAck
 )
 
+var (
+	ErrPrefetchFull   = errors.New("consumer has reached its prefetch limit")
+	ErrNotOutstanding = errors.New("offset is not outstanding for the consumer")
+)
+
+// Consumer reads messages from a topic. Topic is the queue the consumer reads from, which for
+// consumers of fan-out topics is the queue of the subscription named by Subscription. Member is
+// set for consumers of a consumer group, in which case Subscription is the name of the group.
 type Consumer struct {
-	ID          string
-	Topic       []byte
-	AckOffset   uint64
-	Store       store.Store
-	EvChan      chan EvType
-	Outstanding bool
+	ID           string
+	Topic        []byte
+	Subscription string
+	Member       string
+	// Notify is called with EvNack after the consumer returns a message to its topic and with
+	// EvAck after it acknowledges messages, so that other consumers waiting for messages can be
+	// woken up.
+	Notify func(ev EvType)
+	Store  store.Store
+	EvChan chan EvType
+	// Prefetch is how many leased messages the consumer can have outstanding at once. Zero is
+	// treated as one.
+	Prefetch int
+
+	mu          sync.Mutex
+	outstanding map[uint64]struct{}
+}
+
+// Next leases the next message of the consumer's topic. It returns ErrPrefetchFull if the consumer
+// already has as many outstanding messages as its prefetch allows.
+func (c *Consumer) Next() (*store.Value, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.window() == 0 {
+		return nil, 0, ErrPrefetchFull
+	}
+
+	val, offset, err := c.Store.GetNext(c.Topic)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get next value for topic [%s]: %w", string(c.Topic), err)
+	}
+	c.track(offset)
+
+	return val, offset, nil
+}
+
+// NextN leases up to n messages at once, limited by the free space in the consumer's prefetch
+// window.
+func (c *Consumer) NextN(n int) ([]*store.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	window := c.window()
+	if window == 0 {
+		return nil, ErrPrefetchFull
+	}
+
+	msgs, err := c.Store.GetNextN(c.Topic, min(n, window))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get next values for topic [%s]: %w", string(c.Topic), err)
+	}
+	for _, msg := range msgs {
+		c.track(msg.Offset)
+	}
+
+	return msgs, nil
+}
+
+// Ack acknowledges an outstanding message. If the message's lease has expired and it has been
+// returned to the topic, the returned error wraps store.ErrKeyDoesntExist.
+func (c *Consumer) Ack(offset uint64) error {
+	c.mu.Lock()
+	err := c.ack(offset)
+	c.mu.Unlock()
+
+	if err == nil && c.Notify != nil {
+		c.Notify(EvAck)
+	}
+
+	return err
+}
+
+// AckUpTo acknowledges every outstanding message with an offset up to and including the given
+// offset. All of the messages are attempted even if some of them fail.
+func (c *Consumer) AckUpTo(offset uint64) error {
+	c.mu.Lock()
+	var (
+		errs  []error
+		acked bool
+	)
+	for _, o := range c.offsets() {
+		if o > offset {
+			break
+		}
+		if err := c.ack(o); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		acked = true
+	}
+	c.mu.Unlock()
+
+	if acked && c.Notify != nil {
+		c.Notify(EvAck)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Consumer) ack(offset uint64) error {
+	if _, ok := c.outstanding[offset]; !ok {
+		return ErrNotOutstanding
+	}
+
+	if err := c.Store.Ack(c.Topic, offset); err != nil {
+		if errors.Is(err, store.ErrKeyDoesntExist) {
+			delete(c.outstanding, offset)
+		}
+		return fmt.Errorf("failed to acknowledge topic [%s] with offset [%d]: %w", string(c.Topic), offset, err)
+	}
+	delete(c.outstanding, offset)
+
+	return nil
 }
 
-func (c *Consumer) Ack() error {
-	if err := c.Store.Ack(c.Topic, c.AckOffset); err != nil {
-		return fmt.Errorf("failed to acknowledge topic [%s] with offset [%d]: %v", string(c.Topic), c.AckOffset, err)
+// Nack returns an outstanding message to the topic. The reason is recorded if the message is
+// moved to a dead-letter topic.
+func (c *Consumer) Nack(offset uint64, reason string) error {
+	c.mu.Lock()
+	err := c.nack(offset, reason)
+	c.mu.Unlock()
+
+	if err == nil && c.Notify != nil {
+		c.Notify(EvNack)
 	}
-	c.Outstanding = false
+
+	return err
+}
+
+// NackAll returns every outstanding message to the topic. All of the messages are attempted even
+// if some of them fail.
+func (c *Consumer) NackAll(reason string) error {
+	c.mu.Lock()
+	var (
+		errs   []error
+		nacked bool
+	)
+	for _, offset := range c.offsets() {
+		if err := c.nack(offset, reason); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		nacked = true
+	}
+	c.mu.Unlock()
+
+	if nacked && c.Notify != nil {
+		c.Notify(EvNack)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Consumer) nack(offset uint64, reason string) error {
+	if _, ok := c.outstanding[offset]; !ok {
+		return ErrNotOutstanding
+	}
+
+	if err := c.Store.Nack(c.Topic, offset, reason); err != nil {
+		if errors.Is(err, store.ErrKeyDoesntExist) {
+			delete(c.outstanding, offset)
+		}
+		return fmt.Errorf("failed to nacking topic [%s] with offset [%d]: %w", string(c.Topic), offset, err)
+	}
+	delete(c.outstanding, offset)
 
 	return nil
 }
 
-func (c *Consumer) Nack() error {
-	if err := c.Store.Nack(c.Topic, c.AckOffset); err != nil {
-		return fmt.Errorf("failed to nacking topic [%s] with offset [%d]: %v", string(c.Topic), c.AckOffset, err)
+// Release gives up the responsibility for the outstanding messages without acknowledging them, so
+// that unsubscribing doesn't return them to the topic. The messages have to be acknowledged through
+// the store using their offsets, or they're returned to the topic once their leases expire.
+func (c *Consumer) Release() {
+	c.mu.Lock()
+	c.outstanding = nil
+	c.mu.Unlock()
+}
+
+// Touch extends the lease of an outstanding message. A zero duration extends it by the topic's
+// visibility timeout.
+func (c *Consumer) Touch(offset uint64, extend time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.outstanding[offset]; !ok {
+		return ErrNotOutstanding
+	}
+
+	if err := c.Store.Touch(c.Topic, offset, extend); err != nil {
+		if errors.Is(err, store.ErrKeyDoesntExist) {
+			delete(c.outstanding, offset)
+		}
+		return fmt.Errorf("failed to touch topic [%s] with offset [%d]: %w", string(c.Topic), offset, err)
 	}
-	c.Outstanding = false
 
 	return nil
 }
+
+// Outstanding returns the offsets of the outstanding messages in ascending order.
+func (c *Consumer) Outstanding() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.offsets()
+}
+
+func (c *Consumer) offsets() []uint64 {
+	offsets := make([]uint64, 0, len(c.outstanding))
+	for offset := range c.outstanding {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	return offsets
+}
+
+// window returns how many more messages the consumer can lease.
+func (c *Consumer) window() int {
+	return max(max(c.Prefetch, 1)-len(c.outstanding), 0)
+}
+
+func (c *Consumer) track(offset uint64) {
+	if c.outstanding == nil {
+		c.outstanding = make(map[uint64]struct{})
+	}
+	c.outstanding[offset] = struct{}{}
+}
@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/nireo/rq/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	val := store.NewValue([]byte("test_value"))
+	mockStore := store.NewMockStore(ctrl)
+	gomock.InOrder(
+		mockStore.EXPECT().GetNext(topic).Return(val, uint64(1), nil),
+		mockStore.EXPECT().GetNextN(topic, 2).Return([]*store.Message{
+			{Offset: 2, Value: val},
+			{Offset: 3, Value: val},
+		}, nil),
+		mockStore.EXPECT().Ack(topic, uint64(1)).Return(nil),
+		mockStore.EXPECT().Ack(topic, uint64(2)).Return(nil),
+		mockStore.EXPECT().Touch(topic, uint64(3), gomock.Any()).Return(nil),
+		mockStore.EXPECT().Nack(topic, uint64(3), "failure").Return(nil),
+	)
+
+	events := make(map[EvType]int)
+	c := &Consumer{
+		Topic:    topic,
+		Store:    mockStore,
+		Prefetch: 3,
+		Notify:   func(ev EvType) { events[ev]++ },
+	}
+
+	_, offset, err := c.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+
+	msgs, err := c.NextN(10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, []uint64{1, 2, 3}, c.Outstanding())
+
+	_, _, err = c.Next()
+	require.ErrorIs(t, err, ErrPrefetchFull)
+
+	require.NoError(t, c.AckUpTo(2))
+	require.Equal(t, []uint64{3}, c.Outstanding())
+	require.ErrorIs(t, c.Ack(2), ErrNotOutstanding)
+
+	require.NoError(t, c.Touch(3, 0))
+	require.NoError(t, c.NackAll("failure"))
+	require.Empty(t, c.Outstanding())
+	require.Equal(t, map[EvType]int{EvAck: 1, EvNack: 1}, events)
+}
+
+func TestAck_Expired(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	topic := []byte("test_topic")
+	mockStore := store.NewMockStore(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return(store.NewValue(nil), uint64(1), nil)
+	mockStore.EXPECT().Ack(topic, uint64(1)).Return(store.ErrKeyDoesntExist)
+
+	c := &Consumer{Topic: topic, Store: mockStore}
+
+	_, _, err := c.Next()
+	require.NoError(t, err)
+	require.ErrorIs(t, c.Ack(1), store.ErrKeyDoesntExist)
+	require.Empty(t, c.Outstanding())
+}
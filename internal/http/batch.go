@@ -0,0 +1,178 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/nireo/rq/internal/consumer"
+	"github.com/nireo/rq/internal/store"
+)
+
+// maxBatch is the largest amount of messages published or leased in a single request.
+const maxBatch = 1000
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// PublishBatch handles POST /publish/batch?topic=x and inserts every message of the body into the
+// topic atomically. A body with the JSON content type is a JSON array with one element per message,
+// while any other body has one message per line, such as newline-delimited JSON. The query and
+// the X-Rq-* headers apply to every message, same as on /publish. With a Content-Encoding every
+// message is compressed on its own and limited to the maximum message size. Batches can't be
+// published with an Idempotency-Key. It responds with the IDs of the published messages.
+func (s *Server) PublishBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		http.Error(w, "no topic provided", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := publishOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	priority, err := parsePriority(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get(headerIdempotencyKey) != "" {
+		http.Error(w, errIdempotentBatch.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compression, err := contentEncoding(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, errReadBody.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	msgs, err := splitBatch(contentType, b)
+	if err != nil || len(msgs) == 0 || len(msgs) > maxBatch {
+		http.Error(w, errInvalidBatch.Error(), http.StatusBadRequest)
+		return
+	}
+
+	headers := valueHeaders(r.Header)
+	if contentType == contentTypeJSON || contentType == contentTypeNDJSON {
+		// every message of a JSON batch is a JSON document of its own.
+		headers["Content-Type"] = contentTypeJSON
+	}
+
+	vals := make([]*store.Value, len(msgs))
+	for i, msg := range msgs {
+		val, ok := s.newValue(w, msg, compression)
+		if !ok {
+			return
+		}
+		vals[i] = val
+		vals[i].Headers = maps.Clone(headers)
+		vals[i].Priority = priority
+	}
+
+	if err := s.broker.PublishBatch(topic, vals, opts...); err != nil {
+		writePublishErr(w, err)
+		return
+	}
+
+	ids := make([]string, len(vals))
+	for i, val := range vals {
+		ids[i] = val.ID.String()
+	}
+	writeJSON(w, http.StatusCreated, map[string][]string{"ids": ids})
+}
+
+// splitBatch splits a batch body into its messages. JSON bodies are arrays of messages and other
+// bodies contain a message per line, with empty lines skipped.
+func splitBatch(contentType string, body []byte) ([][]byte, error) {
+	if contentType == contentTypeJSON {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(body, &elems); err != nil {
+			return nil, err
+		}
+
+		msgs := make([][]byte, len(elems))
+		for i, elem := range elems {
+			msgs[i] = elem
+		}
+		return msgs, nil
+	}
+
+	var msgs [][]byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) > 0 {
+			msgs = append(msgs, line)
+		}
+	}
+
+	return msgs, nil
+}
+
+// nextBatch leases up to n messages for the consumer and writes them as frames, see writeFrames.
+func (s *Server) nextBatch(ctx context.Context, w http.ResponseWriter, r *http.Request, csm *consumer.Consumer, n int) {
+	msgs, err := s.broker.NextN(ctx, csm, n)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if errors.Is(err, store.ErrStream) {
+		http.Error(w, store.ErrStream.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, errNextValue.Error(), http.StatusInternalServerError)
+		return
+	}
+	csm.Release()
+
+	writeFrames(w, r, msgs)
+}
+
+// writeFrames writes a frame for every message, as newline-delimited JSON if the client accepts it
+// and as a JSON array otherwise.
+func writeFrames(w http.ResponseWriter, r *http.Request, msgs []*store.Message) {
+	frames := make([]frame, len(msgs))
+	for i, msg := range msgs {
+		frames[i] = valueFrame(msg.Offset, msg.Value, r.Header)
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), contentTypeNDJSON) {
+		writeJSON(w, http.StatusOK, frames)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for _, f := range frames {
+		encoder.Encode(f)
+	}
+}
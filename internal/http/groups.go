@@ -0,0 +1,64 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nireo/rq/internal/store"
+)
+
+// groups handles the consumer group routes of a topic: GET /topics/{name}/groups lists the groups
+// of the topic, GET /topics/{name}/groups/{group} describes a single group and
+// DELETE /topics/{name}/groups/{group}/members/{member} removes a member from a group. The path is
+// what follows /groups.
+func (s *Server) groups(w http.ResponseWriter, r *http.Request, topic, path string) {
+	if topic == "" {
+		http.Error(w, "no topic provided", http.StatusBadRequest)
+		return
+	}
+
+	if group, member, ok := strings.Cut(path, "/members/"); ok {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.broker.LeaveGroup(topic, group, member); err != nil {
+			if errors.Is(err, store.ErrMemberNotFound) {
+				http.Error(w, store.ErrMemberNotFound.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, errLeaveGroup.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groups, err := s.broker.Groups(topic)
+	if err != nil {
+		writeTopicErr(w, err, errGroups)
+		return
+	}
+
+	if path == "" {
+		writeJSON(w, http.StatusOK, groups)
+		return
+	}
+
+	for _, g := range groups {
+		if g.Name == path {
+			writeJSON(w, http.StatusOK, g)
+			return
+		}
+	}
+	http.Error(w, "group not found", http.StatusNotFound)
+}
@@ -0,0 +1,135 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nireo/rq/internal/store"
+)
+
+// headerPrefix is the prefix of the HTTP headers carrying message metadata. A request header
+// such as X-Rq-Correlation-Id is stored as the message header Correlation-Id and is returned as
+// the same HTTP header when the message is consumed.
+const headerPrefix = "X-Rq-"
+
+const (
+	headerID               = headerPrefix + "Id"
+	headerOffset           = headerPrefix + "Offset"
+	headerDacks            = headerPrefix + "Dacks"
+	headerPriority         = headerPrefix + "Priority"
+	headerPublishedAt      = headerPrefix + "Published-At"
+	headerFirstDeliveredAt = headerPrefix + "First-Delivered-At"
+	headerNextOffset       = headerPrefix + "Next-Offset"
+	headerExpiresAt        = headerPrefix + "Expires-At"
+	headerGroupKey         = headerPrefix + "Group-Key"
+	// headerEncoding is set if the payload is returned in its stored, compressed form.
+	headerEncoding = headerPrefix + "Encoding"
+
+	// headerIdempotencyKey deduplicates retried publishes, see broker.PublishIdempotent. Responses
+	// to a repeated key carry headerIdempotentReplayed.
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// reservedHeaders are set by the server and can't be used as message headers.
+var reservedHeaders = map[string]bool{
+	headerID:               true,
+	headerOffset:           true,
+	headerDacks:            true,
+	headerPriority:         true,
+	headerPublishedAt:      true,
+	headerFirstDeliveredAt: true,
+	headerNextOffset:       true,
+	headerExpiresAt:        true,
+	headerGroupKey:         true,
+	headerEncoding:         true,
+}
+
+// valueHeaders returns the message headers of a publish request. The request's Content-Type is
+// stored as the Content-Type message header.
+func valueHeaders(h http.Header) map[string]string {
+	var headers map[string]string
+	set := func(key, value string) {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[key] = value
+	}
+
+	for key, values := range h {
+		if name, ok := strings.CutPrefix(key, headerPrefix); ok && name != "" && !reservedHeaders[key] {
+			set(name, values[0])
+		}
+	}
+
+	if ct := h.Get("Content-Type"); ct != "" {
+		set("Content-Type", ct)
+	}
+
+	return headers
+}
+
+// contentEncoding returns the compression of a publish request's body given by its
+// Content-Encoding.
+func contentEncoding(h http.Header) (store.Compression, error) {
+	switch v := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding"))); v {
+	case "", "identity":
+		return store.CompressionNone, nil
+	default:
+		c, err := store.ParseCompression(v)
+		if err != nil || c == store.CompressionNone {
+			return "", errEncoding
+		}
+		return c, nil
+	}
+}
+
+// acceptsEncoding reports whether the Accept-Encoding of a request lists the compression.
+func acceptsEncoding(h http.Header, c store.Compression) bool {
+	for _, values := range h.Values("Accept-Encoding") {
+		for _, v := range strings.Split(values, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(v), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), string(c)) {
+				continue
+			}
+
+			q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+			if !ok {
+				return true
+			}
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+	}
+
+	return false
+}
+
+// setValueHeaders writes the metadata of a consumed message into the response headers.
+func setValueHeaders(h http.Header, offset uint64, val *store.Value) {
+	for key, value := range val.Headers {
+		h.Set(headerPrefix+key, value)
+	}
+
+	h.Set(headerOffset, strconv.FormatUint(offset, 10))
+	h.Set(headerDacks, strconv.FormatUint(uint64(val.Dacks), 10))
+	h.Set(headerPriority, strconv.FormatUint(uint64(val.Priority), 10))
+	if val.ID != uuid.Nil {
+		h.Set(headerID, val.ID.String())
+	}
+	if !val.PublishedAt.IsZero() {
+		h.Set(headerPublishedAt, val.PublishedAt.Format(time.RFC3339Nano))
+	}
+	if !val.FirstDeliveredAt.IsZero() {
+		h.Set(headerFirstDeliveredAt, val.FirstDeliveredAt.Format(time.RFC3339Nano))
+	}
+	if !val.ExpiresAt.IsZero() {
+		h.Set(headerExpiresAt, val.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	if val.GroupKey != "" {
+		h.Set(headerGroupKey, val.GroupKey)
+	}
+}
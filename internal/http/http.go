@@ -1,18 +1,67 @@
 package http
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/goccy/go-json"
+	"github.com/google/uuid"
 	"github.com/nireo/rq/internal/broker"
+	"github.com/nireo/rq/internal/consumer"
 	"github.com/nireo/rq/internal/store"
 )
 
+// maxWait is the longest time a request to Next waits for a message.
+const maxWait = 2 * time.Minute
+
 type Server struct {
-	broker broker.Broker
+	broker         broker.Broker
+	maxMessageSize int
+}
+
+type Option func(*Server)
+
+// WithMaxMessageSize limits the decompressed size of published payloads, which defaults to
+// store.DefaultMaxMessageSize. Larger payloads are rejected with 413.
+func WithMaxMessageSize(n int) Option {
+	return func(s *Server) {
+		s.maxMessageSize = n
+	}
+}
+
+func NewServer(b broker.Broker, opts ...Option) *Server {
+	s := &Server{
+		broker: b,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Handler returns a handler with all of the server's routes registered.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/publish", s.Publish)
+	mux.HandleFunc("/publish/batch", s.PublishBatch)
+	mux.HandleFunc("/subscribe", s.Subscribe)
+	mux.HandleFunc("/next", s.Next)
+	mux.HandleFunc("/ack", s.Ack)
+	mux.HandleFunc("/nack", s.Nack)
+	mux.HandleFunc("/read", s.Read)
+	mux.HandleFunc("/commit", s.Commit)
+	mux.HandleFunc("/topics", s.Topics)
+	mux.HandleFunc("/topics/", s.Topic)
+
+	return mux
 }
 
 type httpErr string
@@ -22,13 +71,143 @@ const (
 	errReadBody          = httpErr("error reading the request body")
 	errPublish           = httpErr("error publishing to broker")
 	errNextValue         = httpErr("error getting next value for consumer")
+	errEmpty             = httpErr("topic has no ready messages")
+	errPrefetchFull      = httpErr("prefetch window is full")
 	errAck               = httpErr("error ACKing message")
 	errNack              = httpErr("error NACKing message")
 	errDecodingCmd       = httpErr("error decoding command")
 	errRequestCancelled  = httpErr("request context cancelled")
 	errPurge             = httpErr("failed to purge topic")
+	errUnknownCmd        = httpErr("unknown command")
+	errTouch             = httpErr("error extending message lease")
+	errListTopics        = httpErr("failed to list topics")
+	errTopicStats        = httpErr("failed to get topic stats")
+	errDeleteTopic       = httpErr("failed to delete topic")
+	errSubscribe         = httpErr("failed to subscribe to topic")
+	errDeclareTopic      = httpErr("failed to declare topic")
+	errDecodingConfig    = httpErr("error decoding topic config")
+	errRedrive           = httpErr("failed to redrive dead-letter topic")
+	errInvalidMax        = httpErr("invalid max value")
+	errInvalidWait       = httpErr("invalid wait duration")
+	errInvalidOffset     = httpErr("invalid offset")
+	errInvalidDelay      = httpErr("invalid delay duration")
+	errInvalidDeliverAt  = httpErr("invalid deliver_at time")
+	errInvalidTTL        = httpErr("invalid ttl duration")
+	errInvalidGroupKey   = httpErr("invalid group key")
+	errEncoding          = httpErr("unsupported content encoding")
+	errInvalidPayload    = httpErr("payload doesn't match its content encoding")
+	errInvalidPriority   = httpErr("invalid priority")
+	errInvalidBatch      = httpErr("invalid batch body")
+	errIdempotentBatch   = httpErr("batches can't be published with an idempotency key")
+	errInvalidN          = httpErr("invalid n value")
+	errInvalidPrefetch   = httpErr("invalid prefetch value")
+	errGroups            = httpErr("failed to get consumer groups")
+	errLeaveGroup        = httpErr("failed to remove group member")
+	errInvalidFrom       = httpErr("invalid from position")
+	errRead              = httpErr("error reading stream")
+	errCommit            = httpErr("error committing offset")
+	errFanoutNext        = httpErr("fan-out topics require a subscription or group")
+	errJoinMethod        = httpErr("joining a group as a member requires POST")
+)
+
+// Commands a client can send during a subscribe session.
+const (
+	cmdNext  = "next"
+	cmdAck   = "ack"
+	cmdNack  = "nack"
+	cmdTouch = "touch"
+	cmdClose = "close"
 )
 
+// command is a command sent by the client during a subscribe session. Commands without arguments
+// can be sent as a plain JSON string, e.g. "next" instead of {"cmd":"next"}. Ack, nack and touch
+// apply to the message with the given offset, or to the oldest outstanding message if the offset
+// is omitted. A cumulative ack acknowledges every outstanding message up to the offset. Wait
+// limits how long a next waits for a message, e.g. "30s", where "0s" doesn't wait at all.
+type command struct {
+	Cmd        string  `json:"cmd"`
+	Offset     *uint64 `json:"offset,omitempty"`
+	Cumulative bool    `json:"cumulative,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+	Wait       string  `json:"wait,omitempty"`
+}
+
+// offset returns the offset the command applies to.
+func (c *command) offset(csm *consumer.Consumer) (uint64, bool) {
+	if c.Offset != nil {
+		return *c.Offset, true
+	}
+
+	outstanding := csm.Outstanding()
+	if len(outstanding) == 0 {
+		return 0, false
+	}
+
+	return outstanding[0], true
+}
+
+func (c *command) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &c.Cmd)
+	}
+
+	type plain command
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+// frame is the response written for every command of a subscribe session. Error is set to one
+// of the httpErr values if the command failed.
+type frame struct {
+	Cmd              string            `json:"cmd"`
+	Offset           uint64            `json:"offset"`
+	ID               string            `json:"id,omitempty"`
+	Dacks            uint32            `json:"dacks,omitempty"`
+	Priority         uint8             `json:"priority,omitempty"`
+	PublishedAt      *time.Time        `json:"published_at,omitempty"`
+	FirstDeliveredAt *time.Time        `json:"first_delivered_at,omitempty"`
+	ExpiresAt        *time.Time        `json:"expires_at,omitempty"`
+	GroupKey         string            `json:"group_key,omitempty"`
+	Encoding         string            `json:"encoding,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Value            []byte            `json:"value,omitempty"`
+	DeadLetter       *store.DeadLetter `json:"dead_letter,omitempty"`
+	Error            string            `json:"error,omitempty"`
+}
+
+// valueFrame returns the frame delivering a message to the client. Compressed payloads are
+// delivered in their stored form if the request's Accept-Encoding lists their compression.
+func valueFrame(offset uint64, val *store.Value, h http.Header) frame {
+	f := frame{
+		Cmd:        cmdNext,
+		Offset:     offset,
+		Dacks:      val.Dacks,
+		Priority:   val.Priority,
+		GroupKey:   val.GroupKey,
+		Headers:    val.Headers,
+		Value:      val.Raw,
+		DeadLetter: val.DeadLetter,
+	}
+
+	if val.ID != uuid.Nil {
+		f.ID = val.ID.String()
+	}
+	if !val.PublishedAt.IsZero() {
+		f.PublishedAt = &val.PublishedAt
+	}
+	if !val.FirstDeliveredAt.IsZero() {
+		f.FirstDeliveredAt = &val.FirstDeliveredAt
+	}
+	if !val.ExpiresAt.IsZero() {
+		f.ExpiresAt = &val.ExpiresAt
+	}
+	if packed, c := val.Compressed(); c != store.CompressionNone && acceptsEncoding(h, c) {
+		f.Value = packed
+		f.Encoding = string(c)
+	}
+
+	return f
+}
+
 func (e httpErr) Error() string {
 	return string(e)
 }
@@ -55,13 +234,26 @@ func (f flushWriter) Write(data []byte) (int, error) {
 	return n, err
 }
 
+// Publish inserts the request body into the topic given in the query. The message can be given a
+// priority between 0 and store.MaxPriority, and its delivery can be postponed with either a delay
+// duration or a deliver_at time in RFC 3339 format. A ttl duration expires the message if it isn't
+// delivered in time, and a group_key delivers it only after the earlier messages of its group have
+// been settled. A body compressed with snappy or zstd is stored as is if its Content-Encoding names
+// the compression.
 func (s *Server) Publish(w http.ResponseWriter, r *http.Request) {
-	topic := r.URL.Query().Get("topic")
+	query := r.URL.Query()
+	topic := query.Get("topic")
 	if topic == "" {
 		http.Error(w, "no topic provided", http.StatusBadRequest)
 		return
 	}
 
+	opts, err := publishOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "error reading request body", http.StatusInternalServerError)
@@ -69,15 +261,131 @@ func (s *Server) Publish(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	val := store.NewValue(b)
-	if err := s.broker.Publish(topic, val); err != nil {
-		http.Error(w, "error publishing topic", http.StatusInternalServerError)
+	priority, err := parsePriority(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compression, err := contentEncoding(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	val, ok := s.newValue(w, b, compression)
+	if !ok {
+		return
+	}
+	val.Headers = valueHeaders(r.Header)
+	val.Priority = priority
+
+	if key := r.Header.Get(headerIdempotencyKey); key != "" {
+		receipt, err := s.broker.PublishIdempotent(topic, key, val, opts...)
+		if err != nil {
+			writePublishErr(w, err)
+			return
+		}
+
+		w.Header().Set(headerID, receipt.ID.String())
+		if !receipt.Scheduled {
+			w.Header().Set(headerOffset, strconv.FormatUint(receipt.Offset, 10))
+		}
+		if receipt.Duplicate {
+			w.Header().Set(headerIdempotentReplayed, "true")
+		}
+		w.WriteHeader(http.StatusCreated)
 		return
 	}
 
+	if err := s.broker.Publish(topic, val, opts...); err != nil {
+		writePublishErr(w, err)
+		return
+	}
+
+	w.Header().Set(headerID, val.ID.String())
 	w.WriteHeader(http.StatusCreated)
 }
 
+// newValue returns the value of a published payload encoded with the compression. If the payload
+// doesn't match its encoding or is larger than the maximum message size, the error is written to
+// w and false is returned.
+func (s *Server) newValue(w http.ResponseWriter, payload []byte, c store.Compression) (*store.Value, bool) {
+	val, err := store.NewCompressedValue(payload, c, s.maxMessageSize)
+	if errors.Is(err, store.ErrTooLarge) {
+		http.Error(w, store.ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, errInvalidPayload.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return val, true
+}
+
+func parsePriority(query url.Values) (uint8, error) {
+	v := query.Get("priority")
+	if v == "" {
+		return 0, nil
+	}
+
+	priority, err := strconv.ParseUint(v, 10, 8)
+	if err != nil || priority > store.MaxPriority {
+		return 0, errInvalidPriority
+	}
+
+	return uint8(priority), nil
+}
+
+func publishOptions(query url.Values) ([]broker.PublishOption, error) {
+	var opts []broker.PublishOption
+	if v := query.Get("delay"); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil || delay < 0 {
+			return nil, errInvalidDelay
+		}
+		opts = append(opts, broker.WithDelay(delay))
+	}
+
+	if v := query.Get("deliver_at"); v != "" {
+		at, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errInvalidDeliverAt
+		}
+		opts = append(opts, broker.WithDeliverAt(at))
+	}
+
+	if v := query.Get("ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return nil, errInvalidTTL
+		}
+		opts = append(opts, broker.WithTTL(ttl))
+	}
+
+	if v := query.Get("group_key"); v != "" {
+		if len(v) > store.MaxGroupKeyLen {
+			return nil, errInvalidGroupKey
+		}
+		opts = append(opts, broker.WithGroupKey(v))
+	}
+
+	return opts, nil
+}
+
+// Subscribe starts a streaming consume session for the topic given in the query. The client
+// writes JSON encoded commands (next, ack, nack, touch, close) into the request body and the server
+// answers each of them with a single frame in the response body. A nack can carry a reason which
+// is recorded if the message ends up in a dead-letter topic. The prefetch query parameter sets how
+// many messages the client can have outstanding at once, one by default. The consumer is
+// unsubscribed once the client closes the session or disconnects, which also nacks every
+// outstanding message. An optional subscription query parameter joins a durable subscription of a
+// fan-out topic, see subscribe for joining a consumer group.
+//
+// A next waits for a message if the topic is empty, see sessionNext. It fails with errEmpty if no
+// message arrived, errPrefetchFull if the client already has prefetch messages outstanding and
+// store.ErrStream for stream topics. Other failures are answered with errNextValue.
 func (s *Server) Subscribe(w http.ResponseWriter, r *http.Request) {
 	topic := r.URL.Query().Get("topic")
 	if topic == "" {
@@ -85,14 +393,546 @@ func (s *Server) Subscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	csm := s.broker.Subscribe()
-	encoder, decoder := json.NewEncoder(newFlushWriter(w)), json.NewDecoder(r.Body)
+	// HTTP/1.x connections need to explicitly allow reading the body after writing the response.
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, "error enabling full duplex", http.StatusInternalServerError)
+		return
+	}
+
+	var prefetch int
+	if v := r.URL.Query().Get("prefetch"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxBatch {
+			http.Error(w, errInvalidPrefetch.Error(), http.StatusBadRequest)
+			return
+		}
+		prefetch = parsed
+	}
 
+	csm, ok := s.subscribe(w, topic, r.URL.Query())
+	if !ok {
+		return
+	}
+	defer s.broker.Unsubscribe(topic, csm.ID)
+	if prefetch > 0 {
+		csm.Prefetch = prefetch
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	// the session ends once the request is cancelled, e.g. when the server shuts down, instead of
+	// waiting for the next command.
+	stop := context.AfterFunc(r.Context(), func() { rc.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	// commands are decoded by a goroutine of their own, so that a next waiting for a message can
+	// be interrupted by the client's next command.
+	var decodeErr error
+	cmds, done, stopped := make(chan command), make(chan struct{}), make(chan struct{})
+	defer func() {
+		// the body can't be read once the handler returns, so the decoder is stopped first.
+		close(done)
+		if rc.SetReadDeadline(time.Now()) == nil {
+			<-stopped
+		}
+	}()
+	go func() {
+		defer close(stopped)
+		defer close(cmds)
+
+		decoder := json.NewDecoder(r.Body)
+		for {
+			var cmd command
+			if decodeErr = decoder.Decode(&cmd); decodeErr != nil {
+				return
+			}
+
+			select {
+			case cmds <- cmd:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	encoder := json.NewEncoder(newFlushWriter(w))
+	var pending *command
 	for {
-		var cmd string
-		if err := decoder.Decode(&cmd); isDisconnect(err) {
+		var cmd command
+		if pending != nil {
+			cmd, pending = *pending, nil
+		} else {
+			var ok bool
+			if cmd, ok = <-cmds; !ok {
+				if !isDisconnect(decodeErr) && r.Context().Err() == nil {
+					encoder.Encode(frame{Error: errDecodingCmd.Error()})
+				}
+				return
+			}
+		}
+
+		var resp frame
+		switch cmd.Cmd {
+		case cmdNext:
+			resp, pending = s.sessionNext(r, csm, &cmd, cmds)
+		case cmdAck:
+			offset, ok := cmd.offset(csm)
+			resp = frame{Cmd: cmdAck, Offset: offset}
+			if !ok {
+				resp.Error = errAck.Error()
+			} else if cmd.Cumulative {
+				if err := csm.AckUpTo(offset); err != nil {
+					resp.Error = errAck.Error()
+				}
+			} else if err := csm.Ack(offset); err != nil {
+				resp.Error = errAck.Error()
+			}
+		case cmdNack:
+			offset, ok := cmd.offset(csm)
+			resp = frame{Cmd: cmdNack, Offset: offset}
+			if !ok || csm.Nack(offset, cmd.Reason) != nil {
+				resp.Error = errNack.Error()
+			}
+		case cmdTouch:
+			offset, ok := cmd.offset(csm)
+			resp = frame{Cmd: cmdTouch, Offset: offset}
+			if !ok {
+				resp.Error = errTouch.Error()
+			} else if err := csm.Touch(offset, 0); errors.Is(err, store.ErrNoVisibilityTimeout) {
+				resp.Error = store.ErrNoVisibilityTimeout.Error()
+			} else if err != nil {
+				resp.Error = errTouch.Error()
+			}
+		case cmdClose:
+			return
+		default:
+			resp = frame{Cmd: cmd.Cmd, Error: errUnknownCmd.Error()}
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// sessionNext answers a next command of a subscribe session. If the topic is empty it waits until
+// a message is published, the command's wait elapses, the session ends or the client sends its
+// next command, which is returned to be handled after the answer.
+func (s *Server) sessionNext(r *http.Request, csm *consumer.Consumer, cmd *command, cmds <-chan command) (frame, *command) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	if cmd.Wait != "" {
+		wait, err := time.ParseDuration(cmd.Wait)
+		if err != nil || wait < 0 {
+			return frame{Cmd: cmdNext, Error: errInvalidWait.Error()}, nil
+		}
+		ctx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	}
+
+	type result struct {
+		val    *store.Value
+		offset uint64
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		val, offset, err := s.broker.Next(ctx, csm)
+		results <- result{val, offset, err}
+	}()
+
+	var (
+		res  result
+		next *command
+	)
+	select {
+	case res = <-results:
+	case c, ok := <-cmds:
+		if ok {
+			next = &c
+		}
+		// a message leased before the wait was cancelled is still delivered.
+		cancel()
+		res = <-results
+	}
+
+	switch {
+	case res.err == nil:
+		return valueFrame(res.offset, res.val, r.Header), next
+	case errors.Is(res.err, store.ErrEmpty), errors.Is(res.err, context.DeadlineExceeded),
+		errors.Is(res.err, context.Canceled):
+		return frame{Cmd: cmdNext, Error: errEmpty.Error()}, next
+	case errors.Is(res.err, consumer.ErrPrefetchFull):
+		return frame{Cmd: cmdNext, Error: errPrefetchFull.Error()}, next
+	case errors.Is(res.err, store.ErrStream):
+		return frame{Cmd: cmdNext, Error: store.ErrStream.Error()}, next
+	default:
+		return frame{Cmd: cmdNext, Error: errNextValue.Error()}, next
+	}
+}
+
+// Topics handles GET /topics and responds with the names of all topics.
+func (s *Server) Topics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topics, err := s.broker.Topics()
+	if err != nil {
+		http.Error(w, errListTopics.Error(), http.StatusInternalServerError)
+		return
+	}
+	if topics == nil {
+		topics = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, topics)
+}
+
+// Topic handles the routes of a single topic: GET /topics/{name} describes the topic,
+// PUT /topics/{name} declares it with the JSON encoded config in the body, DELETE /topics/{name}
+// deletes it, POST /topics/{name}/purge removes all ready messages and
+// POST /topics/{name}/redrive?max=n moves messages of a dead-letter topic back to their topics.
+// The consumer groups of a topic are handled by groups.
+func (s *Server) Topic(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/topics/")
+	if name, rest, ok := cutSegment(path, "groups"); ok {
+		s.groups(w, r, name, rest)
+		return
+	}
+
+	if name, ok := strings.CutSuffix(path, "/purge"); ok && r.Method == http.MethodPost {
+		s.purge(w, name)
+		return
+	}
+
+	if name, ok := strings.CutSuffix(path, "/redrive"); ok && r.Method == http.MethodPost {
+		s.redrive(w, r, name)
+		return
+	}
+
+	if path == "" {
+		http.Error(w, "no topic provided", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		stats, err := s.broker.Stats(path)
+		if err != nil {
+			writeTopicErr(w, err, errTopicStats)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	case http.MethodPut:
+		cfg := store.DefaultTopicConfig()
+		if err := json.NewDecoder(r.Body).Decode(cfg); err != nil {
+			http.Error(w, errDecodingConfig.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.broker.DeclareTopic(path, cfg); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, store.ErrInvalidConfig) || errors.Is(err, store.ErrInvalidTopic) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, errDeclareTopic.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := s.broker.DeleteTopic(path); err != nil {
+			writeTopicErr(w, err, errDeleteTopic)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPut, http.MethodDelete}, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cutSegment slices the path around the first whole segment seg, so that the topic a/groupsx/groups
+// is cut after a/groupsx. The returned rest doesn't start with a slash.
+func cutSegment(path, seg string) (before, rest string, found bool) {
+	for i := 0; ; {
+		j := strings.Index(path[i:], "/"+seg)
+		if j == -1 {
+			return path, "", false
+		}
+
+		j += i
+		end := j + 1 + len(seg)
+		if end == len(path) || path[end] == '/' {
+			return path[:j], strings.TrimPrefix(path[end:], "/"), true
+		}
+		i = j + 1
+	}
+}
+
+func (s *Server) purge(w http.ResponseWriter, topic string) {
+	purged, err := s.broker.Purge(topic)
+	if err != nil {
+		writeTopicErr(w, err, errPurge)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]uint64{"purged": purged})
+}
+
+func (s *Server) redrive(w http.ResponseWriter, r *http.Request, dlq string) {
+	var max uint64
+	if v := r.URL.Query().Get("max"); v != "" {
+		parsed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, errInvalidMax.Error(), http.StatusBadRequest)
+			return
+		}
+		max = parsed
+	}
+
+	moved, err := s.broker.Redrive(dlq, max)
+	if err != nil {
+		writeTopicErr(w, err, errRedrive)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]map[string]uint64{"redriven": moved})
+}
+
+// writePublishErr writes the error of a rejected publish. Topics which are full respond with 507
+// if they reached their size limit and with 429 if they reached their message limit.
+func writePublishErr(w http.ResponseWriter, err error) {
+	var retentionErr *store.RetentionError
+	switch {
+	case errors.As(err, &retentionErr):
+		status := http.StatusTooManyRequests
+		if retentionErr.Limit == store.LimitMaxBytes {
+			status = http.StatusInsufficientStorage
+		}
+		http.Error(w, retentionErr.Error(), status)
+	case errors.Is(err, store.ErrInvalidIdempotencyKey):
+		http.Error(w, store.ErrInvalidIdempotencyKey.Error(), http.StatusBadRequest)
+	case errors.Is(err, store.ErrInvalidTopic), errors.Is(err, store.ErrInvalidPriority),
+		errors.Is(err, store.ErrInvalidGroupKey):
+		http.Error(w, errPublish.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, errPublish.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeTopicErr responds with 404 if the topic doesn't exist and otherwise with fallback.
+func writeTopicErr(w http.ResponseWriter, err error, fallback httpErr) {
+	if errors.Is(err, store.ErrTopicNotFound) {
+		http.Error(w, store.ErrTopicNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	http.Error(w, fallback.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// subscribe adds a consumer to the topic as described by the query. The subscription parameter
+// joins a durable subscription, and group together with member joins a consumer group as the
+// member. A group without a member is the same as a subscription. If subscribing fails an error is
+// written to the client.
+func (s *Server) subscribe(w http.ResponseWriter, topic string, query url.Values) (*consumer.Consumer, bool) {
+	var (
+		csm *consumer.Consumer
+		err error
+	)
+	group, member := subscription(query), query.Get("member")
+	switch {
+	case member != "":
+		if group == "" {
+			http.Error(w, "no group provided", http.StatusBadRequest)
+			return nil, false
+		}
+		csm, err = s.broker.JoinGroup(topic, group, member)
+	case group != "":
+		csm, err = s.broker.SubscribeDurable(topic, group)
+	default:
+		csm, err = s.broker.Subscribe(topic)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrNotFanout) || errors.Is(err, store.ErrInvalidSubscription) ||
+			errors.Is(err, store.ErrInvalidMember) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, errSubscribe.Error(), status)
+		return nil, false
+	}
+
+	return csm, true
+}
+
+// subscription returns the subscription given in the query, which can also be given as group.
+func subscription(query url.Values) string {
+	if sub := query.Get("subscription"); sub != "" {
+		return sub
+	}
+
+	return query.Get("group")
+}
+
+// Next handles GET /next?topic=x&wait=30s and responds with the next message of the topic as a
+// frame. If the topic is empty the request waits up to the given duration, or maxWait, for a
+// message to be published and responds with 204 if none arrives. The message stays leased after
+// the request and has to be acknowledged through /ack or /nack with its offset. With n set up to n
+// messages are leased at once, see nextBatch. Fan-out topics are consumed through a subscription or
+// group, since a subscription created by the request only receives messages published during it.
+// Setting member joins the group as the member, which outlasts the request, so that form has to be
+// sent as POST.
+func (s *Server) Next(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		http.Error(w, "no topic provided", http.StatusBadRequest)
+		return
+	}
+
+	var wait time.Duration
+	if v := query.Get("wait"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			http.Error(w, errInvalidWait.Error(), http.StatusBadRequest)
+			return
 		}
+		wait = min(parsed, maxWait)
+	}
+
+	var n int
+	if v := query.Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxBatch {
+			http.Error(w, errInvalidN.Error(), http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	if query.Get("member") != "" && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, errJoinMethod.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if subscription(query) == "" {
+		cfg, err := s.broker.TopicConfig(topic)
+		if err != nil {
+			http.Error(w, errSubscribe.Error(), http.StatusInternalServerError)
+			return
+		}
+		if cfg.Mode == store.ModeFanout {
+			http.Error(w, errFanoutNext.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	csm, ok := s.subscribe(w, topic, query)
+	if !ok {
+		return
+	}
+	defer s.broker.Unsubscribe(topic, csm.ID)
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	if n > 0 {
+		csm.Prefetch = n
+		s.nextBatch(ctx, w, r, csm, n)
+		return
 	}
+
+	val, offset, err := s.broker.Next(ctx, csm)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if errors.Is(err, store.ErrStream) {
+		http.Error(w, store.ErrStream.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, errNextValue.Error(), http.StatusInternalServerError)
+		return
+	}
+	csm.Release()
+
+	f := valueFrame(offset, val, r.Header)
+	setValueHeaders(w.Header(), offset, val)
+	if f.Encoding != "" {
+		w.Header().Set(headerEncoding, f.Encoding)
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// Ack handles POST /ack?topic=x&offset=n, acknowledging a message leased through /next.
+func (s *Server) Ack(w http.ResponseWriter, r *http.Request) {
+	s.settle(w, r, errAck, func(topic, sub string, offset uint64) error {
+		return s.broker.Ack(topic, sub, offset)
+	})
+}
+
+// Nack handles POST /nack?topic=x&offset=n&reason=r, returning a message leased through /next to
+// its topic.
+func (s *Server) Nack(w http.ResponseWriter, r *http.Request) {
+	reason := r.URL.Query().Get("reason")
+	s.settle(w, r, errNack, func(topic, sub string, offset uint64) error {
+		return s.broker.Nack(topic, sub, offset, reason)
+	})
+}
+
+func (s *Server) settle(w http.ResponseWriter, r *http.Request, fallback httpErr, fn func(topic, sub string, offset uint64) error) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		http.Error(w, "no topic provided", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := strconv.ParseUint(query.Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, errInvalidOffset.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := fn(topic, subscription(query), offset); err != nil {
+		if errors.Is(err, store.ErrKeyDoesntExist) {
+			http.Error(w, store.ErrKeyDoesntExist.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fallback.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func isDisconnect(err error) bool {
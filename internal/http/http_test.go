@@ -0,0 +1,818 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/golang/snappy"
+	"github.com/nireo/rq/internal/broker"
+	"github.com/nireo/rq/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe_Session(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, err := http.Post(srv.URL+"/publish?topic=test_topic", "text/plain", strings.NewReader("test_value"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	resp, err = http.Post(srv.URL+"/subscribe?topic=test_topic", "application/json", pr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	encoder, decoder := json.NewEncoder(pw), json.NewDecoder(resp.Body)
+	send := func(cmd string) frame {
+		require.NoError(t, encoder.Encode(cmd))
+
+		var f frame
+		require.NoError(t, decoder.Decode(&f))
+		return f
+	}
+
+	f := send(cmdNext)
+	require.Empty(t, f.Error)
+	require.Equal(t, "test_value", string(f.Value))
+
+	f = send(cmdNext)
+	require.Equal(t, errPrefetchFull.Error(), f.Error)
+
+	f = send(cmdAck)
+	require.Empty(t, f.Error)
+
+	f = send(cmdAck)
+	require.Equal(t, errAck.Error(), f.Error)
+
+	f = send("unknown")
+	require.Equal(t, errUnknownCmd.Error(), f.Error)
+
+	require.NoError(t, encoder.Encode(cmdClose))
+	_, err = decoder.Token()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestSubscribe_Prefetch(t *testing.T) {
+	srv := newTestServer(t)
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post(srv.URL+"/publish?topic=test_topic", "text/plain", strings.NewReader(fmt.Sprint(i)))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	resp, err := http.Post(srv.URL+"/subscribe?topic=test_topic&prefetch=3", "application/json", pr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	encoder, decoder := json.NewEncoder(pw), json.NewDecoder(resp.Body)
+	send := func(cmd any) frame {
+		require.NoError(t, encoder.Encode(cmd))
+
+		var f frame
+		require.NoError(t, decoder.Decode(&f))
+		return f
+	}
+
+	var offsets []uint64
+	for i := 0; i < 3; i++ {
+		f := send(cmdNext)
+		require.Empty(t, f.Error)
+		offsets = append(offsets, f.Offset)
+	}
+
+	f := send(command{Cmd: cmdAck, Offset: &offsets[1], Cumulative: true})
+	require.Empty(t, f.Error)
+
+	f = send(command{Cmd: cmdAck, Offset: &offsets[0]})
+	require.Equal(t, errAck.Error(), f.Error)
+
+	f = send(command{Cmd: cmdNack, Offset: &offsets[2]})
+	require.Empty(t, f.Error)
+
+	f = send(cmdNext)
+	require.Equal(t, "2", string(f.Value))
+}
+
+func TestSubscribe_Wait(t *testing.T) {
+	srv := newTestServer(t)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	resp, err := http.Post(srv.URL+"/subscribe?topic=test_topic&prefetch=2", "application/json", pr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	encoder, decoder := json.NewEncoder(pw), json.NewDecoder(resp.Body)
+	read := func() frame {
+		var f frame
+		require.NoError(t, decoder.Decode(&f))
+		return f
+	}
+
+	require.NoError(t, encoder.Encode(command{Cmd: cmdNext, Wait: "0s"}))
+	require.Equal(t, errEmpty.Error(), read().Error)
+
+	require.NoError(t, encoder.Encode(command{Cmd: cmdNext, Wait: "invalid"}))
+	require.Equal(t, errInvalidWait.Error(), read().Error)
+
+	// next waits until a message is published.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		http.Post(srv.URL+"/publish?topic=test_topic", "text/plain", strings.NewReader("test_value"))
+	}()
+	require.NoError(t, encoder.Encode(cmdNext))
+	f := read()
+	require.Empty(t, f.Error)
+	require.Equal(t, "test_value", string(f.Value))
+
+	// a waiting next is answered as empty once the client sends another command.
+	require.NoError(t, encoder.Encode(cmdNext))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, encoder.Encode(command{Cmd: cmdAck, Offset: &f.Offset}))
+	require.Equal(t, errEmpty.Error(), read().Error)
+
+	f = read()
+	require.Equal(t, cmdAck, f.Cmd)
+	require.Empty(t, f.Error)
+}
+
+func TestSubscribe_NoTopic(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, err := http.Post(srv.URL+"/subscribe", "application/json", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestTopicEndpoints(t *testing.T) {
+	srv := newTestServer(t)
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post(srv.URL+"/publish?topic=test_topic", "text/plain", strings.NewReader("test_value"))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	var topics []string
+	resp, err := http.Get(srv.URL + "/topics")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&topics))
+	require.Equal(t, []string{"test_topic"}, topics)
+
+	var stats store.TopicStats
+	resp, err = http.Get(srv.URL + "/topics/test_topic")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.Equal(t, uint64(3), stats.Ready)
+
+	var purged map[string]uint64
+	resp, err = http.Post(srv.URL+"/topics/test_topic/purge", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&purged))
+	require.Equal(t, uint64(3), purged["purged"])
+
+	req, err := http.NewRequest(http.MethodDelete, srv.URL+"/topics/test_topic", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/topics/test_topic")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestNext_LongPoll(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/next?topic=test_topic")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		http.Post(srv.URL+"/publish?topic=test_topic", "text/plain", strings.NewReader("test_value"))
+	}()
+
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic&wait=5s")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var f frame
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, "test_value", string(f.Value))
+
+	ackURL := fmt.Sprintf("%s/ack?topic=test_topic&offset=%d", srv.URL, f.Offset)
+	resp, err = http.Post(ackURL, "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Post(ackURL, "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestNext_Fanout(t *testing.T) {
+	srv := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/topics/test_topic", strings.NewReader(`{"mode":"fanout"}`))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic&subscription=sub")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"/publish?topic=test_topic", "text/plain", strings.NewReader("test_value"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	for _, query := range []string{"topic=test_topic", "topic=test_topic&n=2"} {
+		resp, err = http.Get(srv.URL + "/next?" + query)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	var stats store.TopicStats
+	resp, err = http.Get(srv.URL + "/topics/test_topic")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.Len(t, stats.Subscriptions, 1)
+
+	var f frame
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic&subscription=sub")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, "test_value", string(f.Value))
+}
+
+func TestNext_Headers(t *testing.T) {
+	srv := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/publish?topic=test_topic", strings.NewReader("test_value"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Rq-Correlation-Id", "abc")
+	req.Header.Set(headerOffset, "10")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	id := resp.Header.Get(headerID)
+	require.NotEmpty(t, id)
+
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, id, resp.Header.Get(headerID))
+	require.Equal(t, "abc", resp.Header.Get("X-Rq-Correlation-Id"))
+	require.Equal(t, "text/plain", resp.Header.Get("X-Rq-Content-Type"))
+	require.NotEmpty(t, resp.Header.Get(headerPublishedAt))
+	require.NotEmpty(t, resp.Header.Get(headerFirstDeliveredAt))
+
+	var f frame
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, id, f.ID)
+	require.Equal(t, fmt.Sprint(f.Offset), resp.Header.Get(headerOffset))
+	require.Equal(t, map[string]string{"Correlation-Id": "abc", "Content-Type": "text/plain"}, f.Headers)
+	require.NotNil(t, f.PublishedAt)
+	require.NotNil(t, f.FirstDeliveredAt)
+}
+
+func TestPublish_Delay(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, err := http.Post(srv.URL+"/publish?topic=test_topic&delay=1h", "text/plain", strings.NewReader("test_value"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var stats store.TopicStats
+	resp, err = http.Get(srv.URL + "/topics/test_topic")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.Equal(t, uint64(1), stats.Scheduled)
+
+	resp, err = http.Post(srv.URL+"/publish?topic=test_topic&deliver_at=tomorrow", "text/plain", strings.NewReader("test_value"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPublish_Priority(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, priority := range []string{"0", "9"} {
+		resp, err := http.Post(srv.URL+"/publish?topic=test_topic&priority="+priority, "text/plain", strings.NewReader("priority_"+priority))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	resp, err := http.Post(srv.URL+"/publish?topic=test_topic&priority=10", "text/plain", strings.NewReader("test_value"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "9", resp.Header.Get(headerPriority))
+
+	var f frame
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, "priority_9", string(f.Value))
+	require.Equal(t, uint8(9), f.Priority)
+}
+
+func TestBatch(t *testing.T) {
+	srv := newTestServer(t)
+
+	var published map[string][]string
+	resp, err := http.Post(srv.URL+"/publish/batch?topic=test_topic", contentTypeNDJSON, strings.NewReader("{\"n\":1}\n{\"n\":2}\n\n"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&published))
+	require.Len(t, published["ids"], 2)
+
+	resp, err = http.Post(srv.URL+"/publish/batch?topic=test_topic", contentTypeJSON, strings.NewReader(`[{"n":3}, "four"]`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"/publish/batch?topic=test_topic", contentTypeJSON, strings.NewReader(`{"n":5}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var frames []frame
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic&n=3")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&frames))
+	require.Len(t, frames, 3)
+	require.Equal(t, `{"n":1}`, string(frames[0].Value))
+	require.Equal(t, `{"n":3}`, string(frames[2].Value))
+	require.Equal(t, published["ids"][0], frames[0].ID)
+	require.Equal(t, contentTypeJSON, frames[0].Headers["Content-Type"])
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/next?topic=test_topic&n=3", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", contentTypeNDJSON)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, contentTypeNDJSON, resp.Header.Get("Content-Type"))
+
+	decoder := json.NewDecoder(resp.Body)
+	var f frame
+	require.NoError(t, decoder.Decode(&f))
+	require.Equal(t, `"four"`, string(f.Value))
+	require.ErrorIs(t, decoder.Decode(&f), io.EOF)
+
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic&n=0")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	publish := func(header, value string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/publish/batch?topic=test_topic", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// every message of an encoded batch is checked like a message published on its own.
+	packed := append(append(snappy.Encode(nil, []byte("one")), '\n'), snappy.Encode(nil, []byte("two"))...)
+	require.Equal(t, http.StatusCreated, publish("Content-Encoding", "snappy", packed).StatusCode)
+	require.Equal(t, http.StatusBadRequest, publish("Content-Encoding", "zstd", packed).StatusCode)
+	tooLarge := append(append(snappy.Encode(nil, []byte("one")), '\n'), 0x80, 0x80, 0x80, 0x80, 0x07)
+	require.Equal(t, http.StatusRequestEntityTooLarge, publish("Content-Encoding", "snappy", tooLarge).StatusCode)
+	require.Equal(t, http.StatusBadRequest, publish(headerIdempotencyKey, "key", []byte("one\ntwo")).StatusCode)
+
+	req, err = http.NewRequest(http.MethodGet, srv.URL+"/next?topic=test_topic&n=10", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&frames))
+	require.Len(t, frames, 2)
+	require.Equal(t, "one", string(frames[0].Value))
+	require.Equal(t, "two", string(frames[1].Value))
+}
+
+func TestGroups(t *testing.T) {
+	srv := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/topics/test_topic", strings.NewReader(`{"mode":"fanout"}`))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"/next?topic=test_topic&member=m1", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic&group=g1&member=m1")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.Equal(t, http.MethodPost, resp.Header.Get("Allow"))
+
+	var groups []*store.Group
+	resp, err = http.Get(srv.URL + "/topics/test_topic/groups")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&groups))
+	require.Empty(t, groups)
+
+	for _, group := range []string{"g1", "g2"} {
+		resp, err = http.Post(srv.URL+"/next?topic=test_topic&group="+group+"&member=m1", "", nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err = http.Post(srv.URL+"/publish?topic=test_topic", "text/plain", strings.NewReader("test_value"))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	var f frame
+	resp, err = http.Post(srv.URL+"/next?topic=test_topic&group=g1&member=m2", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, "test_value", string(f.Value))
+
+	resp, err = http.Get(srv.URL + "/topics/test_topic/groups")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&groups))
+	require.Len(t, groups, 2)
+	require.Equal(t, "g1", groups[0].Name)
+	require.Equal(t, uint64(1), groups[0].Lag)
+	require.Equal(t, uint64(1), groups[0].Outstanding)
+	require.Len(t, groups[0].Members, 2)
+	require.Equal(t, uint64(2), groups[1].Lag)
+
+	resp, err = http.Post(fmt.Sprintf("%s/ack?topic=test_topic&group=g1&offset=%d", srv.URL, f.Offset), "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	req, err = http.NewRequest(http.MethodDelete, srv.URL+"/topics/test_topic/groups/g1/members/m1", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	var group store.Group
+	resp, err = http.Get(srv.URL + "/topics/test_topic/groups/g1")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&group))
+	require.Equal(t, uint64(0), group.Outstanding)
+	require.Len(t, group.Members, 1)
+	require.Equal(t, "m2", group.Members[0].Name)
+
+	resp, err = http.Get(srv.URL + "/topics/test_topic/groups/missing")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// only a whole /groups segment routes to the groups of a topic.
+	req, err = http.NewRequest(http.MethodPut, srv.URL+"/topics/orders/groupsx", strings.NewReader(`{"mode":"fanout"}`))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"/next?topic=orders/groupsx&group=g1&member=m1", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/topics/orders/groupsx/groups")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&groups))
+	require.Len(t, groups, 1)
+	require.Equal(t, "g1", groups[0].Name)
+}
+
+func TestStream(t *testing.T) {
+	srv := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/topics/test_topic", strings.NewReader(`{"mode":"stream"}`))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	for i := 0; i < 3; i++ {
+		resp, err = http.Post(srv.URL+"/publish?topic=test_topic", "text/plain", strings.NewReader(fmt.Sprintf("value_%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// messages can't be leased over a subscribe session either.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	resp, err = http.Post(srv.URL+"/subscribe?topic=test_topic", "application/json", pr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.NoError(t, json.NewEncoder(pw).Encode(cmdNext))
+	var f frame
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, store.ErrStream.Error(), f.Error)
+
+	resp, err = http.Get(srv.URL + "/read?topic=test_topic")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get(headerNextOffset))
+
+	// the same messages can be read again.
+	for i := 0; i < 2; i++ {
+		var frames []frame
+		resp, err = http.Get(srv.URL + "/read?topic=test_topic&from=earliest&n=2")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&frames))
+		require.Len(t, frames, 2)
+		require.Equal(t, "value_0", string(frames[0].Value))
+		require.Equal(t, uint64(1), frames[1].Offset)
+		require.Equal(t, "2", resp.Header.Get(headerNextOffset))
+	}
+
+	resp, err = http.Post(srv.URL+"/commit?topic=test_topic&consumer=c&offset=2", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var frames []frame
+	resp, err = http.Get(srv.URL + "/read?topic=test_topic&consumer=c")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&frames))
+	require.Len(t, frames, 1)
+	require.Equal(t, "value_2", string(frames[0].Value))
+
+	from := url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+	resp, err = http.Get(srv.URL + "/read?topic=test_topic&from=" + from)
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&frames))
+	require.Len(t, frames, 3)
+
+	resp, err = http.Get(srv.URL + "/read?topic=test_topic&from=7")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/read?topic=test_topic&from=yesterday")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPublish_Retention(t *testing.T) {
+	srv := newTestServer(t)
+
+	for topic, cfg := range map[string]string{
+		"messages": `{"mode":"queue","max_messages":1,"overflow":"reject_publish"}`,
+		"bytes":    `{"mode":"queue","max_bytes":64,"overflow":"reject_publish"}`,
+		"dropping": `{"mode":"queue","max_messages":1}`,
+	} {
+		req, err := http.NewRequest(http.MethodPut, srv.URL+"/topics/"+topic, strings.NewReader(cfg))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	publish := func(topic, body string) int {
+		resp, err := http.Post(srv.URL+"/publish?topic="+topic, "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusCreated, publish("messages", "value"))
+	require.Equal(t, http.StatusTooManyRequests, publish("messages", "value"))
+	require.Equal(t, http.StatusInsufficientStorage, publish("bytes", strings.Repeat("x", 100)))
+	require.Equal(t, http.StatusCreated, publish("dropping", "value"))
+	require.Equal(t, http.StatusCreated, publish("dropping", "value"))
+
+	resp, err := http.Post(srv.URL+"/publish/batch?topic=messages", "text/plain", strings.NewReader("a\nb"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	var stats store.TopicStats
+	resp, err = http.Get(srv.URL + "/topics/dropping")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.Equal(t, uint64(1), stats.Ready)
+	require.Equal(t, uint64(1), stats.Dropped)
+	require.NotZero(t, stats.Bytes)
+}
+
+func TestPublish_TTL(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, err := http.Post(srv.URL+"/publish?topic=test_topic&ttl=-1s", "text/plain", strings.NewReader("value"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"/publish?topic=test_topic&ttl=1ms", "text/plain", strings.NewReader("expired"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, err = http.Post(srv.URL+"/publish?topic=test_topic&ttl=1h", "text/plain", strings.NewReader("value"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	time.Sleep(5 * time.Millisecond)
+
+	var f frame
+	resp, err = http.Get(srv.URL + "/next?topic=test_topic")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, "value", string(f.Value))
+	require.NotNil(t, f.ExpiresAt)
+
+	expiresAt, err := time.Parse(time.RFC3339Nano, resp.Header.Get(headerExpiresAt))
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+
+	var stats store.TopicStats
+	resp, err = http.Get(srv.URL + "/topics/test_topic")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.Equal(t, uint64(1), stats.Expired)
+}
+
+func TestPublish_Idempotent(t *testing.T) {
+	srv := newTestServer(t)
+
+	publish := func(key, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/publish?topic=test_topic", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(headerIdempotencyKey, key)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		return resp
+	}
+
+	first := publish("key_1", "value_1")
+	require.Empty(t, first.Header.Get(headerIdempotentReplayed))
+	second := publish("key_2", "value_2")
+	require.Equal(t, "1", second.Header.Get(headerOffset))
+
+	// a retry with the same key returns the original message's id and offset.
+	retry := publish("key_1", "value_1")
+	require.Equal(t, "true", retry.Header.Get(headerIdempotentReplayed))
+	require.Equal(t, first.Header.Get(headerID), retry.Header.Get(headerID))
+	require.Equal(t, first.Header.Get(headerOffset), retry.Header.Get(headerOffset))
+
+	var stats store.TopicStats
+	resp, err := http.Get(srv.URL + "/topics/test_topic")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.Equal(t, uint64(2), stats.Ready)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/publish?topic=test_topic", strings.NewReader("value"))
+	require.NoError(t, err)
+	req.Header.Set(headerIdempotencyKey, strings.Repeat("k", store.MaxIdempotencyKeyLen+1))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPublish_GroupKey(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, v := range []string{"a_1", "a_2", "b_1"} {
+		resp, err := http.Post(srv.URL+"/publish?topic=test_topic&group_key="+v[:1], "text/plain", strings.NewReader(v))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	// the second message of group a is held until the first one is acknowledged.
+	next := func() *http.Response {
+		resp, err := http.Get(srv.URL + "/next?topic=test_topic")
+		require.NoError(t, err)
+		return resp
+	}
+
+	first := next()
+	require.Equal(t, http.StatusOK, first.StatusCode)
+	require.Equal(t, "a", first.Header.Get(headerGroupKey))
+
+	var f frame
+	resp := next()
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, "b_1", string(f.Value))
+	require.Equal(t, "b", f.GroupKey)
+
+	resp = next()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err := http.Post(srv.URL+"/ack?topic=test_topic&offset="+first.Header.Get(headerOffset), "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = next()
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	require.Equal(t, "a_2", string(f.Value))
+
+	resp, err = http.Post(srv.URL+"/publish?topic=test_topic&group_key="+strings.Repeat("g", store.MaxGroupKeyLen+1),
+		"text/plain", strings.NewReader("value"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPublish_ContentEncoding(t *testing.T) {
+	srv := newTestServer(t)
+
+	payload := bytes.Repeat([]byte("value"), 100)
+	packed := snappy.Encode(nil, payload)
+
+	publish := func(encoding string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/publish?topic=test_topic", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", encoding)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	require.Equal(t, http.StatusCreated, publish("snappy", packed).StatusCode)
+	require.Equal(t, http.StatusCreated, publish("snappy", packed).StatusCode)
+	require.Equal(t, http.StatusUnsupportedMediaType, publish("gzip", payload).StatusCode)
+	require.Equal(t, http.StatusBadRequest, publish("zstd", payload).StatusCode)
+	// a header claiming a length of almost 2 GiB is rejected without decoding the body.
+	require.Equal(t, http.StatusRequestEntityTooLarge, publish("snappy", []byte{0x80, 0x80, 0x80, 0x80, 0x07}).StatusCode)
+
+	next := func(accept string) (*http.Response, frame) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/next?topic=test_topic", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", accept)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		var f frame
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+		return resp, f
+	}
+
+	// clients accepting the compression get the stored bytes.
+	resp, f := next("gzip, snappy")
+	require.Equal(t, "snappy", resp.Header.Get(headerEncoding))
+	require.Equal(t, "snappy", f.Encoding)
+	require.Equal(t, packed, f.Value)
+
+	resp, f = next("snappy;q=0")
+	require.Empty(t, resp.Header.Get(headerEncoding))
+	require.Empty(t, f.Encoding)
+	require.Equal(t, payload, f.Value)
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "rq-test-http")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %v", err)
+	}
+
+	st, err := store.NewStore(dir)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+
+	b := broker.NewBroker(st)
+	srv := httptest.NewServer(NewServer(b).Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		b.Close()
+		os.RemoveAll(dir)
+	})
+
+	return srv
+}
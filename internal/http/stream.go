@@ -0,0 +1,163 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nireo/rq/internal/store"
+)
+
+// defaultReadN is how many messages of a stream are read at once if the client doesn't say.
+const defaultReadN = 100
+
+// Read handles GET /read?topic=x&from=earliest&n=100&wait=30s and responds with up to n messages of
+// a stream topic as frames, see writeFrames. The from parameter is the position to read from:
+// earliest, latest, an offset or a time in RFC 3339 format. Without it a named consumer given with
+// consumer continues from its committed offset, and otherwise the read starts at the latest
+// offset. If there are no messages yet the request waits like /next does and responds with 204.
+// The X-Rq-Next-Offset header holds the offset to continue reading from.
+func (s *Server) Read(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		http.Error(w, "no topic provided", http.StatusBadRequest)
+		return
+	}
+
+	var wait time.Duration
+	if v := query.Get("wait"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			http.Error(w, errInvalidWait.Error(), http.StatusBadRequest)
+			return
+		}
+		wait = min(parsed, maxWait)
+	}
+
+	n := defaultReadN
+	if v := query.Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxBatch {
+			http.Error(w, errInvalidN.Error(), http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	offset, err := s.readOffset(topic, query)
+	if errors.Is(err, errInvalidFrom) {
+		http.Error(w, errInvalidFrom.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStreamErr(w, err, errRead)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	msgs, err := s.broker.ReadStream(ctx, topic, offset, n)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		w.Header().Set(headerNextOffset, strconv.FormatUint(offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeStreamErr(w, err, errRead)
+		return
+	}
+
+	w.Header().Set(headerNextOffset, strconv.FormatUint(msgs[len(msgs)-1].Offset+1, 10))
+	writeFrames(w, r, msgs)
+}
+
+// readOffset resolves the offset a read starts at from the from and consumer query parameters.
+func (s *Server) readOffset(topic string, query url.Values) (uint64, error) {
+	from := query.Get("from")
+	if from == "" {
+		if consumer := query.Get("consumer"); consumer != "" {
+			offset, err := s.broker.CommittedOffset(topic, consumer)
+			if !errors.Is(err, store.ErrNoCommittedOffset) {
+				return offset, err
+			}
+		}
+		from = "latest"
+	}
+
+	var pos store.Position
+	switch from {
+	case "earliest":
+		pos = store.Earliest()
+	case "latest":
+		pos = store.Latest()
+	default:
+		if offset, err := strconv.ParseUint(from, 10, 64); err == nil {
+			pos = store.AtOffset(offset)
+		} else if t, err := time.Parse(time.RFC3339, from); err == nil {
+			pos = store.AtTime(t)
+		} else {
+			return 0, errInvalidFrom
+		}
+	}
+
+	return s.broker.Seek(topic, pos)
+}
+
+// Commit handles POST /commit?topic=x&consumer=c&offset=n and stores n as the offset the consumer
+// continues reading the stream from, which is the offset after the last message it has processed.
+func (s *Server) Commit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		http.Error(w, "no topic provided", http.StatusBadRequest)
+		return
+	}
+
+	consumer := query.Get("consumer")
+	if consumer == "" {
+		http.Error(w, "no consumer provided", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := strconv.ParseUint(query.Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, errInvalidOffset.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.broker.CommitOffset(topic, consumer, offset); err != nil {
+		writeStreamErr(w, err, errCommit)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeStreamErr writes the error of a stream operation, falling back to writeTopicErr.
+func writeStreamErr(w http.ResponseWriter, err error, fallback httpErr) {
+	switch {
+	case errors.Is(err, store.ErrNotStream):
+		http.Error(w, store.ErrNotStream.Error(), http.StatusBadRequest)
+	case errors.Is(err, store.ErrOffsetOutOfRange):
+		http.Error(w, store.ErrOffsetOutOfRange.Error(), http.StatusRequestedRangeNotSatisfiable)
+	default:
+		writeTopicErr(w, err, fallback)
+	}
+}
@@ -0,0 +1,31 @@
+// Package rqtest runs rq servers for the tests of the packages talking to the HTTP API.
+package rqtest
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nireo/rq/internal/broker"
+	rqhttp "github.com/nireo/rq/internal/http"
+	"github.com/nireo/rq/internal/store"
+)
+
+// NewServer starts an HTTP server backed by a broker and a store in a temporary directory. The
+// server is closed when the test finishes.
+func NewServer(t testing.TB) *httptest.Server {
+	t.Helper()
+
+	st, err := store.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+
+	b := broker.NewBroker(st)
+	srv := httptest.NewServer(rqhttp.NewServer(b).Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		b.Close()
+	})
+
+	return srv
+}
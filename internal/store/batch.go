@@ -0,0 +1,144 @@
+package store
+
+import (
+	"bytes"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// batchTx collects the writes of an operation into a batch, which is written to the database
+// atomically once the operation has succeeded. Reads see the writes made so far, so helpers can
+// read a position indicator right after updating it and scan keys written earlier in the operation.
+// leveldb transactions offer the same, but they flush the memtable when opened and write a new
+// table file on every commit, which is far too expensive for operations as frequent as Insert and
+// GetNext.
+type batchTx struct {
+	db      *leveldb.DB
+	batch   *leveldb.Batch
+	pending map[string][]byte
+}
+
+func newBatchTx(db *leveldb.DB) *batchTx {
+	return &batchTx{
+		db:      db,
+		batch:   new(leveldb.Batch),
+		pending: make(map[string][]byte),
+	}
+}
+
+func (tx *batchTx) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	if val, ok := tx.pending[string(key)]; ok {
+		if val == nil {
+			return nil, leveldb.ErrNotFound
+		}
+		return append([]byte(nil), val...), nil
+	}
+
+	return tx.db.Get(key, ro)
+}
+
+func (tx *batchTx) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	if val, ok := tx.pending[string(key)]; ok {
+		return val != nil, nil
+	}
+
+	return tx.db.Has(key, ro)
+}
+
+func (tx *batchTx) Put(key, value []byte, _ *opt.WriteOptions) error {
+	// the pending value must not be nil, since nil marks a deleted key.
+	tx.pending[string(key)] = append([]byte{}, value...)
+	tx.batch.Put(key, value)
+	return nil
+}
+
+func (tx *batchTx) Delete(key []byte, _ *opt.WriteOptions) error {
+	tx.pending[string(key)] = nil
+	tx.batch.Delete(key)
+	return nil
+}
+
+// NewIterator returns an iterator over the database merged with the pending writes in the range.
+// Like a database iterator it sees the state at the time it was created, so keys can be written
+// while iterating.
+func (tx *batchTx) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	var written *memdb.DB
+	for key, val := range tx.pending {
+		if !inRange(slice, []byte(key)) {
+			continue
+		}
+
+		if written == nil {
+			written = memdb.New(comparer.DefaultComparer, 0)
+		}
+		// deleted keys are only skipped in the database, so they aren't added.
+		if val != nil {
+			written.Put([]byte(key), val)
+		}
+	}
+	if written == nil {
+		return tx.db.NewIterator(slice, ro)
+	}
+
+	skipped := make(map[string]bool, len(tx.pending))
+	for key := range tx.pending {
+		skipped[key] = true
+	}
+
+	return iterator.NewMergedIterator([]iterator.Iterator{
+		written.NewIterator(slice),
+		&skipIterator{Iterator: tx.db.NewIterator(slice, ro), skipped: skipped},
+	}, comparer.DefaultComparer, true)
+}
+
+// commit writes the batch to the database.
+func (tx *batchTx) commit() error {
+	if tx.batch.Len() == 0 {
+		return nil
+	}
+
+	return tx.db.Write(tx.batch, nil)
+}
+
+func inRange(slice *util.Range, key []byte) bool {
+	if slice == nil {
+		return true
+	}
+
+	return (slice.Start == nil || bytes.Compare(key, slice.Start) >= 0) &&
+		(slice.Limit == nil || bytes.Compare(key, slice.Limit) < 0)
+}
+
+// skipIterator hides the given keys of an iterator. It hides the keys of the database which have
+// pending writes, so that the merged iterator sees every key once.
+type skipIterator struct {
+	iterator.Iterator
+	skipped map[string]bool
+}
+
+func (i *skipIterator) First() bool        { return i.forward(i.Iterator.First()) }
+func (i *skipIterator) Last() bool         { return i.backward(i.Iterator.Last()) }
+func (i *skipIterator) Seek(k []byte) bool { return i.forward(i.Iterator.Seek(k)) }
+func (i *skipIterator) Next() bool         { return i.forward(i.Iterator.Next()) }
+func (i *skipIterator) Prev() bool         { return i.backward(i.Iterator.Prev()) }
+
+func (i *skipIterator) forward(ok bool) bool {
+	for ok && i.skipped[string(i.Key())] {
+		ok = i.Iterator.Next()
+	}
+
+	return ok
+}
+
+func (i *skipIterator) backward(ok bool) bool {
+	for ok && i.skipped[string(i.Key())] {
+		ok = i.Iterator.Prev()
+	}
+
+	return ok
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm the payload of a value is stored with.
+type Compression string
+
+const (
+	CompressionNone   Compression = "none"
+	CompressionSnappy Compression = "snappy"
+	CompressionZstd   Compression = "zstd"
+)
+
+var (
+	ErrInvalidCompression = errors.New("invalid compression")
+	ErrTooLarge           = errors.New("payload exceeds the maximum message size")
+)
+
+const (
+	// DefaultMaxMessageSize is the default limit of the decompressed size of a published payload.
+	DefaultMaxMessageSize = 64 << 20
+	// maxStoredSize limits decompressing stored payloads, which were checked against the limit
+	// they were published with.
+	maxStoredSize = 1 << 30
+)
+
+// compression ids stored in the value header.
+const (
+	compressionIDSnappy = 1
+	compressionIDZstd   = 2
+)
+
+var (
+	// the encoder and decoders are safe for concurrent use with EncodeAll and DecodeAll.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	// zstdDecoders holds a decoder for every size limit in use, see zstdDecoder.
+	zstdDecoders sync.Map
+)
+
+// zstdDecoder returns a decoder which fails payloads decompressing to more than limit bytes
+// before allocating them.
+func zstdDecoder(limit int) *zstd.Decoder {
+	if d, ok := zstdDecoders.Load(limit); ok {
+		return d.(*zstd.Decoder)
+	}
+
+	d, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+	if actual, loaded := zstdDecoders.LoadOrStore(limit, d); loaded {
+		d.Close()
+		return actual.(*zstd.Decoder)
+	}
+
+	return d
+}
+
+// ParseCompression returns the compression with the given name. The empty name is
+// CompressionNone.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionSnappy, CompressionZstd:
+		return c, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidCompression, name)
+	}
+}
+
+func (c Compression) id() byte {
+	switch c {
+	case CompressionSnappy:
+		return compressionIDSnappy
+	case CompressionZstd:
+		return compressionIDZstd
+	default:
+		return 0
+	}
+}
+
+func compressionFromID(id byte) Compression {
+	switch id {
+	case compressionIDSnappy:
+		return CompressionSnappy
+	case compressionIDZstd:
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+func (c Compression) compress(data []byte) []byte {
+	switch c {
+	case CompressionSnappy:
+		return snappy.Encode(nil, data)
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, nil)
+	default:
+		return data
+	}
+}
+
+// decompress decompresses data, failing with ErrTooLarge if it decompresses to more than limit
+// bytes.
+func (c Compression) decompress(data []byte, limit int) ([]byte, error) {
+	switch c {
+	case CompressionSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > limit {
+			return nil, ErrTooLarge
+		}
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		// the window of a frame is bounded by the limit too.
+		raw, err := zstdDecoder(limit).DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, ErrTooLarge
+		}
+		return raw, err
+	default:
+		return data, nil
+	}
+}
+
+// NewCompressedValue returns a value from a payload which is already compressed with c, such as
+// the body of a publish with a Content-Encoding. The payload is decompressed to validate it, but
+// it's stored as given without being compressed again. Payloads which are larger than maxSize
+// bytes once decompressed fail with ErrTooLarge, where zero is DefaultMaxMessageSize. So do zstd
+// payloads whose window is larger than maxSize.
+func NewCompressedValue(data []byte, c Compression, maxSize int) (*Value, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+
+	if c == CompressionNone || c == "" {
+		if len(data) > maxSize {
+			return nil, ErrTooLarge
+		}
+		return NewValue(data), nil
+	}
+
+	raw, err := c.decompress(data, maxSize)
+	if errors.Is(err, ErrTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: decompressing %s payload: %v", ErrInvalidCompression, c, err)
+	}
+
+	return &Value{Raw: raw, Compression: c, packed: data}, nil
+}
+
+// Compressed returns the stored form of the payload along with its compression. Values without a
+// compression return Raw.
+func (v *Value) Compressed() ([]byte, Compression) {
+	if v.Compression == "" || v.Compression == CompressionNone {
+		return v.Raw, CompressionNone
+	}
+
+	if v.packed == nil {
+		v.packed = v.Compression.compress(v.Raw)
+	}
+
+	return v.packed, v.Compression
+}
+
+// applyCompression compresses a value published to a topic with a compression, unless the value
+// is already compressed or encrypted. The payload is kept uncompressed if compressing doesn't make
+// it smaller.
+func applyCompression(cfg *TopicConfig, val *Value) {
+	if cfg.Compression == "" || cfg.Compression == CompressionNone {
+		return
+	}
+	if (val.Compression != "" && val.Compression != CompressionNone) || val.KeyID != "" {
+		return
+	}
+
+	packed := cfg.Compression.compress(val.Raw)
+	if len(packed) >= len(val.Raw) {
+		return
+	}
+
+	val.Compression = cfg.Compression
+	val.packed = packed
+}
@@ -0,0 +1,422 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// crashingTx fails every write after the first n, which simulates the process being killed in the
+// middle of an operation.
+type crashingTx struct {
+	leveldbCommon
+	writes  int
+	n       int
+	crashed bool
+}
+
+func (tx *crashingTx) write() error {
+	if tx.writes == tx.n {
+		tx.crashed = true
+		return errCrash
+	}
+	tx.writes++
+	return nil
+}
+
+func (tx *crashingTx) Put(key, value []byte, wo *opt.WriteOptions) error {
+	if err := tx.write(); err != nil {
+		return err
+	}
+	return tx.leveldbCommon.Put(key, value, wo)
+}
+
+func (tx *crashingTx) Delete(key []byte, wo *opt.WriteOptions) error {
+	if err := tx.write(); err != nil {
+		return err
+	}
+	return tx.leveldbCommon.Delete(key, wo)
+}
+
+// TestCrashConsistency kills every write operation after each of its write steps and checks that
+// the reopened store is identical to the store before the operation, and that the store is
+// consistent once the operation is allowed to complete.
+func TestCrashConsistency(t *testing.T) {
+	var offset uint64
+	getNext := func(s Store) error {
+		var err error
+		_, offset, err = s.GetNext(testTopic)
+		return err
+	}
+	insert := func(vals ...*Value) func(s Store) error {
+		return func(s Store) error {
+			for _, val := range vals {
+				if err := s.Insert(testTopic, val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	configure := func(cfg *TopicConfig, subs ...string) func(s Store) error {
+		return func(s Store) error {
+			if err := s.SetTopicConfig(testTopic, cfg); err != nil {
+				return err
+			}
+			for _, sub := range subs {
+				if err := s.AddSubscription(testTopic, []byte(sub), true); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	leased := &TopicConfig{Mode: ModeQueue, VisibilityTimeout: Duration(time.Minute), MaxDeliveries: 2}
+
+	tests := []struct {
+		name  string
+		setup []func(s Store) error
+		op    func(s Store) error
+	}{
+		{
+			name: "insert",
+			setup: []func(s Store) error{
+				insert(NewValue([]byte("value_1"))),
+			},
+			op: insert(NewValue([]byte("value_2"))),
+		},
+		{
+			name: "insert new topic",
+			op:   insert(NewValue([]byte("value"))),
+		},
+		{
+			name: "insert priority",
+			setup: []func(s Store) error{
+				insert(&Value{Raw: []byte("value_1"), Priority: 3}),
+			},
+			op: insert(&Value{Raw: []byte("value_2"), Priority: 5}),
+		},
+		{
+			name: "insert batch",
+			setup: []func(s Store) error{
+				configure(&TopicConfig{Mode: ModeFanout}, "sub_1"),
+			},
+			op: func(s Store) error {
+				return s.InsertBatch(testTopic, []*Value{NewValue([]byte("value_1")), {Raw: []byte("value_2"), Priority: 2}})
+			},
+		},
+		{
+			name: "insert fanout",
+			setup: []func(s Store) error{
+				configure(&TopicConfig{Mode: ModeFanout}, "sub_1", "sub_2"),
+			},
+			op: insert(NewValue([]byte("value"))),
+		},
+		{
+			name: "insert drop oldest",
+			setup: []func(s Store) error{
+				configure(&TopicConfig{Mode: ModeQueue, MaxMessages: 2}),
+				insert(NewValue([]byte("value_1")), &Value{Raw: []byte("value_2"), Priority: 1}),
+			},
+			op: insert(NewValue([]byte("value_3"))),
+		},
+		{
+			name: "insert idempotent",
+			setup: []func(s Store) error{
+				insert(NewValue([]byte("value_1"))),
+			},
+			op: func(s Store) error {
+				_, err := s.InsertIdempotent(testTopic, []byte("key"), NewValue([]byte("value_2")), time.Now())
+				return err
+			},
+		},
+		{
+			name: "add member",
+			setup: []func(s Store) error{
+				configure(&TopicConfig{Mode: ModeFanout}),
+			},
+			op: func(s Store) error { return s.AddMember(testTopic, []byte("group"), []byte("member")) },
+		},
+		{
+			name: "get next",
+			setup: []func(s Store) error{
+				configure(leased),
+				insert(NewValue([]byte("value_1")), &Value{Raw: []byte("value_2"), Priority: 1}),
+			},
+			op: getNext,
+		},
+		{
+			name: "get next expired",
+			setup: []func(s Store) error{
+				configure(&TopicConfig{Mode: ModeQueue, Expiry: ExpiryDeadLetter}),
+				insert(&Value{Raw: []byte("value_1"), ExpiresAt: time.Now().Add(-time.Second)}, NewValue([]byte("value_2"))),
+			},
+			op: getNext,
+		},
+		{
+			name: "get next n",
+			setup: []func(s Store) error{
+				configure(leased),
+				insert(NewValue([]byte("value_1")), &Value{Raw: []byte("value_2"), Priority: 1}, NewValue([]byte("value_3"))),
+			},
+			op: func(s Store) error {
+				_, err := s.GetNextN(testTopic, 3)
+				return err
+			},
+		},
+		{
+			name: "get next grouped",
+			setup: []func(s Store) error{
+				insert(&Value{Raw: []byte("value_1"), GroupKey: "a"}, &Value{Raw: []byte("value_2"), GroupKey: "a"},
+					&Value{Raw: []byte("value_3"), GroupKey: "b"}),
+				getNext,
+			},
+			op: getNext,
+		},
+		{
+			name: "ack grouped",
+			setup: []func(s Store) error{
+				insert(&Value{Raw: []byte("value_1"), GroupKey: "a"}, &Value{Raw: []byte("value_2"), GroupKey: "a"},
+					NewValue([]byte("value_3"))),
+				getNext,
+				func(s Store) error {
+					_, err := s.GetNextN(testTopic, 2)
+					return err
+				},
+			},
+			op: func(s Store) error { return s.Ack(testTopic, offset) },
+		},
+		{
+			name: "nack",
+			setup: []func(s Store) error{
+				configure(leased),
+				insert(NewValue([]byte("value_1")), NewValue([]byte("value_2"))),
+				getNext,
+			},
+			op: func(s Store) error { return s.Nack(testTopic, offset, "failure") },
+		},
+		{
+			name: "nack to dead-letter topic",
+			setup: []func(s Store) error{
+				configure(leased),
+				insert(&Value{Raw: []byte("value"), Dacks: 1}),
+				getNext,
+			},
+			op: func(s Store) error { return s.Nack(testTopic, offset, "failure") },
+		},
+		{
+			name: "requeue expired",
+			setup: []func(s Store) error{
+				configure(leased),
+				insert(NewValue([]byte("value_1")), NewValue([]byte("value_2"))),
+				getNext,
+				getNext,
+			},
+			op: func(s Store) error {
+				_, err := s.RequeueExpired(time.Now().Add(time.Hour))
+				return err
+			},
+		},
+		{
+			name: "redrive",
+			setup: []func(s Store) error{
+				configure(leased),
+				insert(&Value{Raw: []byte("value"), Dacks: 1}),
+				getNext,
+				func(s Store) error { return s.Nack(testTopic, offset, "failure") },
+			},
+			op: func(s Store) error {
+				_, err := s.Redrive([]byte("testtopic.dlq"), 0)
+				return err
+			},
+		},
+		{
+			name: "schedule",
+			op: func(s Store) error {
+				return s.Schedule(testTopic, NewValue([]byte("value")), time.Now().Add(time.Hour))
+			},
+		},
+		{
+			name: "promote due",
+			setup: []func(s Store) error{
+				func(s Store) error {
+					return s.Schedule(testTopic, NewValue([]byte("value")), time.Now().Add(time.Minute))
+				},
+			},
+			op: func(s Store) error {
+				_, err := s.PromoteDue(time.Now().Add(time.Hour))
+				return err
+			},
+		},
+		{
+			name: "purge",
+			setup: []func(s Store) error{
+				configure(&TopicConfig{Mode: ModeFanout}, "sub_1"),
+				insert(NewValue([]byte("value_1")), &Value{Raw: []byte("value_2"), Priority: 2, GroupKey: "g"}),
+			},
+			op: func(s Store) error {
+				_, err := s.Purge(testTopic)
+				return err
+			},
+		},
+		{
+			name: "delete topic",
+			setup: []func(s Store) error{
+				configure(&TopicConfig{Mode: ModeFanout}, "sub_1"),
+				insert(NewValue([]byte("value"))),
+			},
+			op: func(s Store) error { return s.DeleteTopic(testTopic) },
+		},
+		{
+			name: "remove subscription",
+			setup: []func(s Store) error{
+				configure(&TopicConfig{Mode: ModeFanout}, "sub_1"),
+				insert(NewValue([]byte("value"))),
+			},
+			op: func(s Store) error { return s.RemoveSubscription(testTopic, []byte("sub_1")) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "rq-test-crash")
+			require.NoError(t, err)
+			t.Cleanup(func() { os.RemoveAll(dir) })
+
+			s, err := NewStore(dir, WithJanitorInterval(0))
+			require.NoError(t, err)
+			for _, setup := range tt.setup {
+				require.NoError(t, setup(s))
+			}
+			before := snapshot(t, s)
+
+			for n := 0; ; n++ {
+				tx := &crashingTx{n: n}
+				s.(*store).wrapTx = func(db leveldbCommon) leveldbCommon {
+					tx.leveldbCommon = db
+					return tx
+				}
+
+				err := tt.op(s)
+				if !tx.crashed {
+					require.NoError(t, err)
+					require.NotZero(t, n, "operation didn't write anything")
+					break
+				}
+				require.Error(t, err)
+
+				require.NoError(t, s.Close())
+				s, err = NewStore(dir, WithJanitorInterval(0))
+				require.NoError(t, err)
+				require.Equal(t, before, snapshot(t, s), "store changed after crashing at write %d", n)
+			}
+
+			require.NoError(t, s.Close())
+			s, err = NewStore(dir, WithJanitorInterval(0))
+			require.NoError(t, err)
+			defer s.Close()
+
+			require.NotEqual(t, before, snapshot(t, s))
+			checkInvariants(t, s.(*store).db)
+		})
+	}
+}
+
+func snapshot(t *testing.T, s Store) map[string]string {
+	t.Helper()
+
+	kv := make(map[string]string)
+	iter := s.(*store).db.NewIterator(nil, nil)
+	for iter.Next() {
+		kv[string(iter.Key())] = string(iter.Value())
+	}
+	iter.Release()
+	require.NoError(t, iter.Error())
+
+	return kv
+}
+
+// checkInvariants verifies that the ready messages of every queue are exactly the offsets between
+// its head and tail, that their size matches the queue's usage, that leased messages are below the
+// ack tail and that every lease belongs to a leased message.
+func checkInvariants(t *testing.T, db *leveldb.DB) {
+	t.Helper()
+
+	type queue struct {
+		head, tail, ackTail uint64
+		ready, leased       map[uint64]bool
+		bytes, usage        uint64
+	}
+	queues := make(map[string]*queue)
+	get := func(topic []byte) *queue {
+		q, ok := queues[string(topic)]
+		if !ok {
+			q = &queue{ready: make(map[uint64]bool), leased: make(map[uint64]bool)}
+			queues[string(topic)] = q
+		}
+		return q
+	}
+
+	type lease struct {
+		topic  string
+		offset uint64
+	}
+
+	var leases []lease
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		if iter.Key()[0] == usagePrefix {
+			topic, _, ok := splitTopicKey(iter.Key())
+			require.True(t, ok)
+			get(topic).usage = binary.BigEndian.Uint64(iter.Value())
+			continue
+		}
+
+		prefix, topic, offset, ok := decodeKey(iter.Key())
+		if !ok {
+			continue
+		}
+
+		switch q := get(topic); {
+		case prefix == primaryPrefix && offset == headIndicator:
+			q.head = binary.LittleEndian.Uint64(iter.Value())
+		case prefix == primaryPrefix && offset == tailIndicator:
+			q.tail = binary.LittleEndian.Uint64(iter.Value())
+		case prefix == primaryPrefix:
+			q.ready[offset] = true
+			q.bytes += uint64(len(iter.Value()))
+		case prefix == ackPrefix && offset == tailIndicator:
+			q.ackTail = binary.LittleEndian.Uint64(iter.Value())
+		case prefix == ackPrefix:
+			q.leased[offset] = true
+		case prefix == leasePrefix:
+			leases = append(leases, lease{topic: string(topic), offset: offset})
+		}
+	}
+	iter.Release()
+	require.NoError(t, iter.Error())
+
+	for name, q := range queues {
+		require.LessOrEqual(t, q.head, q.tail, "queue %q", name)
+		require.Len(t, q.ready, int(q.tail-q.head), "queue %q", name)
+		for offset := q.head; offset < q.tail; offset++ {
+			require.True(t, q.ready[offset], "queue %q is missing offset %d", name, offset)
+		}
+		for offset := range q.leased {
+			require.Less(t, offset, q.ackTail, "queue %q", name)
+		}
+		require.Equal(t, q.bytes, q.usage, "queue %q", name)
+	}
+
+	for _, l := range leases {
+		require.True(t, queues[l.topic].leased[l.offset], "lease without leased message: %v", l)
+	}
+}
@@ -0,0 +1,381 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// dataKeyLen is the length of the AES-256 data keys values are encrypted with.
+const dataKeyLen = 32
+
+var (
+	ErrKeyNotFound = errors.New("encryption key not found")
+	ErrNoKeys      = errors.New("value is encrypted but the store has no key provider")
+	ErrInvalidKeys = errors.New("invalid encryption keys")
+)
+
+// KeyProvider protects the data keys values are encrypted with. Every value is encrypted with AES-GCM
+// under a random data key of its own, which is stored next to the value wrapped by a
+// key-encryption key. Only the ID of the key-encryption key is recorded with the value, so the
+// keys can be rotated by adding a new current key and rewrapping the stored data keys with
+// Reencrypt. Keyring keeps the keys in memory, while other implementations can hand the wrapping
+// off to a key management service.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key new values are encrypted with.
+	CurrentKeyID() string
+	WrapKey(keyID string, dataKey []byte) ([]byte, error)
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Keyring is a KeyProvider holding AES key-encryption keys in memory.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring of the given keys, which are 16, 24 or 32 bytes long. New values are
+// encrypted with the key named by current.
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("%w: current key %q not found", ErrInvalidKeys, current)
+	}
+
+	k := &Keyring{current: current, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" {
+			return nil, fmt.Errorf("%w: empty key id", ErrInvalidKeys)
+		}
+
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: %v", ErrInvalidKeys, id, err)
+		}
+		k.keys[id] = aead
+	}
+
+	return k, nil
+}
+
+// ParseKeyring parses keys written as id:base64-key pairs separated by newlines or commas. The
+// first key is the current one, so a key is rotated by adding the new key in front of the old
+// ones. Empty lines and lines starting with # are ignored.
+func ParseKeyring(s string) (*Keyring, error) {
+	var (
+		current string
+		keys    = make(map[string][]byte)
+	)
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: expected id:key", ErrInvalidKeys)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: decoding key %q: %v", ErrInvalidKeys, id, err)
+		}
+
+		if current == "" {
+			current = id
+		}
+		keys[id] = key
+	}
+
+	if current == "" {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidKeys)
+	}
+
+	return NewKeyring(current, keys)
+}
+
+// LoadKeyFile reads a keyring from a file in the format of ParseKeyring.
+func LoadKeyFile(path string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %v", err)
+	}
+
+	return ParseKeyring(string(b))
+}
+
+// LoadKeyEnv reads a keyring from an environment variable in the format of ParseKeyring.
+func LoadKeyEnv(name string) (*Keyring, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not set", ErrInvalidKeys, name)
+	}
+
+	return ParseKeyring(v)
+}
+
+func (k *Keyring) CurrentKeyID() string {
+	return k.current
+}
+
+// WrapKey encrypts a data key with AES-GCM under the key-encryption key. The nonce is prepended to
+// the wrapped key.
+func (k *Keyring) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, keyID)
+	}
+
+	return sealGCM(aead, dataKey)
+}
+
+func (k *Keyring) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, keyID)
+	}
+
+	return openGCM(aead, wrapped)
+}
+
+// WithKeyProvider encrypts the payloads of inserted values with keys from the provider. Values
+// inserted before encryption was enabled stay readable and are encrypted by Reencrypt.
+func WithKeyProvider(keys KeyProvider) Option {
+	return func(s *store) {
+		s.keys = keys
+	}
+}
+
+// encryptValue encrypts the stored payload of a value, after compression, under a new data key.
+// Values which are already encrypted are left as they are.
+func encryptValue(keys KeyProvider, val *Value) error {
+	if keys == nil || val.KeyID != "" {
+		return nil
+	}
+
+	dataKey := make([]byte, dataKeyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("generating data key: %v", err)
+	}
+
+	keyID := keys.CurrentKeyID()
+	wrapped, err := keys.WrapKey(keyID, dataKey)
+	if err != nil {
+		return fmt.Errorf("wrapping data key: %v", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	payload, _ := val.Compressed()
+	if val.sealed, err = sealGCM(aead, payload); err != nil {
+		return err
+	}
+	val.KeyID = keyID
+	val.wrappedKey = wrapped
+
+	return nil
+}
+
+// decryptValue restores the payload of a value decoded in its encrypted form.
+func decryptValue(keys KeyProvider, val *Value) error {
+	if !val.locked {
+		return nil
+	}
+	if keys == nil {
+		return ErrNoKeys
+	}
+
+	dataKey, err := keys.UnwrapKey(val.KeyID, val.wrappedKey)
+	if err != nil {
+		return fmt.Errorf("unwrapping data key: %w", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	payload, err := openGCM(aead, val.sealed)
+	if err != nil {
+		return fmt.Errorf("decrypting value: %v", err)
+	}
+
+	val.locked = false
+	val.setPayload(payload)
+
+	return nil
+}
+
+// rewrapValue wraps the data key of an encrypted value with the current key. The payload isn't
+// encrypted again.
+func rewrapValue(keys KeyProvider, val *Value) error {
+	current := keys.CurrentKeyID()
+	if val.KeyID == current {
+		return nil
+	}
+
+	dataKey, err := keys.UnwrapKey(val.KeyID, val.wrappedKey)
+	if err != nil {
+		return fmt.Errorf("unwrapping data key: %w", err)
+	}
+
+	wrapped, err := keys.WrapKey(current, dataKey)
+	if err != nil {
+		return fmt.Errorf("wrapping data key: %v", err)
+	}
+	val.KeyID = current
+	val.wrappedKey = wrapped
+
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealGCM(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %v", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openGCM(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], nil)
+}
+
+// reencryptBatchSize is the number of values Reencrypt rewrites in a single batch.
+const reencryptBatchSize = 1000
+
+// prepareValue compresses and encrypts a value published to a topic.
+func (s *store) prepareValue(cfg *TopicConfig, val *Value) error {
+	applyCompression(cfg, val)
+	return encryptValue(s.keys, val)
+}
+
+// Reencrypt rewrites the values of the store at path so that all of them are encrypted under the
+// current key of the provider. Encrypted values only get their data key rewrapped, while values
+// stored before encryption was enabled are encrypted. Once it returns, keys other than the current
+// one can be removed from the provider. It returns the number of rewritten values. The store must
+// not be open elsewhere while it runs.
+func Reencrypt(path string, keys KeyProvider) (uint64, error) {
+	if keys == nil {
+		return 0, ErrNoKeys
+	}
+
+	st, err := NewStore(path, WithJanitorInterval(0), WithKeyProvider(keys))
+	if err != nil {
+		return 0, err
+	}
+	defer st.Close()
+
+	return st.(*store).reencrypt()
+}
+
+// reencrypt rewrites every stored value which isn't encrypted under the current key. Values are
+// rewritten in batches, and since a rewritten value is skipped, an interrupted run is finished by
+// running it again.
+func (s *store) reencrypt() (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var rewritten uint64
+	for _, prefix := range []byte{primaryPrefix, ackPrefix, schedulePrefix, heldPrefix} {
+		n, err := s.reencryptPrefix(prefix)
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += n
+	}
+
+	return rewritten, nil
+}
+
+func (s *store) reencryptPrefix(prefix byte) (uint64, error) {
+	var (
+		rewritten uint64
+		tx        = newBatchTx(s.db)
+		pending   int
+	)
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{prefix}), nil)
+	defer iter.Release()
+	for iter.Next() {
+		// the position indicators of bands and ack prefixes aren't values.
+		if prefix == primaryPrefix || prefix == ackPrefix {
+			_, _, offset, ok := decodeKey(iter.Key())
+			if !ok || offset == headIndicator || offset == tailIndicator {
+				continue
+			}
+		}
+
+		val := Decode(append([]byte(nil), iter.Value()...))
+		if val.KeyID == s.keys.CurrentKeyID() {
+			continue
+		}
+
+		var err error
+		if val.KeyID != "" {
+			err = rewrapValue(s.keys, val)
+		} else {
+			err = encryptValue(s.keys, val)
+		}
+		if err != nil {
+			return rewritten, fmt.Errorf("reencrypting value: %w", err)
+		}
+
+		b := val.Encode()
+		key := append([]byte(nil), iter.Key()...)
+		if err := tx.Put(key, b, nil); err != nil {
+			return rewritten, err
+		}
+
+		// the bands count the size of their stored values.
+		if prefix == primaryPrefix {
+			_, band, _, _ := decodeKey(key)
+			if err := addUsage(tx, band, len(b)-len(iter.Value())); err != nil {
+				return rewritten, err
+			}
+		}
+
+		rewritten++
+		if pending++; pending == reencryptBatchSize {
+			if err := tx.commit(); err != nil {
+				return rewritten, fmt.Errorf("commiting reencrypted values: %v", err)
+			}
+			tx, pending = newBatchTx(s.db), 0
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return rewritten, fmt.Errorf("iterating values: %v", err)
+	}
+
+	if err := tx.commit(); err != nil {
+		return rewritten, fmt.Errorf("commiting reencrypted values: %v", err)
+	}
+
+	return rewritten, nil
+}
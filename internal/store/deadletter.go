@@ -0,0 +1,212 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Redrive moves up to max ready messages from a dead-letter topic back to the topics they were
+// dead-lettered from, or all of them if max is zero. The redriven messages start over with a zero
+// dacks counter and no expiry time. They're admitted like published messages, and a message of a
+// FIFO group which is busy is held behind the group's other messages. Messages without dead-letter
+// information and messages their topic rejects because it's full are moved to the tail of the
+// dead-letter topic instead. It returns the amount of messages moved to each topic.
+func (s *store) Redrive(dlq []byte, max uint64) (map[string]uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := topicExists(s.db, dlq); err != nil {
+		return nil, err
+	}
+
+	moved := make(map[string]uint64)
+	err := s.withTx(func(tx leveldbCommon) error {
+		priorities, err := queuePriorities(tx, dlq)
+		if err != nil {
+			return err
+		}
+
+		var count uint64
+		for i := len(priorities) - 1; i >= 0 && (max == 0 || count < max); i-- {
+			n, err := redriveBand(tx, dlq, priorities[i], max-count, moved)
+			if err != nil {
+				return err
+			}
+			count += n
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return moved, nil
+}
+
+// redriveBand redrives up to max ready messages of a priority band of a dead-letter topic, or all
+// of them if max is zero, and counts them by topic in moved. Messages which can't be redriven are
+// moved to the tail of the band, past the messages the call looks at.
+func redriveBand(tx leveldbCommon, dlq []byte, priority uint8, max uint64, moved map[string]uint64) (uint64, error) {
+	band := priorityQueue(dlq, priority)
+	head, err := getPos(tx, band)
+	if err != nil {
+		return 0, err
+	}
+
+	tail, err := getTail(tx, primaryPrefix, band)
+	if err != nil {
+		return 0, err
+	}
+
+	var count, removed uint64
+	for offset := head; offset < tail && (max == 0 || count < max); offset++ {
+		key := encodeKeyWithOffset(primaryPrefix, band, offset)
+		raw, err := tx.Get(key, nil)
+		if err != nil {
+			return 0, err
+		}
+		val := Decode(raw)
+
+		if err := tx.Delete(key, nil); err != nil {
+			return 0, err
+		}
+
+		if err := addUsage(tx, band, -len(raw)); err != nil {
+			return 0, err
+		}
+		removed++
+
+		if val.DeadLetter == nil {
+			if _, err := appendValue(tx, primaryPrefix, band, val); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		var retentionErr *RetentionError
+		err = redriveValue(tx, val)
+		if errors.As(err, &retentionErr) {
+			if _, err := appendValue(tx, primaryPrefix, band, val); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		moved[val.DeadLetter.Topic]++
+		count++
+	}
+
+	if _, _, err := addPos(tx, band, int(removed)); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// deadLetter moves a value which failed in a queue to the dead-letter topic of the queue's topic.
+// The value keeps its metadata apart from the dacks counter and the expiry time, which start over
+// in the dead-letter topic.
+func deadLetter(tx leveldbCommon, queue []byte, cfg *TopicConfig, val *Value, failures uint32, reason string) error {
+	base := baseTopic(queue)
+
+	dead := *val
+	dead.Dacks = 0
+	dead.ExpiresAt = time.Time{}
+	dead.DeadLetter = &DeadLetter{
+		Topic:    string(base),
+		Failures: failures,
+		Reason:   reason,
+	}
+	if len(base) != len(queue) {
+		dead.DeadLetter.Subscription = string(queue[len(base)+1:])
+	}
+
+	dlq := cfg.deadLetterTopic(base)
+	if _, err := insertTopic(tx, dlq, &dead); err != nil {
+		return fmt.Errorf("moving value to dead-letter topic [%s]: %v", string(dlq), err)
+	}
+
+	return nil
+}
+
+// deadLetterLeased moves a leased message which can't be delivered to the dead-letter topic with the
+// reason and removes its lease.
+func deadLetterLeased(tx leveldbCommon, topic []byte, offset uint64, reason string) error {
+	key := encodeKeyWithOffset(ackPrefix, topic, offset)
+	raw, err := tx.Get(key, nil)
+	if err != nil {
+		return err
+	}
+	val := Decode(raw)
+
+	cfg, err := getTopicConfig(tx, baseTopic(topic))
+	if err != nil {
+		return err
+	}
+
+	if err := deadLetter(tx, topic, cfg, val, val.Dacks, reason); err != nil {
+		return err
+	}
+
+	if err := settleGroup(tx, topic, val, offset, true); err != nil {
+		return err
+	}
+
+	if err := tx.Delete(key, nil); err != nil {
+		return fmt.Errorf("error deleting ack-key: %v", err)
+	}
+
+	return tx.Delete(encodeKeyWithOffset(leasePrefix, topic, offset), nil)
+}
+
+// redriveValue inserts a dead-lettered value back to the subscription it came from. If it didn't
+// come from a subscription or the subscription no longer exists, it's inserted into the topic. The
+// value is admitted by the topic first, and the dead-letter information is kept if it's rejected.
+func redriveValue(tx leveldbCommon, val *Value) error {
+	dl := val.DeadLetter
+	topic := []byte(dl.Topic)
+
+	cfg, err := getTopicConfig(tx, topic)
+	if err != nil {
+		return err
+	}
+
+	redriven := *val
+	redriven.DeadLetter = nil
+	redriven.Dacks = 0
+	redriven.ExpiresAt = time.Time{}
+	if err := admit(tx, topic, cfg, &redriven); err != nil {
+		return err
+	}
+
+	queue := topic
+	if dl.Subscription != "" {
+		exists, err := tx.Has(subscriptionKey(topic, []byte(dl.Subscription)), nil)
+		if err != nil {
+			return fmt.Errorf("checking existance failed: %v", err)
+		}
+
+		if exists {
+			queue = SubscriptionTopic(topic, []byte(dl.Subscription))
+		}
+	}
+
+	// a value inserted into every subscription of a fan-out topic or into a stream has no group
+	// to wait for.
+	if cfg.Mode == ModeQueue || len(queue) != len(topic) {
+		held, err := holdGrouped(tx, queue, &redriven)
+		if held || err != nil {
+			return err
+		}
+
+		_, err = insertValue(tx, queue, &redriven)
+		return err
+	}
+
+	_, err = insertTopic(tx, topic, &redriven)
+	return err
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// defaultDedupWindow is how long idempotency keys are remembered by topics without a
+	// DedupWindow.
+	defaultDedupWindow = 10 * time.Minute
+	// MaxIdempotencyKeyLen is the maximum length of an idempotency key.
+	MaxIdempotencyKeyLen = 256
+
+	dedupEntryLen = 8 + 8 + 16 + 1
+)
+
+var ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+// Receipt describes where a message published with an idempotency key was enqueued. Offset is the
+// offset of the message in its priority band, or in the stream for stream topics. It's zero for
+// fan-out topics, where every subscription has offsets of its own, and for scheduled messages,
+// which get their offset once they are delivered. Duplicate is set if the key was already used
+// within the topic's dedup window, in which case the receipt is the one of the original message and
+// the value wasn't inserted again.
+type Receipt struct {
+	ID        uuid.UUID `json:"id"`
+	Offset    uint64    `json:"offset"`
+	Scheduled bool      `json:"scheduled,omitempty"`
+	Duplicate bool      `json:"duplicate,omitempty"`
+}
+
+func (c *TopicConfig) dedupWindow() time.Duration {
+	if c.DedupWindow == 0 {
+		return defaultDedupWindow
+	}
+
+	return c.DedupWindow.Duration()
+}
+
+// dedupEntry is the receipt of an idempotency key along with the time the key is forgotten. The
+// layout is the big-endian expiry time in unix nanoseconds, the big-endian offset, the message ID
+// and a byte which is 1 for scheduled messages.
+type dedupEntry struct {
+	expiresAt time.Time
+	receipt   Receipt
+}
+
+func (e *dedupEntry) encode() []byte {
+	b := make([]byte, dedupEntryLen)
+	binary.BigEndian.PutUint64(b, uint64(e.expiresAt.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], e.receipt.Offset)
+	copy(b[16:32], e.receipt.ID[:])
+	if e.receipt.Scheduled {
+		b[32] = 1
+	}
+
+	return b
+}
+
+func decodeDedupEntry(b []byte) (*dedupEntry, bool) {
+	if len(b) != dedupEntryLen {
+		return nil, false
+	}
+
+	e := &dedupEntry{expiresAt: time.Unix(0, int64(binary.BigEndian.Uint64(b)))}
+	e.receipt.Offset = binary.BigEndian.Uint64(b[8:])
+	copy(e.receipt.ID[:], b[16:32])
+	e.receipt.Scheduled = b[32] == 1
+
+	return e, true
+}
+
+// InsertIdempotent inserts a value into the topic unless the idempotency key was already used for
+// the topic within its dedup window. A repeated key returns the receipt of the original message
+// with Duplicate set, so retrying a publish doesn't enqueue the message twice. Values are scheduled
+// if at is in the future, like with Schedule.
+func (s *store) InsertIdempotent(topic, key []byte, val *Value, at time.Time) (*Receipt, error) {
+	if !validTopic(topic) {
+		return nil, ErrInvalidTopic
+	}
+
+	if len(key) == 0 || len(key) > MaxIdempotencyKeyLen {
+		return nil, ErrInvalidIdempotencyKey
+	}
+
+	if err := validPriority(val); err != nil {
+		return nil, err
+	}
+
+	if err := validGroupKey(val); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var receipt *Receipt
+	err := s.withTx(func(tx leveldbCommon) error {
+		now := time.Now()
+
+		b, err := tx.Get(dedupKey(topic, key), nil)
+		if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+			return fmt.Errorf("getting idempotency key: %v", err)
+		}
+		if err == nil {
+			if e, ok := decodeDedupEntry(b); ok && now.Before(e.expiresAt) {
+				receipt = &e.receipt
+				receipt.Duplicate = true
+				return nil
+			}
+		}
+
+		cfg, err := getTopicConfig(tx, topic)
+		if err != nil {
+			return err
+		}
+
+		if err := s.prepareValue(cfg, val); err != nil {
+			return err
+		}
+
+		receipt = &Receipt{ID: val.ID}
+		if at.After(now) {
+			receipt.Scheduled = true
+			if err := s.scheduleValues(tx, topic, []*Value{val}, at); err != nil {
+				return err
+			}
+		} else {
+			if err := admit(tx, topic, cfg, val); err != nil {
+				return err
+			}
+
+			if receipt.Offset, err = insertTopic(tx, topic, val); err != nil {
+				return err
+			}
+		}
+
+		e := &dedupEntry{expiresAt: now.Add(cfg.dedupWindow()), receipt: *receipt}
+		if err := tx.Put(dedupKey(topic, key), e.encode(), nil); err != nil {
+			return fmt.Errorf("putting idempotency key: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt, nil
+}
+
+// pruneDedup deletes the idempotency keys whose dedup window has passed at now and returns the
+// amount of deleted keys. Expired keys are ignored by InsertIdempotent, so pruning only reclaims
+// space.
+func (s *store) pruneDedup(now time.Time) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var pruned uint64
+	batch := new(leveldb.Batch)
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{dedupPrefix}), nil)
+	for iter.Next() {
+		if e, ok := decodeDedupEntry(iter.Value()); ok && now.Before(e.expiresAt) {
+			continue
+		}
+
+		batch.Delete(iter.Key())
+		pruned++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("iterating idempotency keys: %v", err)
+	}
+
+	if pruned == 0 {
+		return 0, nil
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+
+	return pruned, nil
+}
+
+// deleteDedupKeys deletes the idempotency keys of a topic.
+func deleteDedupKeys(db leveldbCommon, topic []byte) error {
+	return deletePrefix(db, topicKeyPrefix(dedupPrefix, topic))
+}
+
+func dedupKey(topic, key []byte) []byte {
+	return append(topicKeyPrefix(dedupPrefix, topic), key...)
+}
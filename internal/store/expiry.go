@@ -0,0 +1,55 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Expiry is what happens to a message that expires before it's delivered.
+type Expiry string
+
+const (
+	// ExpiryDiscard drops expired messages.
+	ExpiryDiscard Expiry = "discard"
+	// ExpiryDeadLetter moves expired messages to the topic's dead-letter topic.
+	ExpiryDeadLetter Expiry = "dead_letter"
+)
+
+// ReasonExpired is the dead-letter reason of messages that expired before they were delivered.
+const ReasonExpired = "message expired"
+
+// applyTTL sets the expiry time of a value published without one from the topic's default TTL.
+func applyTTL(cfg *TopicConfig, val *Value, now time.Time) {
+	if val.ExpiresAt.IsZero() && cfg.MessageTTL > 0 {
+		val.ExpiresAt = now.Add(cfg.MessageTTL.Duration()).UTC()
+	}
+}
+
+// expire handles a value of a queue which expired before it was leased. The value has already been
+// removed from its band, which counts the expiry.
+func expire(tx leveldbCommon, queue, band []byte, cfg *TopicConfig, val *Value) error {
+	u, err := getUsage(tx, band)
+	if err != nil {
+		return err
+	}
+	u.expired++
+	if err := putUsage(tx, band, u); err != nil {
+		return err
+	}
+
+	if val.GroupKey != "" {
+		if err := releaseGroup(tx, queue, val.GroupKey); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Expiry != ExpiryDeadLetter {
+		return nil
+	}
+
+	if err := deadLetter(tx, queue, cfg, val, val.Dacks, ReasonExpired); err != nil {
+		return fmt.Errorf("dead-lettering expired value: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// MaxGroupKeyLen is the maximum length of the group key of a message.
+const MaxGroupKeyLen = 256
+
+var ErrInvalidGroupKey = errors.New("invalid group key")
+
+// fifoGroup is the state of a message group of a queue. A group has at most one outstanding
+// message. Messages of the group that reach the head of their band while another message of the
+// group is outstanding are held under the held prefix, in the order they reached the head, and
+// released one at a time as the outstanding messages are settled.
+//
+// The state is stored under the fifo prefix of the queue followed by the group key. The layout is
+// a byte which is 1 if the group has an outstanding message, the big-endian ack offset of that
+// message and the big-endian offsets of the first and the next held message. Groups without an
+// outstanding or held message have no state.
+type fifoGroup struct {
+	outstanding bool
+	offset      uint64
+	head, tail  uint64
+}
+
+const fifoGroupLen = 1 + 8 + 8 + 8
+
+func getFifoGroup(db leveldbCommon, queue []byte, group string) (*fifoGroup, error) {
+	b, err := db.Get(fifoKey(queue, group), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return &fifoGroup{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting message group: %v", err)
+	}
+
+	return decodeFifoGroup(b), nil
+}
+
+func decodeFifoGroup(b []byte) *fifoGroup {
+	return &fifoGroup{
+		outstanding: b[0] == 1,
+		offset:      binary.BigEndian.Uint64(b[1:]),
+		head:        binary.BigEndian.Uint64(b[9:]),
+		tail:        binary.BigEndian.Uint64(b[17:]),
+	}
+}
+
+func putFifoGroup(db leveldbCommon, queue []byte, group string, g *fifoGroup) error {
+	key := fifoKey(queue, group)
+	if !g.outstanding && g.head == g.tail {
+		if err := db.Delete(key, nil); err != nil {
+			return fmt.Errorf("deleting message group: %v", err)
+		}
+		return nil
+	}
+
+	b := make([]byte, fifoGroupLen)
+	if g.outstanding {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint64(b[1:], g.offset)
+	binary.BigEndian.PutUint64(b[9:], g.head)
+	binary.BigEndian.PutUint64(b[17:], g.tail)
+
+	if err := db.Put(key, b, nil); err != nil {
+		return fmt.Errorf("putting message group: %v", err)
+	}
+
+	return nil
+}
+
+func validGroupKey(val *Value) error {
+	if len(val.GroupKey) > MaxGroupKeyLen {
+		return ErrInvalidGroupKey
+	}
+
+	return nil
+}
+
+// leaseGrouped leases a value removed from a band of the queue unless its group already has an
+// outstanding message, in which case the value is held until the group is settled. It returns nil
+// if the value was held.
+func leaseGrouped(tx leveldbCommon, queue []byte, cfg *TopicConfig, val *Value) (*Message, error) {
+	if val.GroupKey == "" {
+		return leaseValue(tx, queue, cfg, val)
+	}
+
+	g, err := getFifoGroup(tx, queue, val.GroupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.outstanding {
+		if err := tx.Put(heldKey(queue, val.GroupKey, g.tail), val.Encode(), nil); err != nil {
+			return nil, fmt.Errorf("holding value: %v", err)
+		}
+		g.tail++
+
+		return nil, putFifoGroup(tx, queue, val.GroupKey, g)
+	}
+
+	msg, err := leaseValue(tx, queue, cfg, val)
+	if err != nil {
+		return nil, err
+	}
+
+	g.outstanding = true
+	g.offset = msg.Offset
+	if err := putFifoGroup(tx, queue, val.GroupKey, g); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// holdGrouped holds a value inserted into the queue behind the other messages of its group if the
+// group has an outstanding or held message. It reports whether the value was held.
+func holdGrouped(tx leveldbCommon, queue []byte, val *Value) (bool, error) {
+	if val.GroupKey == "" {
+		return false, nil
+	}
+
+	g, err := getFifoGroup(tx, queue, val.GroupKey)
+	if err != nil {
+		return false, err
+	}
+	if !g.outstanding && g.head == g.tail {
+		return false, nil
+	}
+
+	if err := tx.Put(heldKey(queue, val.GroupKey, g.tail), val.Encode(), nil); err != nil {
+		return false, fmt.Errorf("holding value: %v", err)
+	}
+	g.tail++
+
+	return true, putFifoGroup(tx, queue, val.GroupKey, g)
+}
+
+// settleGroup ends the outstanding message of the value's group, which was leased at offset. If
+// release is set, the first held message of the group is moved back to the head of its band so
+// that it's delivered next. A message returned to its band by a nack isn't followed by a release,
+// since it's still the next message of its group.
+func settleGroup(tx leveldbCommon, queue []byte, val *Value, offset uint64, release bool) error {
+	if val.GroupKey == "" {
+		return nil
+	}
+
+	g, err := getFifoGroup(tx, queue, val.GroupKey)
+	if err != nil {
+		return err
+	}
+
+	if g.outstanding && g.offset == offset {
+		g.outstanding = false
+	}
+
+	if release {
+		if err := releaseHeld(tx, queue, val.GroupKey, g); err != nil {
+			return err
+		}
+	}
+
+	return putFifoGroup(tx, queue, val.GroupKey, g)
+}
+
+// releaseGroup releases the first held message of a group which has no outstanding message. It's
+// used when a message of the group leaves its band without being leased, so that the messages
+// held behind it aren't stuck.
+func releaseGroup(tx leveldbCommon, queue []byte, group string) error {
+	g, err := getFifoGroup(tx, queue, group)
+	if err != nil {
+		return err
+	}
+
+	if g.outstanding {
+		return nil
+	}
+
+	if err := releaseHeld(tx, queue, group, g); err != nil {
+		return err
+	}
+
+	return putFifoGroup(tx, queue, group, g)
+}
+
+// releaseHeld moves the first held message of a group to the head of its band. The caller stores
+// the updated group.
+func releaseHeld(tx leveldbCommon, queue []byte, group string, g *fifoGroup) error {
+	if g.head == g.tail {
+		return nil
+	}
+
+	key := heldKey(queue, group, g.head)
+	raw, err := tx.Get(key, nil)
+	if err != nil {
+		return fmt.Errorf("getting held value: %v", err)
+	}
+
+	if err := tx.Delete(key, nil); err != nil {
+		return fmt.Errorf("deleting held value: %v", err)
+	}
+	g.head++
+
+	val := Decode(raw)
+	if _, err := prependTx(tx, priorityQueue(queue, val.Priority), val); err != nil {
+		return fmt.Errorf("releasing held value: %v", err)
+	}
+
+	return nil
+}
+
+// countHeld returns the number of held messages of a queue.
+func countHeld(db leveldbCommon, queue []byte) (uint64, error) {
+	var held uint64
+	iter := db.NewIterator(util.BytesPrefix(topicKeyPrefix(fifoPrefix, queue)), nil)
+	for iter.Next() {
+		g := decodeFifoGroup(iter.Value())
+		held += g.tail - g.head
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("iterating message groups: %v", err)
+	}
+
+	return held, nil
+}
+
+// purgeHeld deletes the held messages of a queue and returns their amount. Groups with an
+// outstanding message keep it.
+func purgeHeld(db leveldbCommon, queue []byte) (uint64, error) {
+	var purged uint64
+	iter := db.NewIterator(util.BytesPrefix(topicKeyPrefix(fifoPrefix, queue)), nil)
+	for iter.Next() {
+		g := decodeFifoGroup(iter.Value())
+		purged += g.tail - g.head
+
+		var err error
+		if g.outstanding {
+			b := append([]byte(nil), iter.Value()...)
+			binary.BigEndian.PutUint64(b[9:], g.tail)
+			err = db.Put(iter.Key(), b, nil)
+		} else {
+			err = db.Delete(iter.Key(), nil)
+		}
+		if err != nil {
+			iter.Release()
+			return 0, err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("iterating message groups: %v", err)
+	}
+
+	if err := deletePrefix(db, topicKeyPrefix(heldPrefix, queue)); err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// deleteFifoKeys deletes the message groups and held messages of a queue.
+func deleteFifoKeys(db leveldbCommon, queue []byte) error {
+	if err := deletePrefix(db, topicKeyPrefix(fifoPrefix, queue)); err != nil {
+		return err
+	}
+
+	return deletePrefix(db, topicKeyPrefix(heldPrefix, queue))
+}
+
+// deletePrefix deletes every key with the given prefix.
+func deletePrefix(db leveldbCommon, prefix []byte) error {
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		if err := db.Delete(iter.Key(), nil); err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating keys: %v", err)
+	}
+
+	return nil
+}
+
+func fifoKey(queue []byte, group string) []byte {
+	return append(topicKeyPrefix(fifoPrefix, queue), group...)
+}
+
+// heldKey builds the key of a held message. The layout is the queue's prefix under the held
+// prefix, the uint16 length of the group key, the group key and the big-endian offset of the
+// message in the group.
+func heldKey(queue []byte, group string, offset uint64) []byte {
+	key := topicKeyPrefix(heldPrefix, queue)
+	key = binary.BigEndian.AppendUint16(key, uint16(len(group)))
+	key = append(key, group...)
+	return binary.BigEndian.AppendUint64(key, offset)
+}
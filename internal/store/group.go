@@ -0,0 +1,166 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	ErrInvalidMember  = errors.New("invalid group member name")
+	ErrMemberNotFound = errors.New("group member not found")
+)
+
+// Group is a consumer group of a fan-out topic. Every group is a durable subscription, so each
+// group receives every message of the topic and the members of a group compete for its messages.
+// Lag is the number of messages waiting for the group and Outstanding the number of messages
+// leased to its members but not yet acknowledged.
+type Group struct {
+	Name        string    `json:"name"`
+	Lag         uint64    `json:"lag"`
+	Outstanding uint64    `json:"outstanding"`
+	Members     []*Member `json:"members"`
+}
+
+// Member is a named member of a consumer group. Members are stored until they leave the group, so
+// they're listed even while none of their consumers are connected. Connections and Outstanding
+// describe the member's connected consumers and are filled in by the broker.
+type Member struct {
+	Name        string    `json:"name"`
+	JoinedAt    time.Time `json:"joined_at"`
+	Connections int       `json:"connections"`
+	Outstanding int       `json:"outstanding"`
+}
+
+// AddMember adds a member to a consumer group of a fan-out topic, creating the group's durable
+// subscription if it doesn't exist. Adding an existing member is a no-op.
+func (s *store) AddMember(topic, group, member []byte) error {
+	if len(member) == 0 {
+		return ErrInvalidMember
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.withTx(func(tx leveldbCommon) error {
+		if err := addSubscription(tx, topic, group, true); err != nil {
+			return err
+		}
+
+		key := memberKey(topic, group, member)
+		exists, err := tx.Has(key, nil)
+		if err != nil {
+			return fmt.Errorf("checking existance failed: %v", err)
+		}
+		if exists {
+			return nil
+		}
+
+		b, err := json.Marshal(&Member{Name: string(member), JoinedAt: time.Now().UTC()})
+		if err != nil {
+			return fmt.Errorf("encoding member: %v", err)
+		}
+
+		return tx.Put(key, b, nil)
+	})
+}
+
+// RemoveMember removes a member from a consumer group. The group itself is kept along with its
+// messages.
+func (s *store) RemoveMember(topic, group, member []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key := memberKey(topic, group, member)
+	exists, err := s.db.Has(key, nil)
+	if err != nil {
+		return fmt.Errorf("checking existance failed: %v", err)
+	}
+	if !exists {
+		return ErrMemberNotFound
+	}
+
+	return s.db.Delete(key, nil)
+}
+
+// Groups returns the consumer groups of a topic, which are its durable subscriptions, in name
+// order.
+func (s *store) Groups(topic []byte) ([]*Group, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := topicExists(s.db, topic); err != nil {
+		return nil, err
+	}
+
+	prefix := topicKeyPrefix(subPrefix, topic)
+
+	var names [][]byte
+	iter := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		if len(iter.Value()) > 0 && iter.Value()[0] == 1 {
+			names = append(names, append([]byte(nil), iter.Key()[len(prefix):]...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating subscriptions: %v", err)
+	}
+
+	groups := make([]*Group, 0, len(names))
+	for _, name := range names {
+		stats, err := queueStats(s.db, SubscriptionTopic(topic, name))
+		if err != nil {
+			return nil, fmt.Errorf("getting stats of group [%s]: %v", string(name), err)
+		}
+
+		members, err := getMembers(s.db, topic, name)
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, &Group{
+			Name:        string(name),
+			Lag:         stats.Ready,
+			Outstanding: stats.Unacked,
+			Members:     members,
+		})
+	}
+
+	return groups, nil
+}
+
+func getMembers(db leveldbCommon, topic, group []byte) ([]*Member, error) {
+	members := []*Member{}
+	iter := db.NewIterator(util.BytesPrefix(memberKey(topic, group, nil)), nil)
+	for iter.Next() {
+		var m Member
+		if err := json.Unmarshal(iter.Value(), &m); err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("decoding member: %v", err)
+		}
+		members = append(members, &m)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating members: %v", err)
+	}
+
+	return members, nil
+}
+
+// memberKey returns the key of a group member. Group names can't contain the subscription
+// separator, so it's used to separate the group from the member.
+func memberKey(topic, group, member []byte) []byte {
+	key := append(topicKeyPrefix(memberPrefix, topic), group...)
+	key = append(key, subscriptionSeparator)
+	return append(key, member...)
+}
+
+// deleteMemberKeys deletes all members of a group.
+func deleteMemberKeys(db leveldbCommon, topic, group []byte) error {
+	return deletePrefix(db, memberKey(topic, group, nil))
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ReasonLeaseExpired is the nack reason of messages whose visibility timeout expired.
+const ReasonLeaseExpired = "visibility timeout expired"
+
+// ErrNoVisibilityTimeout is returned when touching a message of a topic without a visibility
+// timeout, whose leases never expire.
+var ErrNoVisibilityTimeout = errors.New("topic has no visibility timeout")
+
+// putLease records the deadline by which the leased message at the ack offset has to be
+// acknowledged before it is returned to the topic.
+func putLease(db leveldbCommon, topic []byte, offset uint64, deadline time.Time) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(deadline.UnixNano()))
+
+	if err := db.Put(encodeKeyWithOffset(leasePrefix, topic, offset), b, nil); err != nil {
+		return fmt.Errorf("putting lease: %v", err)
+	}
+
+	return nil
+}
+
+// Touch extends the lease of a message so that it's not returned to the topic for the given
+// duration. A zero duration extends the lease by the topic's visibility timeout, or fails with
+// ErrNoVisibilityTimeout if the topic doesn't have one.
+func (s *store) Touch(topic []byte, offset uint64, extend time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	exists, err := s.db.Has(encodeKeyWithOffset(ackPrefix, topic, offset), nil)
+	if err != nil {
+		return fmt.Errorf("checking existance failed: %v", err)
+	}
+	if !exists {
+		return ErrKeyDoesntExist
+	}
+
+	if extend == 0 {
+		cfg, err := getTopicConfig(s.db, baseTopic(topic))
+		if err != nil {
+			return err
+		}
+		extend = cfg.VisibilityTimeout.Duration()
+	}
+	if extend <= 0 {
+		return ErrNoVisibilityTimeout
+	}
+
+	return putLease(s.db, topic, offset, time.Now().Add(extend))
+}
+
+// RequeueExpired returns every message whose lease expired before now to the head of its topic.
+// It returns the topics which received messages, with subscription queues reported as the fan-out
+// topic they belong to.
+func (s *store) RequeueExpired(now time.Time) ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	type lease struct {
+		topic  []byte
+		offset uint64
+	}
+
+	var expired []lease
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{leasePrefix}), nil)
+	for iter.Next() {
+		if int64(binary.BigEndian.Uint64(iter.Value())) > now.UnixNano() {
+			continue
+		}
+
+		if _, topic, offset, ok := decodeKey(iter.Key()); ok {
+			expired = append(expired, lease{topic: append([]byte(nil), topic...), offset: offset})
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating leases: %v", err)
+	}
+
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	var (
+		requeued [][]byte
+		seen     = make(map[string]bool)
+	)
+	err := s.withTx(func(tx leveldbCommon) error {
+		for _, l := range expired {
+			err := nackTx(tx, l.topic, l.offset, ReasonLeaseExpired)
+			if errors.Is(err, ErrKeyDoesntExist) {
+				// the message was acknowledged but the lease was left behind.
+				err = tx.Delete(encodeKeyWithOffset(leasePrefix, l.topic, l.offset), nil)
+			}
+			if err != nil {
+				return fmt.Errorf("requeueing offset [%d] of topic [%s]: %v", l.offset, string(l.topic), err)
+			}
+
+			if base := baseTopic(l.topic); !seen[string(base)] {
+				seen[string(base)] = true
+				requeued = append(requeued, base)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return requeued, nil
+}
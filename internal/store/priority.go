@@ -0,0 +1,126 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxPriority is the highest priority a message can be published with.
+const MaxPriority = 9
+
+// bandSuffixLen is how much longer the name of a priority band is than the name of its queue.
+const bandSuffixLen = 3
+
+var ErrInvalidPriority = errors.New("invalid message priority")
+
+// priorityQueue returns the name of the queue holding the ready messages of a priority band. The
+// messages of priority 0 are stored in the queue itself, while every other band is a separate queue
+// named after it. Band names contain the subscription separator twice in a row, which neither
+// topics nor subscription names can, so they never collide with either.
+//
+// Only the ready messages are stored in the bands. Leased messages are stored under the ack prefix
+// of the queue itself, so that offsets are unique within the queue regardless of priority.
+func priorityQueue(queue []byte, priority uint8) []byte {
+	if priority == 0 {
+		return queue
+	}
+
+	band := make([]byte, 0, len(queue)+bandSuffixLen)
+	band = append(band, queue...)
+	band = append(band, subscriptionSeparator, subscriptionSeparator)
+	return append(band, priority)
+}
+
+func validPriority(val *Value) error {
+	if val.Priority > MaxPriority {
+		return fmt.Errorf("%w: %d is above %d", ErrInvalidPriority, val.Priority, MaxPriority)
+	}
+
+	return nil
+}
+
+// queuePriorities returns the priorities of the bands of a queue that exist, in ascending order.
+// Priority 0 is always included since it's stored in the queue itself.
+func queuePriorities(db leveldbCommon, queue []byte) ([]uint8, error) {
+	priorities := []uint8{0}
+	for priority := uint8(1); priority <= MaxPriority; priority++ {
+		err := topicExists(db, priorityQueue(queue, priority))
+		if errors.Is(err, ErrTopicNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		priorities = append(priorities, priority)
+	}
+
+	return priorities, nil
+}
+
+// nextBand returns the queue of the highest priority band with ready messages and the offset of its
+// head. It returns ErrEmpty if none of the bands has ready messages.
+func nextBand(db leveldbCommon, queue []byte) ([]byte, uint64, error) {
+	priorities, err := queuePriorities(db, queue)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := len(priorities) - 1; i >= 0; i-- {
+		band := priorityQueue(queue, priorities[i])
+
+		ready, head, err := bandReady(db, band)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ready > 0 {
+			return band, head, nil
+		}
+	}
+
+	return nil, 0, ErrEmpty
+}
+
+// bandReady returns the amount of ready messages in a band and the offset of its head. Bands that
+// don't exist have no ready messages.
+func bandReady(db leveldbCommon, band []byte) (uint64, uint64, error) {
+	if err := topicExists(db, band); errors.Is(err, ErrTopicNotFound) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	head, err := getPos(db, band)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tail, err := getTail(db, primaryPrefix, band)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return tail - head, head, nil
+}
+
+// priorityStats returns the amount of ready messages in every non-empty priority band of a queue.
+// It returns nil if no message has been published to the queue with a priority above 0.
+func priorityStats(db leveldbCommon, queue []byte) (map[uint8]uint64, error) {
+	priorities, err := queuePriorities(db, queue)
+	if err != nil || len(priorities) == 1 {
+		return nil, err
+	}
+
+	depths := make(map[uint8]uint64)
+	for _, priority := range priorities {
+		ready, _, err := bandReady(db, priorityQueue(queue, priority))
+		if err != nil {
+			return nil, err
+		}
+		if ready > 0 {
+			depths[priority] = ready
+		}
+	}
+
+	return depths, nil
+}
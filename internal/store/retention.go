@@ -0,0 +1,426 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Overflow is what happens when a message is published to a queue which has reached its MaxBytes
+// or MaxMessages limit.
+type Overflow string
+
+const (
+	// OverflowDropOldest accepts the message and drops the oldest ready messages of the queue,
+	// starting from its lowest priority band, until the queue is within its limits again.
+	OverflowDropOldest Overflow = "drop_oldest"
+	// OverflowRejectPublish rejects the message with a RetentionError.
+	OverflowRejectPublish Overflow = "reject_publish"
+)
+
+// Limit names a retention limit of a topic.
+type Limit string
+
+const (
+	LimitMaxBytes    Limit = "max_bytes"
+	LimitMaxMessages Limit = "max_messages"
+)
+
+// defaultJanitorInterval is how often the janitor enforces the retention limits.
+const defaultJanitorInterval = time.Second
+
+// RetentionError is returned when a publish is rejected because a queue of the topic has reached
+// one of its retention limits and the topic's overflow policy is OverflowRejectPublish.
+type RetentionError struct {
+	Topic string
+	Limit Limit
+}
+
+func (e *RetentionError) Error() string {
+	return fmt.Sprintf("topic [%s] has reached its %s limit", e.Topic, e.Limit)
+}
+
+func (c *TopicConfig) hasRetention() bool {
+	return c.MaxAge > 0 || c.MaxBytes > 0 || c.MaxMessages > 0
+}
+
+func (c *TopicConfig) overflow() Overflow {
+	if c.Overflow == "" {
+		return OverflowDropOldest
+	}
+
+	return c.Overflow
+}
+
+// usage is the size of the ready messages of a priority band and the amount of messages dropped
+// from it by the retention limits or expired in it. It's stored under the usage prefix of the band
+// and updated by every operation adding or removing ready messages. Bands written before usage was
+// tracked start from zero.
+type usage struct {
+	bytes   uint64
+	dropped uint64
+	expired uint64
+}
+
+func getUsage(db leveldbCommon, band []byte) (usage, error) {
+	b, err := db.Get(topicKeyPrefix(usagePrefix, band), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return usage{}, nil
+	}
+	if err != nil {
+		return usage{}, fmt.Errorf("getting usage: %v", err)
+	}
+
+	return usage{
+		bytes:   binary.BigEndian.Uint64(b),
+		dropped: binary.BigEndian.Uint64(b[8:]),
+		expired: binary.BigEndian.Uint64(b[16:]),
+	}, nil
+}
+
+func (u usage) encode() []byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint64(b, u.bytes)
+	binary.BigEndian.PutUint64(b[8:], u.dropped)
+	binary.BigEndian.PutUint64(b[16:], u.expired)
+	return b
+}
+
+func putUsage(db leveldbCommon, band []byte, u usage) error {
+	if err := db.Put(topicKeyPrefix(usagePrefix, band), u.encode(), nil); err != nil {
+		return fmt.Errorf("putting usage: %v", err)
+	}
+
+	return nil
+}
+
+// addUsage adds size bytes to the usage of a band, or removes them if size is negative.
+func addUsage(db leveldbCommon, band []byte, size int) error {
+	u, err := getUsage(db, band)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 {
+		u.bytes += uint64(size)
+	} else {
+		u.bytes -= min(u.bytes, uint64(-size))
+	}
+
+	return putUsage(db, band, u)
+}
+
+// queueUsage returns the amount and size of the ready messages of a queue along with the amount of
+// messages dropped from it.
+func queueUsage(db leveldbCommon, queue []byte) (uint64, usage, error) {
+	priorities, err := queuePriorities(db, queue)
+	if err != nil {
+		return 0, usage{}, err
+	}
+
+	var (
+		ready uint64
+		total usage
+	)
+	for _, priority := range priorities {
+		band := priorityQueue(queue, priority)
+		n, _, err := bandReady(db, band)
+		if err != nil {
+			return 0, usage{}, err
+		}
+
+		u, err := getUsage(db, band)
+		if err != nil {
+			return 0, usage{}, err
+		}
+
+		ready += n
+		total.bytes += u.bytes
+		total.dropped += u.dropped
+		total.expired += u.expired
+	}
+
+	return ready, total, nil
+}
+
+// admit checks that a value published to a topic fits into every queue it's inserted into. It
+// returns a RetentionError if it doesn't and the topic rejects publishes when full.
+func admit(db leveldbCommon, topic []byte, cfg *TopicConfig, val *Value) error {
+	if cfg.overflow() != OverflowRejectPublish || (cfg.MaxBytes == 0 && cfg.MaxMessages == 0) {
+		return nil
+	}
+
+	queues := [][]byte{topic}
+	if cfg.Mode == ModeFanout {
+		subs, err := getSubscriptions(db, topic)
+		if err != nil {
+			return err
+		}
+
+		queues = queues[:0]
+		for _, sub := range subs {
+			queues = append(queues, SubscriptionTopic(topic, sub))
+		}
+	}
+
+	size := uint64(len(val.Encode()))
+	for _, queue := range queues {
+		if err := topicExists(db, queue); errors.Is(err, ErrTopicNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		ready, u, err := queueUsage(db, queue)
+		if err != nil {
+			return err
+		}
+
+		if cfg.MaxMessages > 0 && ready+1 > cfg.MaxMessages {
+			return &RetentionError{Topic: string(topic), Limit: LimitMaxMessages}
+		}
+		if cfg.MaxBytes > 0 && u.bytes+size > cfg.MaxBytes {
+			return &RetentionError{Topic: string(topic), Limit: LimitMaxBytes}
+		}
+	}
+
+	return nil
+}
+
+// fits reports whether the value fits into an empty queue of the topic, i.e. whether admit can
+// accept it once the topic has been drained.
+func (c *TopicConfig) fits(val *Value) bool {
+	return c.MaxBytes == 0 || uint64(len(val.Encode())) <= c.MaxBytes
+}
+
+// retentionBand is a priority band of a queue being trimmed.
+type retentionBand struct {
+	name       []byte
+	head, tail uint64
+	usage      usage
+	dropped    uint64
+	// groups holds the group keys of the dropped messages.
+	groups []string
+}
+
+// drop deletes the message at the head of the band.
+func (b *retentionBand) drop(db leveldbCommon) error {
+	key := encodeKeyWithOffset(primaryPrefix, b.name, b.head)
+	raw, err := db.Get(key, nil)
+	if err != nil {
+		return fmt.Errorf("getting message at offset [%d]: %v", b.head, err)
+	}
+
+	if err := db.Delete(key, nil); err != nil {
+		return fmt.Errorf("deleting message at offset [%d]: %v", b.head, err)
+	}
+
+	b.head++
+	b.usage.bytes -= min(b.usage.bytes, uint64(len(raw)))
+	b.usage.dropped++
+	b.dropped++
+	if val := Decode(raw); val.GroupKey != "" {
+		b.groups = append(b.groups, val.GroupKey)
+	}
+
+	return nil
+}
+
+// trim drops the ready messages of a queue that are older than the topic's MaxAge and, if the
+// topic drops the oldest messages on overflow, the oldest messages exceeding MaxBytes or
+// MaxMessages. It returns the amount of dropped messages.
+func trim(db leveldbCommon, queue []byte, cfg *TopicConfig, now time.Time) (uint64, error) {
+	if !cfg.hasRetention() {
+		return 0, nil
+	}
+
+	priorities, err := queuePriorities(db, queue)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		bands []*retentionBand
+		ready uint64
+		bytes uint64
+	)
+	for _, priority := range priorities {
+		b := &retentionBand{name: priorityQueue(queue, priority)}
+		n, head, err := bandReady(db, b.name)
+		if err != nil {
+			return 0, err
+		}
+		b.head, b.tail = head, head+n
+
+		if b.usage, err = getUsage(db, b.name); err != nil {
+			return 0, err
+		}
+
+		bands = append(bands, b)
+		ready += n
+		bytes += b.usage.bytes
+	}
+
+	if cfg.MaxAge > 0 {
+		cutoff := now.Add(-cfg.MaxAge.Duration())
+		for _, b := range bands {
+			for b.head < b.tail {
+				val, err := getValue(db, b.name, b.head)
+				if err != nil {
+					return 0, fmt.Errorf("getting message at offset [%d]: %v", b.head, err)
+				}
+				// messages without a publish time can't expire.
+				if val.PublishedAt.IsZero() || !val.PublishedAt.Before(cutoff) {
+					break
+				}
+
+				before := b.usage.bytes
+				if err := b.drop(db); err != nil {
+					return 0, err
+				}
+				ready--
+				bytes -= before - b.usage.bytes
+			}
+		}
+	}
+
+	if cfg.overflow() == OverflowDropOldest {
+		// bands are in ascending priority order, so the least important messages are dropped first.
+		for _, b := range bands {
+			for b.head < b.tail &&
+				((cfg.MaxMessages > 0 && ready > cfg.MaxMessages) || (cfg.MaxBytes > 0 && bytes > cfg.MaxBytes)) {
+				before := b.usage.bytes
+				if err := b.drop(db); err != nil {
+					return 0, err
+				}
+				ready--
+				bytes -= before - b.usage.bytes
+			}
+		}
+	}
+
+	var dropped uint64
+	for _, b := range bands {
+		if b.dropped == 0 {
+			continue
+		}
+
+		head := make([]byte, 8)
+		binary.LittleEndian.PutUint64(head, b.head)
+		if err := db.Put(encodeKeyWithOffset(primaryPrefix, b.name, headIndicator), head, nil); err != nil {
+			return 0, fmt.Errorf("putting new head position: %v", err)
+		}
+
+		if err := putUsage(db, b.name, b.usage); err != nil {
+			return 0, err
+		}
+		dropped += b.dropped
+	}
+
+	// a dropped message may have been released from its group, so the next held message of the
+	// group takes its place.
+	for _, b := range bands {
+		for _, group := range b.groups {
+			if err := releaseGroup(db, queue, group); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return dropped, nil
+}
+
+// enforceRetention trims every queue of the topics with retention limits and returns the amount
+// of dropped messages.
+func (s *store) enforceRetention(now time.Time) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	type retained struct {
+		topic []byte
+		cfg   *TopicConfig
+	}
+
+	var topics []retained
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{configPrefix}), nil)
+	for iter.Next() {
+		topic, _, ok := splitTopicKey(iter.Key())
+		if !ok {
+			continue
+		}
+
+		cfg, err := getTopicConfig(s.db, topic)
+		if err != nil {
+			iter.Release()
+			return 0, err
+		}
+
+		if cfg.hasRetention() {
+			topics = append(topics, retained{topic: append([]byte(nil), topic...), cfg: cfg})
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("iterating topic configs: %v", err)
+	}
+
+	var dropped uint64
+	for _, t := range topics {
+		subs, err := getSubscriptions(s.db, t.topic)
+		if err != nil {
+			return 0, err
+		}
+
+		queues := [][]byte{t.topic}
+		for _, sub := range subs {
+			queues = append(queues, SubscriptionTopic(t.topic, sub))
+		}
+
+		err = s.withTx(func(tx leveldbCommon) error {
+			for _, queue := range queues {
+				n, err := trim(tx, queue, t.cfg, now)
+				if err != nil {
+					return fmt.Errorf("trimming queue [%s]: %v", string(queue), err)
+				}
+				dropped += n
+			}
+
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return dropped, nil
+}
+
+// janitor periodically enforces the retention limits and forgets idempotency keys whose dedup
+// window has passed until the store is closed. The limits on the amount and size of messages are
+// also enforced when messages are inserted, but the janitor is needed to expire messages by age
+// and to apply limits lowered after the messages were inserted.
+func (s *store) janitor() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			if _, err := s.enforceRetention(now); err != nil {
+				log.Printf("enforcing retention limits: %v", err)
+			}
+			if _, err := s.pruneDedup(now); err != nil {
+				log.Printf("pruning idempotency keys: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// scheduleSeqKey holds the sequence number of the last scheduled message. It makes the keys of
+// messages scheduled for the same time unique and keeps them in publish order.
+var scheduleSeqKey = []byte{metaPrefix, 's', 'c', 'h', 'e', 'd', 's', 'e', 'q'}
+
+// Schedule stores a value which is inserted into the topic once the given time has passed. Values
+// scheduled for a time which already passed are inserted right away. The topic is created if it
+// doesn't exist, so that it can be configured before its first message is delivered.
+func (s *store) Schedule(topic []byte, val *Value, at time.Time) error {
+	return s.ScheduleBatch(topic, []*Value{val}, at)
+}
+
+// ScheduleBatch schedules all of the values for the same time in a single batch.
+func (s *store) ScheduleBatch(topic []byte, vals []*Value, at time.Time) error {
+	if !at.After(time.Now()) {
+		return s.InsertBatch(topic, vals)
+	}
+
+	if !validTopic(topic) {
+		return ErrInvalidTopic
+	}
+
+	for _, val := range vals {
+		if err := validPriority(val); err != nil {
+			return err
+		}
+
+		if err := validGroupKey(val); err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.withTx(func(tx leveldbCommon) error {
+		return s.scheduleValues(tx, topic, vals, at)
+	})
+}
+
+// scheduleValues stores the values under the schedule prefix and creates the topic.
+func (s *store) scheduleValues(tx leveldbCommon, topic []byte, vals []*Value, at time.Time) error {
+	if err := initTopic(tx, topic); err != nil {
+		return err
+	}
+
+	cfg, err := getTopicConfig(tx, topic)
+	if err != nil {
+		return err
+	}
+
+	for _, val := range vals {
+		if err := s.prepareValue(cfg, val); err != nil {
+			return err
+		}
+
+		seq, err := nextScheduleSeq(tx)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Put(scheduleKey(at, seq, topic), val.Encode(), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PromoteDue inserts every scheduled value which is due at now into its topic. Every value is moved
+// within a transaction of its own, so a crash never loses or duplicates a scheduled value and a
+// value which fails doesn't hold back the others. Values are admitted like published ones. A value
+// whose topic is full stays scheduled and is retried on the next call, while a value which can
+// never fit into its topic is moved to the topic's dead-letter topic instead. It returns the topics
+// which received values, along with the errors of values which couldn't be moved and stay
+// scheduled.
+func (s *store) PromoteDue(now time.Time) ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	type scheduled struct {
+		key   []byte
+		topic []byte
+		value []byte
+	}
+
+	var due []scheduled
+	iter := s.db.NewIterator(&util.Range{
+		Start: []byte{schedulePrefix},
+		Limit: scheduleKey(now.Add(1), 0, nil),
+	}, nil)
+	for iter.Next() {
+		topic, ok := scheduledTopic(iter.Key())
+		if !ok {
+			continue
+		}
+
+		due = append(due, scheduled{
+			key:   append([]byte(nil), iter.Key()...),
+			topic: append([]byte(nil), topic...),
+			value: append([]byte(nil), iter.Value()...),
+		})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating scheduled values: %v", err)
+	}
+
+	var (
+		promoted [][]byte
+		errs     []error
+		seen     = make(map[string]bool)
+	)
+	for _, d := range due {
+		topic, err := s.promote(d.key, d.topic, d.value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("promoting value to topic [%s]: %w", string(d.topic), err))
+			continue
+		}
+		if topic == nil {
+			continue
+		}
+
+		if !seen[string(topic)] {
+			seen[string(topic)] = true
+			promoted = append(promoted, topic)
+		}
+	}
+
+	return promoted, errors.Join(errs...)
+}
+
+// promote moves a scheduled value into its topic and returns the topic which received it. If the
+// topic is full, the value stays scheduled and nil is returned. A value which is larger than the
+// topic's byte limit is dead-lettered with the rejection as the reason and the dead-letter topic is
+// returned instead.
+func (s *store) promote(key, topic, value []byte) ([]byte, error) {
+	var (
+		cfg *TopicConfig
+		val = Decode(value)
+	)
+	err := s.withTx(func(tx leveldbCommon) error {
+		var err error
+		if cfg, err = getTopicConfig(tx, topic); err != nil {
+			return err
+		}
+
+		if err := admit(tx, topic, cfg, val); err != nil {
+			return err
+		}
+		if _, err := insertTopic(tx, topic, val); err != nil {
+			return err
+		}
+
+		return tx.Delete(key, nil)
+	})
+
+	var retentionErr *RetentionError
+	switch {
+	case err == nil:
+		return topic, nil
+	case !errors.As(err, &retentionErr):
+		return nil, err
+	case cfg.fits(val):
+		return nil, nil
+	}
+
+	reason := err.Error()
+	err = s.withTx(func(tx leveldbCommon) error {
+		if err := deadLetter(tx, topic, cfg, val, 0, reason); err != nil {
+			return err
+		}
+
+		return tx.Delete(key, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s, dead-lettering failed: %v", reason, err)
+	}
+
+	return cfg.deadLetterTopic(topic), nil
+}
+
+func nextScheduleSeq(db leveldbCommon) (uint64, error) {
+	var seq uint64
+
+	b, err := db.Get(scheduleSeqKey, nil)
+	if err == nil {
+		seq = binary.BigEndian.Uint64(b) + 1
+	} else if !errors.Is(err, leveldb.ErrNotFound) {
+		return 0, fmt.Errorf("getting schedule sequence: %v", err)
+	}
+
+	b = make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	if err := db.Put(scheduleSeqKey, b, nil); err != nil {
+		return 0, fmt.Errorf("putting schedule sequence: %v", err)
+	}
+
+	return seq, nil
+}
+
+// scheduleKey builds the key of a scheduled value. The layout is the prefix byte, the big-endian
+// delivery time in unix nanoseconds, the big-endian sequence number and the topic, so that the keys
+// sort by delivery time.
+func scheduleKey(at time.Time, seq uint64, topic []byte) []byte {
+	key := make([]byte, 1+8+8+len(topic))
+
+	key[0] = schedulePrefix
+	binary.BigEndian.PutUint64(key[1:9], uint64(at.UnixNano()))
+	binary.BigEndian.PutUint64(key[9:17], seq)
+	copy(key[17:], topic)
+
+	return key
+}
+
+func scheduledTopic(key []byte) ([]byte, bool) {
+	if len(key) <= 1+8+8 || key[0] != schedulePrefix {
+		return nil, false
+	}
+
+	return key[17:], true
+}
+
+// countScheduled returns the number of values scheduled for the topic.
+func countScheduled(db leveldbCommon, topic []byte) (uint64, error) {
+	var count uint64
+	err := iterateScheduled(db, topic, func([]byte) error {
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// deleteScheduledKeys deletes all values scheduled for the topic.
+func deleteScheduledKeys(db leveldbCommon, topic []byte) error {
+	return iterateScheduled(db, topic, func(key []byte) error { return db.Delete(key, nil) })
+}
+
+// iterateScheduled calls fn with the key of every value scheduled for the topic and stops at the
+// first error. The schedule is indexed by time, so the whole prefix has to be scanned.
+func iterateScheduled(db leveldbCommon, topic []byte, fn func(key []byte) error) error {
+	iter := db.NewIterator(util.BytesPrefix([]byte{schedulePrefix}), nil)
+	for iter.Next() {
+		t, ok := scheduledTopic(iter.Key())
+		if !ok || string(t) != string(topic) {
+			continue
+		}
+
+		if err := fn(append([]byte(nil), iter.Key()...)); err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating scheduled values: %v", err)
+	}
+
+	return nil
+}
@@ -6,54 +6,185 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const (
+	metaPrefix    = 0
 	primaryPrefix = 1
 	ackPrefix     = 2
+	configPrefix  = 3
+	subPrefix     = 4
+	leasePrefix   = 5
+	// schedulePrefix is indexed by delivery time instead of topic, see scheduleKey.
+	schedulePrefix = 6
+	memberPrefix   = 7
+	offsetPrefix   = 8
+	usagePrefix    = 9
+	dedupPrefix    = 10
+	fifoPrefix     = 11
+	heldPrefix     = 12
 
 	tailIndicator = math.MaxUint64
 	headIndicator = math.MaxUint64 - 1
+
+	// formatVersion is the version of the on-disk key layout. Databases without a version marker
+	// use the legacy layout and are migrated when they are opened.
+	formatVersion = 1
+	maxTopicLen   = math.MaxUint16
 )
 
 var (
 	ErrKeyDoesntExist = errors.New("key doesn't exist")
+	ErrInvalidTopic   = errors.New("invalid topic name")
+	ErrTopicNotFound  = errors.New("topic not found")
+	ErrEmpty          = errors.New("topic has no ready messages")
+
+	versionKey = []byte{metaPrefix, 'v', 'e', 'r', 's', 'i', 'o', 'n'}
 )
 
 //go:generate mockgen -source=$GOFILE -destination=store_mock.go -package=store
 type Store interface {
 	Insert(topic []byte, val *Value) error
+	InsertBatch(topic []byte, vals []*Value) error
 	Ack(topic []byte, offset uint64) error
-	Nack(topic []byte, offset uint64) error
+	Nack(topic []byte, offset uint64, reason string) error
 	GetNext(topic []byte) (*Value, uint64, error)
+	GetNextN(topic []byte, n int) ([]*Message, error)
+	Topics() ([][]byte, error)
+	Stats(topic []byte) (*TopicStats, error)
+	Purge(topic []byte) (uint64, error)
+	DeleteTopic(topic []byte) error
+	Touch(topic []byte, offset uint64, extend time.Duration) error
+	Schedule(topic []byte, val *Value, at time.Time) error
+	ScheduleBatch(topic []byte, vals []*Value, at time.Time) error
+	PromoteDue(now time.Time) ([][]byte, error)
+	RequeueExpired(now time.Time) ([][]byte, error)
+	Redrive(dlq []byte, max uint64) (map[string]uint64, error)
+	SetTopicConfig(topic []byte, cfg *TopicConfig) error
+	TopicConfig(topic []byte) (*TopicConfig, error)
+	AddSubscription(topic, name []byte, durable bool) error
+	RemoveSubscription(topic, name []byte) error
+	Subscriptions(topic []byte) ([][]byte, error)
+	AddMember(topic, group, member []byte) error
+	RemoveMember(topic, group, member []byte) error
+	Groups(topic []byte) ([]*Group, error)
+	Read(topic []byte, offset uint64, n int) ([]*Message, error)
+	Seek(topic []byte, pos Position) (uint64, error)
+	CommitOffset(topic, consumer []byte, offset uint64) error
+	CommittedOffset(topic, consumer []byte) (uint64, error)
+	InsertIdempotent(topic, key []byte, val *Value, at time.Time) (*Receipt, error)
 	Close() error
 }
 
+// TopicStats describes the current state of a topic. Head and Tail are the offsets of the first
+// ready message and the next inserted message of priority 0, Ready is the number of messages
+// waiting for a consumer, Unacked the number of messages leased to consumers but not yet
+// acknowledged and Scheduled the number of messages waiting for their delivery time. For stream
+// topics Ready is the number of retained messages. For fan-out topics the stats of every
+// subscription are listed in Subscriptions, with Topic set to the subscription's name.
+type TopicStats struct {
+	Topic     string `json:"topic"`
+	Mode      Mode   `json:"mode,omitempty"`
+	Head      uint64 `json:"head"`
+	Tail      uint64 `json:"tail"`
+	Ready     uint64 `json:"ready"`
+	Unacked   uint64 `json:"unacked"`
+	Scheduled uint64 `json:"scheduled,omitempty"`
+	// Bytes is the size of the ready messages and Dropped the number of messages dropped by the
+	// topic's retention limits.
+	Bytes   uint64 `json:"bytes"`
+	Dropped uint64 `json:"dropped,omitempty"`
+	// Expired is the number of messages which expired before they were delivered.
+	Expired uint64 `json:"expired,omitempty"`
+	// Held is the number of messages waiting for the outstanding message of their group to be
+	// settled. They're not included in Ready.
+	Held uint64 `json:"held,omitempty"`
+	// Priorities holds the number of ready messages of every non-empty priority band. It's only set
+	// for topics that have received messages with a priority above 0.
+	Priorities    map[uint8]uint64 `json:"priorities,omitempty"`
+	Subscriptions []*TopicStats    `json:"subscriptions,omitempty"`
+	// Offsets holds the committed offsets of the consumers of a stream topic.
+	Offsets map[string]uint64 `json:"offsets,omitempty"`
+}
+
+// Message is a leased message along with the offset used to acknowledge it, or a message read
+// from a stream along with its offset in the stream.
+type Message struct {
+	Offset uint64
+	Value  *Value
+}
+
 type store struct {
 	path string
 	db   *leveldb.DB
+	// wrapTx wraps the batch of every write operation. It's only set by tests to inject failures.
+	wrapTx          func(tx leveldbCommon) leveldbCommon
+	janitorInterval time.Duration
+	done            chan struct{}
+	closeOnce       sync.Once
+	wg              sync.WaitGroup
+	keys            KeyProvider
 	sync.RWMutex
 }
 
+type Option func(*store)
+
+// WithJanitorInterval sets how often the store enforces the retention limits of its topics. A zero
+// interval disables the janitor, in which case the limits are only enforced on insert and messages
+// don't expire by age.
+func WithJanitorInterval(d time.Duration) Option {
+	return func(s *store) {
+		s.janitorInterval = d
+	}
+}
+
 type leveldbCommon interface {
 	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
 	Put(key, value []byte, ro *opt.WriteOptions) error
 	Has(key []byte, ro *opt.ReadOptions) (bool, error)
+	Delete(key []byte, wo *opt.WriteOptions) error
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
 }
 
-func NewStore(path string) (Store, error) {
+func NewStore(path string, opts ...Option) (Store, error) {
 	db, err := leveldb.OpenFile(path, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return &store{
-		path: path,
-		db:   db,
-	}, nil
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating store: %v", err)
+	}
+
+	if err := removeEphemeralSubscriptions(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("removing ephemeral subscriptions: %v", err)
+	}
+
+	s := &store{
+		path:            path,
+		db:              db,
+		janitorInterval: defaultJanitorInterval,
+		done:            make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.janitorInterval > 0 {
+		s.wg.Add(1)
+		go s.janitor()
+	}
+
+	return s, nil
 }
 
 func (s *store) Ack(topic []byte, offset uint64) error {
@@ -61,37 +192,79 @@ func (s *store) Ack(topic []byte, offset uint64) error {
 	defer s.Unlock()
 	encodedKey := encodeKeyWithOffset(ackPrefix, topic, offset)
 
-	return s.db.Delete(encodedKey, nil)
+	return s.withTx(func(tx leveldbCommon) error {
+		valBytes, err := tx.Get(encodedKey, nil)
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return ErrKeyDoesntExist
+		}
+		if err != nil {
+			return fmt.Errorf("checking existance failed: %v", err)
+		}
+
+		if err := tx.Delete(encodedKey, nil); err != nil {
+			return fmt.Errorf("error deleting ack-key: %v", err)
+		}
+
+		if err := tx.Delete(encodeKeyWithOffset(leasePrefix, topic, offset), nil); err != nil {
+			return fmt.Errorf("error deleting lease: %v", err)
+		}
+
+		return settleGroup(tx, topic, Decode(valBytes), offset, true)
+	})
 }
 
-func (s *store) Nack(topic []byte, offset uint64) error {
+// Nack returns a leased message to the head of its priority band and increments its dacks counter. If the
+// message has failed the topic's max deliveries, it's moved to the dead-letter topic along with
+// the reason.
+func (s *store) Nack(topic []byte, offset uint64, reason string) error {
 	s.Lock()
 	defer s.Unlock()
 
-	tx, err := s.db.OpenTransaction()
-	if err != nil {
-		return err
-	}
+	return s.withTx(func(tx leveldbCommon) error {
+		return nackTx(tx, topic, offset, reason)
+	})
+}
+
+// nackTx moves a leased message back to the head of its topic, or to the dead-letter topic if it
+// has been delivered too many times, and removes its lease.
+func nackTx(tx leveldbCommon, topic []byte, offset uint64, reason string) error {
 	encodedKey := encodeKeyWithOffset(ackPrefix, topic, offset)
 
 	valBytes, err := tx.Get(encodedKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return ErrKeyDoesntExist
+	}
 	if err != nil {
 		return err
 	}
 	decoded := Decode(valBytes)
+	decoded.Dacks++
+
+	base := baseTopic(topic)
+	cfg, err := getTopicConfig(tx, base)
+	if err != nil {
+		return err
+	}
 
-	if _, err := prependTx(tx, topic, decoded); err != nil {
-		tx.Discard()
+	deadLettered := cfg.MaxDeliveries > 0 && decoded.Dacks >= cfg.MaxDeliveries
+	if deadLettered {
+		if err := deadLetter(tx, topic, cfg, decoded, decoded.Dacks, reason); err != nil {
+			return err
+		}
+	} else if _, err := prependTx(tx, priorityQueue(topic, decoded.Priority), decoded); err != nil {
 		return fmt.Errorf("prepending value to topic [%s]: %v", string(topic), err)
 	}
 
+	if err := settleGroup(tx, topic, decoded, offset, deadLettered); err != nil {
+		return err
+	}
+
 	if err := tx.Delete(encodedKey, nil); err != nil {
 		return fmt.Errorf("error deleting ack-key: %v", err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		tx.Discard()
-		return fmt.Errorf("commiting nack transaction: %v", err)
+	if err := tx.Delete(encodeKeyWithOffset(leasePrefix, topic, offset), nil); err != nil {
+		return fmt.Errorf("error deleting lease: %v", err)
 	}
 
 	return nil
@@ -115,6 +288,10 @@ func prependTx(db leveldbCommon, topic []byte, val *Value) (uint64, error) {
 		return 0, err
 	}
 
+	if err := addUsage(db, topic, len(bytes)); err != nil {
+		return 0, err
+	}
+
 	_, newPos, err := addPos(db, topic, -1)
 	if err != nil {
 		return 0, fmt.Errorf("decrementing head by 1: %v", err)
@@ -123,79 +300,595 @@ func prependTx(db leveldbCommon, topic []byte, val *Value) (uint64, error) {
 	return newPos, nil
 }
 
+// Close stops the janitor and closes the database.
 func (s *store) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+
 	return s.db.Close()
 }
 
+// GetNext leases the message at the head of the topic's highest non-empty priority band and returns
+// it with its ack offset. The message is moved from the band to the ack prefix in a single batch, so
+// it's never lost or delivered twice. Expired messages on the way are skipped. It returns ErrEmpty
+// if the topic has no ready messages or doesn't exist and ErrStream for stream topics, which are
+// read with Read instead.
 func (s *store) GetNext(topic []byte) (*Value, uint64, error) {
+	msgs, err := s.GetNextN(topic, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return msgs[0].Value, msgs[0].Offset, nil
+}
+
+// GetNextN leases up to n messages from the topic in a single batch, in the order GetNext would
+// lease them. A message which can't be decrypted, e.g. because its key was removed from the
+// keyring, is moved to the dead-letter topic with the error as the reason instead of blocking the
+// topic. It returns ErrEmpty if the topic has no ready messages and ErrNoKeys if the store has no
+// key provider to decrypt its messages with.
+func (s *store) GetNextN(topic []byte, n int) ([]*Message, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	headOffset, err := getPos(s.db, topic)
+	var msgs []*Message
+	err := s.withTx(func(tx leveldbCommon) error {
+		for len(msgs) < n {
+			msg, err := leaseNext(tx, topic)
+			// expired messages skipped before running out are still removed.
+			if errors.Is(err, ErrEmpty) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			// without any keys every encrypted message would fail, so the lease is aborted instead.
+			err = decryptValue(s.keys, msg.Value)
+			if errors.Is(err, ErrNoKeys) {
+				return err
+			}
+			if err != nil {
+				if err := deadLetterLeased(tx, topic, msg.Offset, err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+
+		return nil
+	})
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, ErrEmpty
 	}
 
-	val, err := getValue(s.db, topic, headOffset)
+	return msgs, nil
+}
+
+// leaseNext moves the next ready message of the topic to the ack prefix and leases it. Expired
+// messages at the head of the topic are removed and handled according to the topic's expiry, and
+// messages whose group has an outstanding message are held.
+func leaseNext(tx leveldbCommon, topic []byte) (*Message, error) {
+	cfg, err := getTopicConfig(tx, baseTopic(topic))
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	if cfg.Mode == ModeStream {
+		return nil, ErrStream
+	}
+
+	now := time.Now()
+	for {
+		band, headOffset, err := nextBand(tx, topic)
+		if err != nil {
+			return nil, err
+		}
+
+		key := encodeKeyWithOffset(primaryPrefix, band, headOffset)
+		raw, err := tx.Get(key, nil)
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, ErrEmpty
+		}
+		if err != nil {
+			return nil, err
+		}
+		val := Decode(raw)
+
+		if err := tx.Delete(key, nil); err != nil {
+			return nil, fmt.Errorf("deleting leased value: %v", err)
+		}
+
+		if err := addUsage(tx, band, -len(raw)); err != nil {
+			return nil, err
+		}
+
+		if _, _, err := addPos(tx, band, 1); err != nil {
+			return nil, err
+		}
+
+		if !val.expired(now) {
+			msg, err := leaseGrouped(tx, topic, cfg, val)
+			if msg != nil || err != nil {
+				return msg, err
+			}
+			continue
+		}
+
+		if err := expire(tx, topic, band, cfg, val); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// leaseValue moves a value removed from a band of the topic to the ack prefix and leases it.
+func leaseValue(tx leveldbCommon, topic []byte, cfg *TopicConfig, val *Value) (*Message, error) {
+	if val.FirstDeliveredAt.IsZero() {
+		val.FirstDeliveredAt = time.Now().UTC()
 	}
 
-	inserted, err := appendValue(s.db, ackPrefix, topic, val)
+	inserted, err := appendValue(tx, ackPrefix, topic, val)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	if _, _, err := addPos(s.db, topic, 1); err != nil {
-		return nil, 0, err
+	if cfg.VisibilityTimeout > 0 {
+		if err := putLease(tx, topic, inserted, time.Now().Add(cfg.VisibilityTimeout.Duration())); err != nil {
+			return nil, err
+		}
 	}
 
-	return val, inserted, nil
+	return &Message{Offset: inserted, Value: val}, nil
 }
 
+// Insert appends a value to the topic, or to every subscription of a fan-out topic, in a single
+// batch.
 func (s *store) Insert(topic []byte, val *Value) error {
+	return s.InsertBatch(topic, []*Value{val})
+}
+
+// InsertBatch appends all of the values to the topic in a single batch, so either all or none of
+// them are inserted. It returns a RetentionError if the values don't fit into the topic and the
+// topic rejects publishes when full.
+func (s *store) InsertBatch(topic []byte, vals []*Value) error {
+	if !validTopic(topic) {
+		return ErrInvalidTopic
+	}
+
 	s.Lock()
 	defer s.Unlock()
 
+	return s.withTx(func(tx leveldbCommon) error {
+		cfg, err := getTopicConfig(tx, topic)
+		if err != nil {
+			return err
+		}
+
+		for _, val := range vals {
+			// values are compressed and encrypted before they are admitted, so that their stored
+			// size counts.
+			if err := s.prepareValue(cfg, val); err != nil {
+				return err
+			}
+			if err := admit(tx, topic, cfg, val); err != nil {
+				return err
+			}
+
+			if _, err := insertTopic(tx, topic, val); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// insertTopic inserts a value into a topic according to the topic's mode and returns the offset it
+// was appended at. The offset is zero for fan-out topics, since every subscription has offsets of
+// its own.
+func insertTopic(db leveldbCommon, topic []byte, val *Value) (uint64, error) {
+	cfg, err := getTopicConfig(db, topic)
+	if err != nil {
+		return 0, err
+	}
+	applyCompression(cfg, val)
+
+	switch cfg.Mode {
+	case ModeFanout:
+		return 0, fanoutValue(db, topic, val)
+	case ModeStream:
+		return appendStream(db, topic, val)
+	}
+
+	return insertValue(db, topic, val)
+}
+
+// withTx runs fn against a batch, which is written to the database atomically if fn succeeds. A
+// failing operation leaves the database untouched. See batchTx for the limitations of the batch.
+func (s *store) withTx(fn func(tx leveldbCommon) error) error {
+	tx := newBatchTx(s.db)
+
+	var db leveldbCommon = tx
+	if s.wrapTx != nil {
+		db = s.wrapTx(tx)
+	}
+
+	if err := fn(db); err != nil {
+		return err
+	}
+
+	if err := tx.commit(); err != nil {
+		return fmt.Errorf("commiting transaction: %v", err)
+	}
+
+	return nil
+}
+
+// insertValue appends a value to the priority band of a queue, creating the queue and the band if
+// they don't exist yet, and trims the queue to its retention limits. Values without an expiry time
+// get one from the topic's default TTL. It returns the offset of the value in its band.
+func insertValue(db leveldbCommon, topic []byte, val *Value) (uint64, error) {
+	if err := validPriority(val); err != nil {
+		return 0, err
+	}
+
+	if err := validGroupKey(val); err != nil {
+		return 0, err
+	}
+
+	if err := initTopic(db, topic); err != nil {
+		return 0, err
+	}
+
+	cfg, err := getTopicConfig(db, baseTopic(topic))
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	applyTTL(cfg, val, now)
+
+	band := priorityQueue(topic, val.Priority)
+	if err := initTopic(db, band); err != nil {
+		return 0, err
+	}
+
+	offset, err := appendValue(db, primaryPrefix, band, val)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := trim(db, topic, cfg, now); err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+// initTopic creates the position indicators of a topic if they don't exist yet.
+func initTopic(db leveldbCommon, topic []byte) error {
 	tailKey := encodeKeyWithOffset(primaryPrefix, topic, tailIndicator)
-	exists, err := s.db.Has(tailKey, nil)
+	exists, err := db.Has(tailKey, nil)
 	if err != nil {
 		return fmt.Errorf("checking existance failed: %v", err)
 	}
 
 	if exists {
-		if _, err := appendValue(s.db, primaryPrefix, topic, val); err != nil {
+		return nil
+	}
+
+	emptyU64 := make([]byte, 8)
+	for _, key := range [][]byte{
+		encodeKeyWithOffset(primaryPrefix, topic, headIndicator),
+		encodeKeyWithOffset(ackPrefix, topic, tailIndicator),
+		tailKey,
+	} {
+		if err := db.Put(key, emptyU64, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Topics returns the names of all topics in the store in key order. The queues of fan-out
+// subscriptions are not included.
+func (s *store) Topics() ([][]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var topics [][]byte
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{primaryPrefix}), nil)
+	defer iter.Release()
+
+	// every topic has a head indicator, so after finding a topic we can skip all of its keys.
+	for ok := iter.First(); ok; {
+		_, topic, _, valid := decodeKey(iter.Key())
+		if !valid {
+			return nil, fmt.Errorf("invalid key in primary prefix: %x", iter.Key())
+		}
+		if !isSubscriptionTopic(topic) {
+			topics = append(topics, append([]byte(nil), topic...))
+		}
+		ok = iter.Seek(util.BytesPrefix(topicKeyPrefix(primaryPrefix, topic)).Limit)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating topics: %v", err)
+	}
+
+	return topics, nil
+}
+
+func (s *store) Stats(topic []byte) (*TopicStats, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := topicExists(s.db, topic); err != nil {
+		return nil, err
+	}
+
+	cfg, err := getTopicConfig(s.db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := queueStats(s.db, topic)
+	if err != nil {
+		return nil, err
+	}
+	stats.Mode = cfg.Mode
+
+	if stats.Scheduled, err = countScheduled(s.db, topic); err != nil {
+		return nil, err
+	}
+
+	if stats.Offsets, err = committedOffsets(s.db, topic); err != nil {
+		return nil, err
+	}
+
+	subs, err := getSubscriptions(s.db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subs {
+		subStats, err := queueStats(s.db, SubscriptionTopic(topic, sub))
+		if err != nil {
+			return nil, fmt.Errorf("getting stats of subscription [%s]: %v", string(sub), err)
+		}
+		subStats.Topic = string(sub)
+		stats.Subscriptions = append(stats.Subscriptions, subStats)
+	}
+
+	return stats, nil
+}
+
+func queueStats(db leveldbCommon, topic []byte) (*TopicStats, error) {
+	head, err := getPos(db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	tail, err := getTail(db, primaryPrefix, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	priorities, err := priorityStats(db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	_, u, err := queueUsage(db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	ready := tail - head
+	if priorities != nil {
+		ready = 0
+		for _, depth := range priorities {
+			ready += depth
+		}
+	}
+
+	held, err := countHeld(db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var unacked uint64
+	iter := db.NewIterator(messageRange(ackPrefix, topic), nil)
+	for iter.Next() {
+		unacked++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("counting unacked messages: %v", err)
+	}
+
+	return &TopicStats{
+		Topic:      string(topic),
+		Head:       head,
+		Tail:       tail,
+		Ready:      ready,
+		Unacked:    unacked,
+		Bytes:      u.bytes,
+		Dropped:    u.dropped,
+		Expired:    u.expired,
+		Held:       held,
+		Priorities: priorities,
+	}, nil
+}
+
+// Purge deletes all ready and held messages of a topic and its subscriptions and returns the
+// amount of deleted messages. Leased messages are not affected and can still be acknowledged.
+func (s *store) Purge(topic []byte) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var purged uint64
+	err := s.withTx(func(tx leveldbCommon) error {
+		if err := topicExists(tx, topic); err != nil {
+			return err
+		}
+
+		subs, err := getSubscriptions(tx, topic)
+		if err != nil {
 			return err
 		}
 
+		queues := [][]byte{topic}
+		for _, sub := range subs {
+			queues = append(queues, SubscriptionTopic(topic, sub))
+		}
+
+		for _, queue := range queues {
+			priorities, err := queuePriorities(tx, queue)
+			if err != nil {
+				return err
+			}
+
+			for _, priority := range priorities {
+				n, err := purgeQueue(tx, priorityQueue(queue, priority))
+				if err != nil {
+					return err
+				}
+				purged += n
+			}
+
+			n, err := purgeHeld(tx, queue)
+			if err != nil {
+				return err
+			}
+			purged += n
+		}
+
 		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	headKey := encodeKeyWithOffset(primaryPrefix, topic, headIndicator)
-	emptyU64 := make([]byte, 8)
-	if err := s.db.Put(headKey, emptyU64, nil); err != nil {
-		return err
+	return purged, nil
+}
+
+// purgeQueue deletes all ready messages of a queue and moves the head to the tail.
+func purgeQueue(db leveldbCommon, topic []byte) (uint64, error) {
+	head, err := getPos(db, topic)
+	if err != nil {
+		return 0, err
 	}
 
-	ackTailKey := encodeKeyWithOffset(ackPrefix, topic, tailIndicator)
-	if err := s.db.Put(ackTailKey, emptyU64, nil); err != nil {
-		return err
+	tail, err := getTail(db, primaryPrefix, topic)
+	if err != nil {
+		return 0, err
 	}
 
-	emptyU64[0] = 1
-	if err := s.db.Put(tailKey, emptyU64, nil); err != nil {
-		return err
+	var purged uint64
+	iter := db.NewIterator(&util.Range{
+		Start: encodeKeyWithOffset(primaryPrefix, topic, head),
+		Limit: encodeKeyWithOffset(primaryPrefix, topic, tail),
+	}, nil)
+	for iter.Next() {
+		if err := db.Delete(iter.Key(), nil); err != nil {
+			iter.Release()
+			return 0, err
+		}
+		purged++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("iterating messages: %v", err)
 	}
-	newKey := encodeKeyWithOffset(primaryPrefix, topic, 0)
-	b := val.Encode()
 
-	if err := s.db.Put(newKey, b, nil); err != nil {
-		return err
+	newHead := make([]byte, 8)
+	binary.LittleEndian.PutUint64(newHead, tail)
+	if err := db.Put(encodeKeyWithOffset(primaryPrefix, topic, headIndicator), newHead, nil); err != nil {
+		return 0, err
+	}
+
+	u, err := getUsage(db, topic)
+	if err != nil {
+		return 0, err
+	}
+	u.bytes = 0
+	if err := db.Put(topicKeyPrefix(usagePrefix, topic), u.encode(), nil); err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// DeleteTopic removes a topic including its position indicators, leased and scheduled messages,
+// config, subscriptions, committed offsets and idempotency keys.
+func (s *store) DeleteTopic(topic []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.withTx(func(tx leveldbCommon) error {
+		if err := topicExists(tx, topic); err != nil {
+			return err
+		}
+
+		subs, err := getSubscriptions(tx, topic)
+		if err != nil {
+			return err
+		}
+
+		if err := deleteTopicKeys(tx, topic); err != nil {
+			return err
+		}
+
+		if err := deleteScheduledKeys(tx, topic); err != nil {
+			return err
+		}
+
+		if err := deleteCommittedKeys(tx, topic); err != nil {
+			return err
+		}
+
+		if err := deleteDedupKeys(tx, topic); err != nil {
+			return err
+		}
+
+		for _, sub := range subs {
+			if err := deleteSubscription(tx, topic, sub); err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(topicKeyPrefix(configPrefix, topic), nil)
+	})
+}
+
+func topicExists(db leveldbCommon, topic []byte) error {
+	exists, err := db.Has(encodeKeyWithOffset(primaryPrefix, topic, headIndicator), nil)
+	if err != nil {
+		return fmt.Errorf("checking existance failed: %v", err)
+	}
+	if !exists {
+		return ErrTopicNotFound
 	}
 
 	return nil
 }
 
+func getTail(db leveldbCommon, topicPrefix int, topic []byte) (uint64, error) {
+	tail, err := db.Get(encodeKeyWithOffset(topicPrefix, topic, tailIndicator), nil)
+	if err != nil {
+		return 0, fmt.Errorf("error getting tail value: %v", err)
+	}
+
+	return binary.LittleEndian.Uint64(tail), nil
+}
+
 func getValue(db leveldbCommon, topic []byte, offset uint64) (*Value, error) {
 	key := encodeKeyWithOffset(primaryPrefix, topic, offset)
 	valBytes, err := db.Get(key, nil)
@@ -210,7 +903,7 @@ func getPos(db leveldbCommon, topic []byte) (uint64, error) {
 	encodedKey := encodeKeyWithOffset(primaryPrefix, topic, headIndicator)
 	pos, err := db.Get(encodedKey, nil)
 	if err != nil {
-		return 0, fmt.Errorf("error getting offset position: %v", err)
+		return 0, fmt.Errorf("error getting offset position: %w", err)
 	}
 
 	return binary.LittleEndian.Uint64(pos), nil
@@ -238,7 +931,7 @@ func addPos(db leveldbCommon, topic []byte, sum int) (uint64, uint64, error) {
 	return oldPos, uint64(newPos), nil
 }
 
-func appendValue(db leveldbCommon, topicPrefix int,  topic []byte, val *Value) (uint64, error) {
+func appendValue(db leveldbCommon, topicPrefix int, topic []byte, val *Value) (uint64, error) {
 	tailPosKey := encodeKeyWithOffset(topicPrefix, topic, tailIndicator)
 
 	tailPosVal, err := db.Get(tailPosKey, nil)
@@ -254,6 +947,12 @@ func appendValue(db leveldbCommon, topicPrefix int,  topic []byte, val *Value) (
 		return 0, fmt.Errorf("error putting value: %v", err)
 	}
 
+	if topicPrefix == primaryPrefix {
+		if err := addUsage(db, topic, len(b)); err != nil {
+			return 0, err
+		}
+	}
+
 	tail := make([]byte, 8)
 	binary.LittleEndian.PutUint64(tail, origOffset+1)
 	if err := db.Put(tailPosKey, tail, nil); err != nil {
@@ -263,13 +962,102 @@ func appendValue(db leveldbCommon, topicPrefix int,  topic []byte, val *Value) (
 	return origOffset, nil
 }
 
+// encodeKeyWithOffset builds the key of a message or position indicator. The layout is the prefix
+// byte, the big-endian length of the topic, the topic and the big-endian offset, so that keys sort
+// by prefix, then topic and then offset.
 func encodeKeyWithOffset(prefix int, topic []byte, offset uint64) []byte {
-	bufferSize := 1 + 8 + len(topic)
-	buffer := make([]byte, bufferSize)
+	buffer := make([]byte, 1+2+len(topic)+8)
 
 	buffer[0] = byte(prefix)
-	binary.LittleEndian.PutUint64(buffer[1:9], uint64(offset))
-	copy(buffer[9:], topic)
+	binary.BigEndian.PutUint16(buffer[1:3], uint16(len(topic)))
+	copy(buffer[3:], topic)
+	binary.BigEndian.PutUint64(buffer[3+len(topic):], offset)
 
 	return buffer
 }
+
+// decodeKey is the inverse of encodeKeyWithOffset.
+func decodeKey(key []byte) (int, []byte, uint64, bool) {
+	topic, rest, ok := splitTopicKey(key)
+	if !ok || len(rest) != 8 {
+		return 0, nil, 0, false
+	}
+
+	return int(key[0]), topic, binary.BigEndian.Uint64(rest), true
+}
+
+// splitTopicKey returns the length-prefixed topic of a key and the bytes following it.
+func splitTopicKey(key []byte) ([]byte, []byte, bool) {
+	if len(key) < 1+2 {
+		return nil, nil, false
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(key[1:3]))
+	if len(key) < 1+2+topicLen {
+		return nil, nil, false
+	}
+
+	return key[3 : 3+topicLen], key[3+topicLen:], true
+}
+
+// topicKeyPrefix returns the common prefix of all keys of a topic under the given prefix.
+func topicKeyPrefix(prefix int, topic []byte) []byte {
+	key := encodeKeyWithOffset(prefix, topic, 0)
+	return key[:len(key)-8]
+}
+
+// messageRange returns the range of message keys of a topic, which excludes the position
+// indicators stored at the end of the topic's key space.
+func messageRange(prefix int, topic []byte) *util.Range {
+	return &util.Range{
+		Start: encodeKeyWithOffset(prefix, topic, 0),
+		Limit: encodeKeyWithOffset(prefix, topic, headIndicator),
+	}
+}
+
+// decodeLegacyKey decodes a key in the original layout: the prefix byte, the little-endian offset
+// and the topic.
+func decodeLegacyKey(key []byte) (int, []byte, uint64, bool) {
+	if len(key) < 9 {
+		return 0, nil, 0, false
+	}
+
+	return int(key[0]), key[9:], binary.LittleEndian.Uint64(key[1:9]), true
+}
+
+// migrate brings the database to the current format version. Legacy databases are rewritten in a
+// single batch so that a crash during the migration leaves the database untouched.
+func migrate(db *leveldb.DB) error {
+	version, err := db.Get(versionKey, nil)
+	if err == nil {
+		if v := binary.BigEndian.Uint64(version); v != formatVersion {
+			return fmt.Errorf("unsupported format version %d", v)
+		}
+		return nil
+	}
+	if !errors.Is(err, leveldb.ErrNotFound) {
+		return fmt.Errorf("reading format version: %v", err)
+	}
+
+	batch := new(leveldb.Batch)
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		prefix, topic, offset, ok := decodeLegacyKey(iter.Key())
+		if !ok || (prefix != primaryPrefix && prefix != ackPrefix) {
+			continue
+		}
+
+		batch.Delete(iter.Key())
+		batch.Put(encodeKeyWithOffset(prefix, topic, offset), iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating legacy keys: %v", err)
+	}
+
+	version = make([]byte, 8)
+	binary.BigEndian.PutUint64(version, formatVersion)
+	batch.Put(versionKey, version)
+
+	return db.Write(batch, nil)
+}
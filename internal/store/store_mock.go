@@ -6,9 +6,12 @@ package store
 
 import (
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
+	iterator "github.com/syndtr/goleveldb/leveldb/iterator"
 	opt "github.com/syndtr/goleveldb/leveldb/opt"
+	util "github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // MockStore is a mock of Store interface.
@@ -48,6 +51,34 @@ func (mr *MockStoreMockRecorder) Ack(topic, offset interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockStore)(nil).Ack), topic, offset)
 }
 
+// AddMember mocks base method.
+func (m *MockStore) AddMember(topic, group, member []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddMember", topic, group, member)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddMember indicates an expected call of AddMember.
+func (mr *MockStoreMockRecorder) AddMember(topic, group, member interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMember", reflect.TypeOf((*MockStore)(nil).AddMember), topic, group, member)
+}
+
+// AddSubscription mocks base method.
+func (m *MockStore) AddSubscription(topic, name []byte, durable bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddSubscription", topic, name, durable)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddSubscription indicates an expected call of AddSubscription.
+func (mr *MockStoreMockRecorder) AddSubscription(topic, name, durable interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddSubscription", reflect.TypeOf((*MockStore)(nil).AddSubscription), topic, name, durable)
+}
+
 // Close mocks base method.
 func (m *MockStore) Close() error {
 	m.ctrl.T.Helper()
@@ -62,6 +93,49 @@ func (mr *MockStoreMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockStore)(nil).Close))
 }
 
+// CommitOffset mocks base method.
+func (m *MockStore) CommitOffset(topic, consumer []byte, offset uint64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CommitOffset", topic, consumer, offset)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CommitOffset indicates an expected call of CommitOffset.
+func (mr *MockStoreMockRecorder) CommitOffset(topic, consumer, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CommitOffset", reflect.TypeOf((*MockStore)(nil).CommitOffset), topic, consumer, offset)
+}
+
+// CommittedOffset mocks base method.
+func (m *MockStore) CommittedOffset(topic, consumer []byte) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CommittedOffset", topic, consumer)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CommittedOffset indicates an expected call of CommittedOffset.
+func (mr *MockStoreMockRecorder) CommittedOffset(topic, consumer interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CommittedOffset", reflect.TypeOf((*MockStore)(nil).CommittedOffset), topic, consumer)
+}
+
+// DeleteTopic mocks base method.
+func (m *MockStore) DeleteTopic(topic []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteTopic", topic)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteTopic indicates an expected call of DeleteTopic.
+func (mr *MockStoreMockRecorder) DeleteTopic(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteTopic", reflect.TypeOf((*MockStore)(nil).DeleteTopic), topic)
+}
+
 // GetNext mocks base method.
 func (m *MockStore) GetNext(topic []byte) (*Value, uint64, error) {
 	m.ctrl.T.Helper()
@@ -78,6 +152,36 @@ func (mr *MockStoreMockRecorder) GetNext(topic interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNext", reflect.TypeOf((*MockStore)(nil).GetNext), topic)
 }
 
+// GetNextN mocks base method.
+func (m *MockStore) GetNextN(topic []byte, n int) ([]*Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetNextN", topic, n)
+	ret0, _ := ret[0].([]*Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetNextN indicates an expected call of GetNextN.
+func (mr *MockStoreMockRecorder) GetNextN(topic, n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNextN", reflect.TypeOf((*MockStore)(nil).GetNextN), topic, n)
+}
+
+// Groups mocks base method.
+func (m *MockStore) Groups(topic []byte) ([]*Group, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Groups", topic)
+	ret0, _ := ret[0].([]*Group)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Groups indicates an expected call of Groups.
+func (mr *MockStoreMockRecorder) Groups(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Groups", reflect.TypeOf((*MockStore)(nil).Groups), topic)
+}
+
 // Insert mocks base method.
 func (m *MockStore) Insert(topic []byte, val *Value) error {
 	m.ctrl.T.Helper()
@@ -92,18 +196,281 @@ func (mr *MockStoreMockRecorder) Insert(topic, val interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*MockStore)(nil).Insert), topic, val)
 }
 
+// InsertBatch mocks base method.
+func (m *MockStore) InsertBatch(topic []byte, vals []*Value) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertBatch", topic, vals)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InsertBatch indicates an expected call of InsertBatch.
+func (mr *MockStoreMockRecorder) InsertBatch(topic, vals interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertBatch", reflect.TypeOf((*MockStore)(nil).InsertBatch), topic, vals)
+}
+
+// InsertIdempotent mocks base method.
+func (m *MockStore) InsertIdempotent(topic, key []byte, val *Value, at time.Time) (*Receipt, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertIdempotent", topic, key, val, at)
+	ret0, _ := ret[0].(*Receipt)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// InsertIdempotent indicates an expected call of InsertIdempotent.
+func (mr *MockStoreMockRecorder) InsertIdempotent(topic, key, val, at interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertIdempotent", reflect.TypeOf((*MockStore)(nil).InsertIdempotent), topic, key, val, at)
+}
+
 // Nack mocks base method.
-func (m *MockStore) Nack(topic []byte, offset uint64) error {
+func (m *MockStore) Nack(topic []byte, offset uint64, reason string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Nack", topic, offset)
+	ret := m.ctrl.Call(m, "Nack", topic, offset, reason)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Nack indicates an expected call of Nack.
-func (mr *MockStoreMockRecorder) Nack(topic, offset interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) Nack(topic, offset, reason interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockStore)(nil).Nack), topic, offset, reason)
+}
+
+// PromoteDue mocks base method.
+func (m *MockStore) PromoteDue(now time.Time) ([][]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PromoteDue", now)
+	ret0, _ := ret[0].([][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PromoteDue indicates an expected call of PromoteDue.
+func (mr *MockStoreMockRecorder) PromoteDue(now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PromoteDue", reflect.TypeOf((*MockStore)(nil).PromoteDue), now)
+}
+
+// Purge mocks base method.
+func (m *MockStore) Purge(topic []byte) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Purge", topic)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Purge indicates an expected call of Purge.
+func (mr *MockStoreMockRecorder) Purge(topic interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockStore)(nil).Nack), topic, offset)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Purge", reflect.TypeOf((*MockStore)(nil).Purge), topic)
+}
+
+// Read mocks base method.
+func (m *MockStore) Read(topic []byte, offset uint64, n int) ([]*Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Read", topic, offset, n)
+	ret0, _ := ret[0].([]*Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Read indicates an expected call of Read.
+func (mr *MockStoreMockRecorder) Read(topic, offset, n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Read", reflect.TypeOf((*MockStore)(nil).Read), topic, offset, n)
+}
+
+// Redrive mocks base method.
+func (m *MockStore) Redrive(dlq []byte, max uint64) (map[string]uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Redrive", dlq, max)
+	ret0, _ := ret[0].(map[string]uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Redrive indicates an expected call of Redrive.
+func (mr *MockStoreMockRecorder) Redrive(dlq, max interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Redrive", reflect.TypeOf((*MockStore)(nil).Redrive), dlq, max)
+}
+
+// RemoveMember mocks base method.
+func (m *MockStore) RemoveMember(topic, group, member []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveMember", topic, group, member)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveMember indicates an expected call of RemoveMember.
+func (mr *MockStoreMockRecorder) RemoveMember(topic, group, member interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveMember", reflect.TypeOf((*MockStore)(nil).RemoveMember), topic, group, member)
+}
+
+// RemoveSubscription mocks base method.
+func (m *MockStore) RemoveSubscription(topic, name []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveSubscription", topic, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveSubscription indicates an expected call of RemoveSubscription.
+func (mr *MockStoreMockRecorder) RemoveSubscription(topic, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveSubscription", reflect.TypeOf((*MockStore)(nil).RemoveSubscription), topic, name)
+}
+
+// RequeueExpired mocks base method.
+func (m *MockStore) RequeueExpired(now time.Time) ([][]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueExpired", now)
+	ret0, _ := ret[0].([][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RequeueExpired indicates an expected call of RequeueExpired.
+func (mr *MockStoreMockRecorder) RequeueExpired(now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueExpired", reflect.TypeOf((*MockStore)(nil).RequeueExpired), now)
+}
+
+// Schedule mocks base method.
+func (m *MockStore) Schedule(topic []byte, val *Value, at time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Schedule", topic, val, at)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Schedule indicates an expected call of Schedule.
+func (mr *MockStoreMockRecorder) Schedule(topic, val, at interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Schedule", reflect.TypeOf((*MockStore)(nil).Schedule), topic, val, at)
+}
+
+// ScheduleBatch mocks base method.
+func (m *MockStore) ScheduleBatch(topic []byte, vals []*Value, at time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ScheduleBatch", topic, vals, at)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ScheduleBatch indicates an expected call of ScheduleBatch.
+func (mr *MockStoreMockRecorder) ScheduleBatch(topic, vals, at interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ScheduleBatch", reflect.TypeOf((*MockStore)(nil).ScheduleBatch), topic, vals, at)
+}
+
+// Seek mocks base method.
+func (m *MockStore) Seek(topic []byte, pos Position) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Seek", topic, pos)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Seek indicates an expected call of Seek.
+func (mr *MockStoreMockRecorder) Seek(topic, pos interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Seek", reflect.TypeOf((*MockStore)(nil).Seek), topic, pos)
+}
+
+// SetTopicConfig mocks base method.
+func (m *MockStore) SetTopicConfig(topic []byte, cfg *TopicConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTopicConfig", topic, cfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTopicConfig indicates an expected call of SetTopicConfig.
+func (mr *MockStoreMockRecorder) SetTopicConfig(topic, cfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTopicConfig", reflect.TypeOf((*MockStore)(nil).SetTopicConfig), topic, cfg)
+}
+
+// Stats mocks base method.
+func (m *MockStore) Stats(topic []byte) (*TopicStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats", topic)
+	ret0, _ := ret[0].(*TopicStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stats indicates an expected call of Stats.
+func (mr *MockStoreMockRecorder) Stats(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*MockStore)(nil).Stats), topic)
+}
+
+// Subscriptions mocks base method.
+func (m *MockStore) Subscriptions(topic []byte) ([][]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Subscriptions", topic)
+	ret0, _ := ret[0].([][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Subscriptions indicates an expected call of Subscriptions.
+func (mr *MockStoreMockRecorder) Subscriptions(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscriptions", reflect.TypeOf((*MockStore)(nil).Subscriptions), topic)
+}
+
+// TopicConfig mocks base method.
+func (m *MockStore) TopicConfig(topic []byte) (*TopicConfig, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopicConfig", topic)
+	ret0, _ := ret[0].(*TopicConfig)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TopicConfig indicates an expected call of TopicConfig.
+func (mr *MockStoreMockRecorder) TopicConfig(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopicConfig", reflect.TypeOf((*MockStore)(nil).TopicConfig), topic)
+}
+
+// Topics mocks base method.
+func (m *MockStore) Topics() ([][]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Topics")
+	ret0, _ := ret[0].([][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Topics indicates an expected call of Topics.
+func (mr *MockStoreMockRecorder) Topics() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Topics", reflect.TypeOf((*MockStore)(nil).Topics))
+}
+
+// Touch mocks base method.
+func (m *MockStore) Touch(topic []byte, offset uint64, extend time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Touch", topic, offset, extend)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Touch indicates an expected call of Touch.
+func (mr *MockStoreMockRecorder) Touch(topic, offset, extend interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Touch", reflect.TypeOf((*MockStore)(nil).Touch), topic, offset, extend)
 }
 
 // MockleveldbCommon is a mock of leveldbCommon interface.
@@ -129,6 +496,20 @@ func (m *MockleveldbCommon) EXPECT() *MockleveldbCommonMockRecorder {
 	return m.recorder
 }
 
+// Delete mocks base method.
+func (m *MockleveldbCommon) Delete(key []byte, wo *opt.WriteOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", key, wo)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockleveldbCommonMockRecorder) Delete(key, wo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockleveldbCommon)(nil).Delete), key, wo)
+}
+
 // Get mocks base method.
 func (m *MockleveldbCommon) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
 	m.ctrl.T.Helper()
@@ -159,6 +540,20 @@ func (mr *MockleveldbCommonMockRecorder) Has(key, ro interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Has", reflect.TypeOf((*MockleveldbCommon)(nil).Has), key, ro)
 }
 
+// NewIterator mocks base method.
+func (m *MockleveldbCommon) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewIterator", slice, ro)
+	ret0, _ := ret[0].(iterator.Iterator)
+	return ret0
+}
+
+// NewIterator indicates an expected call of NewIterator.
+func (mr *MockleveldbCommonMockRecorder) NewIterator(slice, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewIterator", reflect.TypeOf((*MockleveldbCommon)(nil).NewIterator), slice, ro)
+}
+
 // Put mocks base method.
 func (m *MockleveldbCommon) Put(key, value []byte, ro *opt.WriteOptions) error {
 	m.ctrl.T.Helper()
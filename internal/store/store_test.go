@@ -1,10 +1,20 @@
 package store
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var (
@@ -36,22 +46,42 @@ func TestGetNext(t *testing.T) {
 	assert.NoError(t, store.Insert(testTopic, msg2))
 	assert.NoError(t, store.Insert(testTopic, msg3))
 
-	val, offset, err := store.GetNext([]byte("topic"))
+	val, offset, err := store.GetNext(testTopic)
 	assert.NoError(t, err)
+	assert.False(t, val.FirstDeliveredAt.IsZero())
+	msg1.FirstDeliveredAt = val.FirstDeliveredAt
 	assert.Equal(t, msg1, val)
 	assert.Equal(t, uint64(0), offset)
 
-	val, offset, err = store.GetNext([]byte("topic"))
+	val, offset, err = store.GetNext(testTopic)
 	assert.NoError(t, err)
+	assert.False(t, val.FirstDeliveredAt.IsZero())
+	msg2.FirstDeliveredAt = val.FirstDeliveredAt
 	assert.Equal(t, msg2, val)
 	assert.Equal(t, uint64(1), offset)
 
-	val, offset, err = store.GetNext([]byte("topic"))
+	val, offset, err = store.GetNext(testTopic)
 	assert.NoError(t, err)
+	assert.False(t, val.FirstDeliveredAt.IsZero())
+	msg3.FirstDeliveredAt = val.FirstDeliveredAt
 	assert.Equal(t, msg3, val)
 	assert.Equal(t, uint64(2), offset)
 }
 
+func TestGetNext_Empty(t *testing.T) {
+	s := newTestStore(t)
+
+	_, _, err := s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("test_value_1"))))
+	_, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+
+	_, _, err = s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+}
+
 func TestAck(t *testing.T) {
   store := newTestStore(t).(*store)
 
@@ -73,7 +103,1086 @@ func TestNack(t *testing.T) {
   _, offset, err := s.GetNext(testTopic)
   assert.NoError(t, err)
 
-  assert.NoError(t, s.Nack(testTopic, offset))
+  assert.NoError(t, s.Nack(testTopic, offset, ""))
+}
+
+func TestFanout(t *testing.T) {
+	s := newTestStore(t)
+
+	require.ErrorIs(t, s.AddSubscription(testTopic, []byte("sub"), true), ErrNotFanout)
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeFanout}))
+
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("before_subs"))))
+	require.NoError(t, s.AddSubscription(testTopic, []byte("sub_1"), true))
+	require.NoError(t, s.AddSubscription(testTopic, []byte("sub_2"), false))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value_1"))))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value_2"))))
+
+	for _, sub := range []string{"sub_1", "sub_2"} {
+		subTopic := SubscriptionTopic(testTopic, []byte(sub))
+		for _, expected := range []string{"value_1", "value_2"} {
+			val, offset, err := s.GetNext(subTopic)
+			require.NoError(t, err)
+			assert.Equal(t, expected, string(val.Raw))
+			require.NoError(t, s.Ack(subTopic, offset))
+		}
+	}
+
+	topics, err := s.Topics()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{testTopic}, topics)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, ModeFanout, stats.Mode)
+	require.Len(t, stats.Subscriptions, 2)
+	assert.Equal(t, "sub_1", stats.Subscriptions[0].Topic)
+	assert.Equal(t, uint64(2), stats.Subscriptions[0].Tail)
+
+	require.NoError(t, s.RemoveSubscription(testTopic, []byte("sub_2")))
+	require.ErrorIs(t, s.RemoveSubscription(testTopic, []byte("sub_2")), ErrSubscriptionNotFound)
+
+	subs, err := s.Subscriptions(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("sub_1")}, subs)
+}
+
+func TestNewStore_RemovesEphemeralSubscriptions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rq-test-store")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := NewStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeFanout}))
+	require.NoError(t, s.AddSubscription(testTopic, []byte("durable"), true))
+	require.NoError(t, s.AddSubscription(testTopic, []byte("ephemeral"), false))
+	require.NoError(t, s.AddMember(testTopic, []byte("ephemeral"), []byte("member")))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value"))))
+	require.NoError(t, s.Close())
+
+	s, err = NewStore(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	subs, err := s.Subscriptions(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("durable")}, subs)
+
+	val, _, err := s.GetNext(SubscriptionTopic(testTopic, []byte("durable")))
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(val.Raw))
+
+	_, err = s.Stats(SubscriptionTopic(testTopic, []byte("ephemeral")))
+	require.ErrorIs(t, err, ErrTopicNotFound)
+
+	exists, err := s.(*store).db.Has(memberKey(testTopic, []byte("ephemeral"), []byte("member")), nil)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestGroups(t *testing.T) {
+	s := newTestStore(t)
+
+	require.ErrorIs(t, s.AddMember(testTopic, []byte("group"), []byte("member")), ErrNotFanout)
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeFanout}))
+	require.ErrorIs(t, s.AddMember(testTopic, []byte("group"), nil), ErrInvalidMember)
+
+	require.NoError(t, s.AddMember(testTopic, []byte("group_1"), []byte("member_1")))
+	require.NoError(t, s.AddMember(testTopic, []byte("group_1"), []byte("member_2")))
+	require.NoError(t, s.AddMember(testTopic, []byte("group_1"), []byte("member_2")))
+	require.NoError(t, s.AddMember(testTopic, []byte("group_2"), []byte("member_1")))
+	require.NoError(t, s.AddSubscription(testTopic, []byte("ephemeral"), false))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Insert(testTopic, NewValue([]byte("value"))))
+	}
+	_, _, err := s.GetNext(SubscriptionTopic(testTopic, []byte("group_1")))
+	require.NoError(t, err)
+
+	groups, err := s.Groups(testTopic)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+
+	assert.Equal(t, "group_1", groups[0].Name)
+	assert.Equal(t, uint64(2), groups[0].Lag)
+	assert.Equal(t, uint64(1), groups[0].Outstanding)
+	require.Len(t, groups[0].Members, 2)
+	assert.Equal(t, "member_1", groups[0].Members[0].Name)
+	assert.False(t, groups[0].Members[0].JoinedAt.IsZero())
+	assert.Equal(t, "member_2", groups[0].Members[1].Name)
+
+	assert.Equal(t, "group_2", groups[1].Name)
+	assert.Equal(t, uint64(3), groups[1].Lag)
+	require.Len(t, groups[1].Members, 1)
+
+	require.NoError(t, s.RemoveMember(testTopic, []byte("group_1"), []byte("member_1")))
+	require.ErrorIs(t, s.RemoveMember(testTopic, []byte("group_1"), []byte("member_1")), ErrMemberNotFound)
+	require.NoError(t, s.RemoveSubscription(testTopic, []byte("group_2")))
+
+	groups, err = s.Groups(testTopic)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	require.Len(t, groups[0].Members, 1)
+	assert.Equal(t, "member_2", groups[0].Members[0].Name)
+
+	// members of a removed group don't come back with the group.
+	require.NoError(t, s.AddSubscription(testTopic, []byte("group_2"), true))
+	groups, err = s.Groups(testTopic)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Empty(t, groups[1].Members)
+
+	_, err = s.Groups([]byte("missing"))
+	require.ErrorIs(t, err, ErrTopicNotFound)
+}
+
+func TestStream(t *testing.T) {
+	s := newTestStore(t)
+
+	_, err := s.Read(testTopic, 0, 1)
+	require.ErrorIs(t, err, ErrTopicNotFound)
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("queued"))))
+	_, err = s.Read(testTopic, 0, 1)
+	require.ErrorIs(t, err, ErrNotStream)
+
+	stream := []byte("stream")
+	require.NoError(t, s.SetTopicConfig(stream, &TopicConfig{Mode: ModeStream}))
+	_, err = s.Read(stream, 0, 1)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		val := NewValue([]byte(fmt.Sprintf("value_%d", i)))
+		val.PublishedAt = start.Add(time.Duration(i) * time.Second)
+		val.Priority = uint8(i % 2)
+		require.NoError(t, s.Insert(stream, val))
+	}
+
+	_, _, err = s.GetNext(stream)
+	require.ErrorIs(t, err, ErrStream)
+
+	// reading doesn't consume the messages.
+	for i := 0; i < 2; i++ {
+		msgs, err := s.Read(stream, 1, 3)
+		require.NoError(t, err)
+		require.Len(t, msgs, 3)
+		assert.Equal(t, uint64(1), msgs[0].Offset)
+		assert.Equal(t, "value_1", string(msgs[0].Value.Raw))
+		assert.Equal(t, uint64(3), msgs[2].Offset)
+	}
+
+	_, err = s.Read(stream, 5, 1)
+	require.ErrorIs(t, err, ErrEmpty)
+	_, err = s.Read(stream, 6, 1)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	for _, tc := range []struct {
+		pos      Position
+		expected uint64
+	}{
+		{pos: Earliest(), expected: 0},
+		{pos: Latest(), expected: 5},
+		{pos: AtOffset(2), expected: 2},
+		{pos: AtTime(start.Add(1500 * time.Millisecond)), expected: 2},
+		{pos: AtTime(start.Add(-time.Hour)), expected: 0},
+		{pos: AtTime(start.Add(time.Hour)), expected: 5},
+	} {
+		offset, err := s.Seek(stream, tc.pos)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, offset)
+	}
+	_, err = s.Seek(stream, AtOffset(6))
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	_, err = s.CommittedOffset(stream, []byte("consumer"))
+	require.ErrorIs(t, err, ErrNoCommittedOffset)
+	require.ErrorIs(t, s.CommitOffset(stream, []byte("consumer"), 6), ErrOffsetOutOfRange)
+	require.NoError(t, s.CommitOffset(stream, []byte("consumer"), 3))
+	offset, err := s.CommittedOffset(stream, []byte("consumer"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), offset)
+
+	stats, err := s.Stats(stream)
+	require.NoError(t, err)
+	assert.Equal(t, ModeStream, stats.Mode)
+	assert.Equal(t, uint64(5), stats.Ready)
+	assert.Equal(t, map[string]uint64{"consumer": 3}, stats.Offsets)
+
+	require.NoError(t, s.DeleteTopic(stream))
+	_, err = s.CommittedOffset(stream, []byte("consumer"))
+	require.ErrorIs(t, err, ErrNoCommittedOffset)
+}
+
+func TestRetention(t *testing.T) {
+	s := newTestStore(t).(*store)
+
+	require.ErrorIs(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, Overflow: "block"}), ErrInvalidConfig)
+
+	// the oldest messages are dropped, starting from the lowest priority.
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, MaxMessages: 2}))
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("high"), Priority: 1}))
+	for _, raw := range []string{"value_1", "value_2", "value_3"} {
+		require.NoError(t, s.Insert(testTopic, NewValue([]byte(raw))))
+	}
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Ready)
+	assert.Equal(t, uint64(2), stats.Dropped)
+	for _, expected := range []string{"high", "value_3"} {
+		val, offset, err := s.GetNext(testTopic)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(val.Raw))
+		require.NoError(t, s.Ack(testTopic, offset))
+	}
+
+	// publishes that don't fit are rejected.
+	size := uint64(len(NewValue([]byte("value")).Encode()))
+	full := []byte("full")
+	require.NoError(t, s.SetTopicConfig(full, &TopicConfig{Mode: ModeQueue, MaxBytes: 2 * size, Overflow: OverflowRejectPublish}))
+	require.NoError(t, s.Insert(full, NewValue([]byte("value"))))
+
+	var retentionErr *RetentionError
+	err = s.InsertBatch(full, []*Value{NewValue([]byte("value")), NewValue([]byte("value"))})
+	require.ErrorAs(t, err, &retentionErr)
+	assert.Equal(t, LimitMaxBytes, retentionErr.Limit)
+	require.NoError(t, s.Insert(full, NewValue([]byte("value"))))
+
+	stats, err = s.Stats(full)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Ready)
+	assert.Equal(t, 2*size, stats.Bytes)
+
+	// lowering the limits is applied by the janitor, which also drops messages by age.
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, MaxAge: Duration(time.Minute)}))
+	old := &Value{Raw: []byte("old"), PublishedAt: time.Now().Add(-50 * time.Second)}
+	require.NoError(t, s.Insert(testTopic, old))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("unknown_age"))))
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("new"), PublishedAt: time.Now()}))
+	require.NoError(t, s.SetTopicConfig(full, &TopicConfig{Mode: ModeQueue, MaxMessages: 1}))
+
+	dropped, err := s.enforceRetention(time.Now().Add(30 * time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), dropped)
+
+	val, _, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "unknown_age", string(val.Raw))
+
+	stats, err = s.Stats(full)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Ready)
+	assert.Equal(t, size, stats.Bytes)
+}
+
+func TestExpiry(t *testing.T) {
+	s := newTestStore(t)
+
+	past := time.Now().Add(-time.Second)
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("expired_1"), ExpiresAt: past}))
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("expired_2"), ExpiresAt: past, Priority: 2}))
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("value"), ExpiresAt: time.Now().Add(time.Hour)}))
+
+	// expired messages are discarded by default.
+	val, _, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(val.Raw))
+
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("expired_3"), ExpiresAt: past}))
+	_, _, err = s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), stats.Expired)
+	assert.Equal(t, uint64(0), stats.Ready)
+
+	// the default ttl applies to messages published without one.
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{
+		Mode:       ModeQueue,
+		MessageTTL: Duration(time.Millisecond),
+		Expiry:     ExpiryDeadLetter,
+	}))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("short_lived"))))
+	time.Sleep(5 * time.Millisecond)
+
+	_, _, err = s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	val, _, err = s.GetNext([]byte("testtopic.dlq"))
+	require.NoError(t, err)
+	assert.Equal(t, "short_lived", string(val.Raw))
+	assert.True(t, val.ExpiresAt.IsZero())
+	require.NotNil(t, val.DeadLetter)
+	assert.Equal(t, ReasonExpired, val.DeadLetter.Reason)
+}
+
+func TestMessageGroups(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.InsertBatch(testTopic, []*Value{
+		{Raw: []byte("a_1"), GroupKey: "a"},
+		{Raw: []byte("a_2"), GroupKey: "a"},
+		{Raw: []byte("b_1"), GroupKey: "b"},
+		{Raw: []byte("a_3"), GroupKey: "a"},
+		NewValue([]byte("none")),
+	}))
+
+	// only one message of every group is outstanding at a time.
+	msgs, err := s.GetNextN(testTopic, 5)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "a_1", string(msgs[0].Value.Raw))
+	assert.Equal(t, "b_1", string(msgs[1].Value.Raw))
+	assert.Equal(t, "none", string(msgs[2].Value.Raw))
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Ready)
+	assert.Equal(t, uint64(2), stats.Held)
+
+	_, _, err = s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	// settling a message releases the next message of its group.
+	require.NoError(t, s.Ack(testTopic, msgs[0].Offset))
+	val, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "a_2", string(val.Raw))
+
+	_, _, err = s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	// a nacked message stays first in its group.
+	require.NoError(t, s.Nack(testTopic, offset, "failure"))
+	val, offset, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "a_2", string(val.Raw))
+
+	require.NoError(t, s.Ack(testTopic, offset))
+	val, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "a_3", string(val.Raw))
+
+	stats, err = s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Held)
+
+	_, err = s.InsertIdempotent(testTopic, []byte("key"), &Value{GroupKey: strings.Repeat("g", MaxGroupKeyLen+1)}, time.Now())
+	require.ErrorIs(t, err, ErrInvalidGroupKey)
+}
+
+func TestPurge_MessageGroups(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.InsertBatch(testTopic, []*Value{
+		{Raw: []byte("a_1"), GroupKey: "a"},
+		{Raw: []byte("a_2"), GroupKey: "a"},
+	}))
+
+	msgs, err := s.GetNextN(testTopic, 2)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	// held messages are purged along with the ready ones.
+	purged, err := s.Purge(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), purged)
+
+	require.NoError(t, s.Ack(testTopic, msgs[0].Offset))
+	_, _, err = s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+}
+
+func TestBatchTx_Iterator(t *testing.T) {
+	db := newTestStore(t).(*store).db
+	for _, key := range []string{"tx/a", "tx/c", "tx/d"} {
+		require.NoError(t, db.Put([]byte(key), []byte("db"), nil))
+	}
+
+	tx := newBatchTx(db)
+	require.NoError(t, tx.Put([]byte("tx/a"), []byte("tx"), nil))
+	require.NoError(t, tx.Put([]byte("tx/b"), []byte("tx"), nil))
+	require.NoError(t, tx.Delete([]byte("tx/c"), nil))
+	require.NoError(t, tx.Put([]byte("other"), []byte("tx"), nil))
+
+	// the iterator sees the pending writes of its range and none of the deleted keys.
+	var forward, backward []string
+	iter := tx.NewIterator(util.BytesPrefix([]byte("tx/")), nil)
+	for iter.Next() {
+		forward = append(forward, string(iter.Key())+"="+string(iter.Value()))
+		// keys written while iterating aren't seen by the iterator.
+		require.NoError(t, tx.Put([]byte("tx/e"), []byte("tx"), nil))
+	}
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		backward = append(backward, string(iter.Key()))
+	}
+	iter.Release()
+	require.NoError(t, iter.Error())
+	assert.Equal(t, []string{"tx/a=tx", "tx/b=tx", "tx/d=db"}, forward)
+	assert.Equal(t, []string{"tx/d", "tx/b", "tx/a"}, backward)
+
+	// the database is only changed by the commit.
+	_, err := db.Get([]byte("tx/b"), nil)
+	require.ErrorIs(t, err, leveldb.ErrNotFound)
+	require.NoError(t, tx.commit())
+	has, err := db.Has([]byte("tx/c"), nil)
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestInsertIdempotent(t *testing.T) {
+	s := newTestStore(t)
+
+	now := time.Now()
+	first, err := s.InsertIdempotent(testTopic, []byte("key_1"), NewValue([]byte("value_1")), now)
+	require.NoError(t, err)
+	assert.False(t, first.Duplicate)
+
+	second, err := s.InsertIdempotent(testTopic, []byte("key_2"), NewValue([]byte("value_2")), now)
+	require.NoError(t, err)
+	assert.Equal(t, first.Offset+1, second.Offset)
+
+	// a repeated key returns the original receipt without inserting the value again.
+	dup, err := s.InsertIdempotent(testTopic, []byte("key_1"), NewValue([]byte("value_1")), now)
+	require.NoError(t, err)
+	assert.True(t, dup.Duplicate)
+	assert.Equal(t, first.Offset, dup.Offset)
+	assert.Equal(t, first.ID, dup.ID)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Ready)
+
+	// scheduled messages are deduplicated too.
+	scheduled, err := s.InsertIdempotent(testTopic, []byte("key_3"), NewValue([]byte("later")), now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, scheduled.Scheduled)
+
+	dup, err = s.InsertIdempotent(testTopic, []byte("key_3"), NewValue([]byte("later")), now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, dup.Duplicate)
+	assert.True(t, dup.Scheduled)
+
+	stats, err = s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Scheduled)
+
+	_, err = s.InsertIdempotent(testTopic, nil, NewValue([]byte("value")), now)
+	require.ErrorIs(t, err, ErrInvalidIdempotencyKey)
+
+	// keys are forgotten once the dedup window has passed.
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, DedupWindow: Duration(time.Millisecond)}))
+	_, err = s.InsertIdempotent(testTopic, []byte("key_4"), NewValue([]byte("value_4")), now)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	again, err := s.InsertIdempotent(testTopic, []byte("key_4"), NewValue([]byte("value_4")), time.Now())
+	require.NoError(t, err)
+	assert.False(t, again.Duplicate)
+
+	stats, err = s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), stats.Ready)
+
+	pruned, err := s.(*store).pruneDedup(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), pruned)
+}
+
+func TestCompression(t *testing.T) {
+	s := newTestStore(t)
+
+	payload := bytes.Repeat([]byte("value"), 200)
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, Compression: CompressionSnappy}))
+	require.NoError(t, s.Insert(testTopic, NewValue(payload)))
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Less(t, stats.Bytes, uint64(len(payload)))
+
+	// values compressed differently stay readable.
+	zstdVal, err := NewCompressedValue(CompressionZstd.compress(payload), CompressionZstd, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Insert(testTopic, zstdVal))
+
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		val, _, err := s.GetNext(testTopic)
+		require.NoError(t, err)
+		assert.Equal(t, payload, val.Raw)
+		assert.Equal(t, c, val.Compression)
+	}
+
+	err = s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, Compression: "gzip"})
+	require.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestParseKeyring(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16))
+
+	keys, err := ParseKeyring("# rotated\nk2:" + key2 + "\n\nk1:" + key1 + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keys.CurrentKeyID())
+
+	keys, err = ParseKeyring("k1:" + key1 + ",k2:" + key2)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", keys.CurrentKeyID())
+
+	for _, s := range []string{"", "k1", "k1:not-base64", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), ":" + key1} {
+		_, err := ParseKeyring(s)
+		require.ErrorIs(t, err, ErrInvalidKeys, s)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rq-test-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldKeys, err := NewKeyring("old", map[string][]byte{"old": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+
+	// a value stored before encryption was enabled.
+	s, err := NewStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("plain"))))
+	require.NoError(t, s.Close())
+
+	payload := bytes.Repeat([]byte("secret"), 100)
+	s, err = NewStore(dir, WithKeyProvider(oldKeys))
+	require.NoError(t, err)
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, Compression: CompressionZstd}))
+	require.NoError(t, s.Insert(testTopic, NewValue(payload)))
+	require.NoError(t, s.Close())
+
+	// payloads aren't stored in plaintext and can't be read without the keys.
+	db, err := leveldb.OpenFile(dir, nil)
+	require.NoError(t, err)
+	raw, err := db.Get(encodeKeyWithOffset(primaryPrefix, testTopic, 1), nil)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret")))
+	require.NoError(t, db.Close())
+
+	s, err = NewStore(dir)
+	require.NoError(t, err)
+	_, err = s.GetNextN(testTopic, 2)
+	require.ErrorIs(t, err, ErrNoKeys)
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Ready)
+	require.NoError(t, s.Close())
+
+	// rotating to a new key rewrites both values, after which the old key can be removed.
+	rotated, err := NewKeyring("new", map[string][]byte{
+		"new": bytes.Repeat([]byte{2}, 32),
+		"old": bytes.Repeat([]byte{1}, 32),
+	})
+	require.NoError(t, err)
+	n, err := Reencrypt(dir, rotated)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), n)
+
+	n, err = Reencrypt(dir, rotated)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), n)
+
+	newKeys, err := NewKeyring("new", map[string][]byte{"new": bytes.Repeat([]byte{2}, 32)})
+	require.NoError(t, err)
+	s, err = NewStore(dir, WithKeyProvider(newKeys))
+	require.NoError(t, err)
+	defer s.Close()
+	checkInvariants(t, s.(*store).db)
+
+	msgs, err := s.GetNextN(testTopic, 2)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, []byte("plain"), msgs[0].Value.Raw)
+	assert.Equal(t, payload, msgs[1].Value.Raw)
+	assert.Equal(t, CompressionZstd, msgs[1].Value.Compression)
+	for _, msg := range msgs {
+		assert.Equal(t, "new", msg.Value.KeyID)
+	}
+}
+
+func TestEncryption_MissingKey(t *testing.T) {
+	dir := t.TempDir()
+
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	oldKeys, err := NewKeyring("old", map[string][]byte{"old": oldKey})
+	require.NoError(t, err)
+	s, err := NewStore(dir, WithKeyProvider(oldKeys))
+	require.NoError(t, err)
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("lost"))))
+	require.NoError(t, s.Close())
+
+	// the old key was dropped without reencrypting the stored value.
+	newKeys, err := NewKeyring("new", map[string][]byte{"new": newKey})
+	require.NoError(t, err)
+	s, err = NewStore(dir, WithKeyProvider(newKeys))
+	require.NoError(t, err)
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("kept"))))
+
+	// the value which can't be decrypted is dead-lettered instead of blocking the topic.
+	val, _, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "kept", string(val.Raw))
+
+	stats, err := s.Stats([]byte("testtopic.dlq"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Ready)
+	checkInvariants(t, s.(*store).db)
+	require.NoError(t, s.Close())
+
+	// once the key is back, the dead-lettered value can be read.
+	bothKeys, err := NewKeyring("new", map[string][]byte{"new": newKey, "old": oldKey})
+	require.NoError(t, err)
+	s, err = NewStore(dir, WithKeyProvider(bothKeys))
+	require.NoError(t, err)
+	defer s.Close()
+
+	val, _, err = s.GetNext([]byte("testtopic.dlq"))
+	require.NoError(t, err)
+	assert.Equal(t, "lost", string(val.Raw))
+	require.NotNil(t, val.DeadLetter)
+	assert.Contains(t, val.DeadLetter.Reason, ErrKeyNotFound.Error())
+}
+
+func TestSchedule(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rq-test-store")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := NewStore(dir)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, s.Schedule(testTopic, NewValue([]byte("later")), now.Add(2*time.Minute)))
+	require.NoError(t, s.Schedule(testTopic, NewValue([]byte("sooner_1")), now.Add(time.Minute)))
+	require.NoError(t, s.Schedule(testTopic, NewValue([]byte("sooner_2")), now.Add(time.Minute)))
+	require.NoError(t, s.Schedule(testTopic, NewValue([]byte("now")), now.Add(-time.Minute)))
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Ready)
+	assert.Equal(t, uint64(3), stats.Scheduled)
+
+	promoted, err := s.PromoteDue(now)
+	require.NoError(t, err)
+	assert.Empty(t, promoted)
+
+	// scheduled values survive a restart.
+	require.NoError(t, s.Close())
+	s, err = NewStore(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	promoted, err = s.PromoteDue(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{testTopic}, promoted)
+
+	promoted, err = s.PromoteDue(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, promoted)
+
+	for _, want := range []string{"now", "sooner_1", "sooner_2"} {
+		val, _, err := s.GetNext(testTopic)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(val.Raw))
+	}
+	_, _, err = s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	require.NoError(t, s.DeleteTopic(testTopic))
+	promoted, err = s.PromoteDue(now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, promoted)
+}
+
+func TestPromoteDue_Full(t *testing.T) {
+	s := newTestStore(t)
+	other := []byte("othertopic")
+
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{
+		Mode:        ModeQueue,
+		MaxMessages: 1,
+		Overflow:    OverflowRejectPublish,
+	}))
+	now := time.Now()
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value"))))
+	require.NoError(t, s.Schedule(testTopic, NewValue([]byte("delayed")), now.Add(time.Minute)))
+	require.NoError(t, s.Schedule(other, NewValue([]byte("promoted")), now.Add(time.Minute)))
+
+	// the value of the full topic stays scheduled without holding back the other topic.
+	promoted, err := s.PromoteDue(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{other}, promoted)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Ready)
+	assert.Equal(t, uint64(1), stats.Scheduled)
+
+	val, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(val.Raw))
+	require.NoError(t, s.Ack(testTopic, offset))
+
+	// once the topic has been drained the value is promoted.
+	promoted, err = s.PromoteDue(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{testTopic}, promoted)
+
+	val, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "delayed", string(val.Raw))
+
+	_, _, err = s.GetNext([]byte("testtopic.dlq"))
+	assert.ErrorIs(t, err, ErrEmpty)
+}
+
+func TestPromoteDue_Rejected(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{
+		Mode:     ModeQueue,
+		MaxBytes: 16,
+		Overflow: OverflowRejectPublish,
+	}))
+	now := time.Now()
+	require.NoError(t, s.Schedule(testTopic, NewValue([]byte("larger than the topic's byte limit")), now.Add(time.Minute)))
+
+	// a value which can never fit into the topic is dead-lettered.
+	promoted, err := s.PromoteDue(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("testtopic.dlq")}, promoted)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Ready)
+	assert.Equal(t, uint64(0), stats.Scheduled)
+
+	val, _, err := s.GetNext([]byte("testtopic.dlq"))
+	require.NoError(t, err)
+	require.NotNil(t, val.DeadLetter)
+	assert.Contains(t, val.DeadLetter.Reason, "max_bytes")
+}
+
+func TestInsertBatch_GetNextN(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.InsertBatch(testTopic, []*Value{
+		NewValue([]byte("value_1")),
+		NewValue([]byte("value_2")),
+		{Raw: []byte("value_3"), Priority: 1},
+	}))
+	require.ErrorIs(t, s.InsertBatch(testTopic, []*Value{
+		NewValue([]byte("value_4")),
+		{Priority: MaxPriority + 1},
+	}), ErrInvalidPriority)
+
+	msgs, err := s.GetNextN(testTopic, 2)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "value_3", string(msgs[0].Value.Raw))
+	assert.Equal(t, "value_1", string(msgs[1].Value.Raw))
+	assert.NotEqual(t, msgs[0].Offset, msgs[1].Offset)
+
+	msgs, err = s.GetNextN(testTopic, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "value_2", string(msgs[0].Value.Raw))
+
+	_, err = s.GetNextN(testTopic, 10)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), stats.Unacked)
+}
+
+func TestGetNext_Priority(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, val := range []*Value{
+		{Raw: []byte("low_1")},
+		{Raw: []byte("high_1"), Priority: 9},
+		{Raw: []byte("medium"), Priority: 5},
+		{Raw: []byte("high_2"), Priority: 9},
+		{Raw: []byte("low_2")},
+	} {
+		require.NoError(t, s.Insert(testTopic, val))
+	}
+	require.ErrorIs(t, s.Insert(testTopic, &Value{Priority: MaxPriority + 1}), ErrInvalidPriority)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), stats.Ready)
+	assert.Equal(t, map[uint8]uint64{0: 2, 5: 1, 9: 2}, stats.Priorities)
+
+	val, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "high_1", string(val.Raw))
+
+	// a nacked message returns to the front of its own band.
+	require.NoError(t, s.Nack(testTopic, offset, "retry"))
+
+	var got []string
+	for {
+		val, offset, err := s.GetNext(testTopic)
+		if errors.Is(err, ErrEmpty) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, s.Ack(testTopic, offset))
+		got = append(got, string(val.Raw))
+	}
+	assert.Equal(t, []string{"high_1", "high_2", "medium", "low_1", "low_2"}, got)
+
+	stats, err = s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Ready)
+	assert.Equal(t, uint64(0), stats.Unacked)
+	assert.Empty(t, stats.Priorities)
+
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("high"), Priority: 9}))
+	purged, err := s.Purge(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), purged)
+
+	// dead-lettered messages keep their priority and can be redriven.
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, MaxDeliveries: 1}))
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("poison"), Priority: 5}))
+	_, offset, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	require.NoError(t, s.Nack(testTopic, offset, "failure"))
+
+	moved, err := s.Redrive([]byte("testtopic.dlq"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{string(testTopic): 1}, moved)
+
+	val, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "poison", string(val.Raw))
+	assert.Equal(t, uint8(5), val.Priority)
+}
+
+func TestRequeueExpired(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{
+		Mode:              ModeQueue,
+		VisibilityTimeout: Duration(time.Minute),
+	}))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value_1"))))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value_2"))))
+
+	_, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+
+	requeued, err := s.RequeueExpired(time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, requeued)
+
+	requeued, err = s.RequeueExpired(time.Now().Add(2 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{testTopic}, requeued)
+
+	require.ErrorIs(t, s.Ack(testTopic, offset), ErrKeyDoesntExist)
+	require.ErrorIs(t, s.Touch(testTopic, offset, 0), ErrKeyDoesntExist)
+
+	val, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "value_1", string(val.Raw))
+
+	require.NoError(t, s.Touch(testTopic, offset, time.Hour))
+	requeued, err = s.RequeueExpired(time.Now().Add(2 * time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, requeued)
+
+	require.NoError(t, s.Ack(testTopic, offset))
+	requeued, err = s.RequeueExpired(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, requeued)
+}
+
+func TestTouch_NoVisibilityTimeout(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value"))))
+	_, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, s.Touch(testTopic, offset, 0), ErrNoVisibilityTimeout)
+
+	requeued, err := s.RequeueExpired(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, requeued)
+	require.NoError(t, s.Ack(testTopic, offset))
+}
+
+func TestNack_DeadLetter(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{
+		Mode:          ModeQueue,
+		MaxDeliveries: 2,
+	}))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("poison"))))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("healthy"))))
+
+	val, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	require.NoError(t, s.Nack(testTopic, offset, "first failure"))
+
+	val, offset, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "poison", string(val.Raw))
+	assert.Equal(t, uint32(1), val.Dacks)
+	require.NoError(t, s.Nack(testTopic, offset, "second failure"))
+
+	val, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "healthy", string(val.Raw))
+
+	dlq := []byte(string(testTopic) + ".dlq")
+	val, offset, err = s.GetNext(dlq)
+	require.NoError(t, err)
+	assert.Equal(t, "poison", string(val.Raw))
+	assert.Equal(t, &DeadLetter{
+		Topic:    string(testTopic),
+		Failures: 2,
+		Reason:   "second failure",
+	}, val.DeadLetter)
+	require.NoError(t, s.Nack(dlq, offset, ""))
+
+	moved, err := s.Redrive(dlq, 0)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{string(testTopic): 1}, moved)
+
+	val, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "poison", string(val.Raw))
+	assert.Equal(t, uint32(0), val.Dacks)
+	assert.Nil(t, val.DeadLetter)
+
+	stats, err := s.Stats(dlq)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Ready)
+}
+
+func TestRedrive_Skipped(t *testing.T) {
+	s := newTestStore(t)
+	dlq := []byte("testtopic.dlq")
+
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{
+		Mode:          ModeQueue,
+		MaxDeliveries: 1,
+		MaxMessages:   1,
+		Overflow:      OverflowRejectPublish,
+	}))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("failed"))))
+	_, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	require.NoError(t, s.Nack(testTopic, offset, "failed"))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("ready"))))
+	require.NoError(t, s.Insert(dlq, NewValue([]byte("plain"))))
+
+	// the full topic rejects the message and the plain one has no topic to go back to, but
+	// neither fails the redrive.
+	moved, err := s.Redrive(dlq, 0)
+	require.NoError(t, err)
+	assert.Empty(t, moved)
+
+	stats, err := s.Stats(dlq)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Ready)
+
+	val, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "ready", string(val.Raw))
+	require.NoError(t, s.Ack(testTopic, offset))
+
+	moved, err = s.Redrive(dlq, 0)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{string(testTopic): 1}, moved)
+
+	val, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "failed", string(val.Raw))
+
+	val, _, err = s.GetNext(dlq)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(val.Raw))
+	checkInvariants(t, s.(*store).db)
+}
+
+func TestRedrive_Group(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{Mode: ModeQueue, MaxDeliveries: 1}))
+	for _, v := range []string{"first", "second"} {
+		require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte(v), GroupKey: "g"}))
+	}
+	_, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	require.NoError(t, s.Nack(testTopic, offset, "failed"))
+
+	_, second, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	require.NoError(t, s.Insert(testTopic, &Value{Raw: []byte("third"), GroupKey: "g"}))
+	_, _, err = s.GetNext(testTopic)
+	require.ErrorIs(t, err, ErrEmpty)
+
+	// the redriven message is held behind the held message of its group.
+	moved, err := s.Redrive([]byte("testtopic.dlq"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{string(testTopic): 1}, moved)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Ready)
+	assert.Equal(t, uint64(2), stats.Held)
+
+	require.NoError(t, s.Ack(testTopic, second))
+	for _, want := range []string{"third", "first"} {
+		val, offset, err := s.GetNext(testTopic)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(val.Raw))
+		require.NoError(t, s.Ack(testTopic, offset))
+	}
+	checkInvariants(t, s.(*store).db)
+}
+
+func TestRedrive_Subscription(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.SetTopicConfig(testTopic, &TopicConfig{
+		Mode:            ModeFanout,
+		MaxDeliveries:   1,
+		DeadLetterTopic: "failed",
+	}))
+	require.NoError(t, s.AddSubscription(testTopic, []byte("sub_1"), true))
+	require.NoError(t, s.AddSubscription(testTopic, []byte("sub_2"), true))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value"))))
+
+	subTopic := SubscriptionTopic(testTopic, []byte("sub_1"))
+	_, offset, err := s.GetNext(subTopic)
+	require.NoError(t, err)
+	require.NoError(t, s.Nack(subTopic, offset, "failed"))
+
+	moved, err := s.Redrive([]byte("failed"), 1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{string(testTopic): 1}, moved)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Subscriptions[0].Ready)
+	assert.Equal(t, uint64(1), stats.Subscriptions[1].Ready)
+
+	_, err = s.Redrive([]byte("missing"), 0)
+	require.ErrorIs(t, err, ErrTopicNotFound)
 }
 
 func newTestStore(t *testing.T) Store {
@@ -95,3 +1204,166 @@ func newTestStore(t *testing.T) Store {
 
 	return store
 }
+
+func TestEncodeKeyWithOffset_Order(t *testing.T) {
+	keys := [][]byte{
+		encodeKeyWithOffset(primaryPrefix, []byte("a"), 0),
+		encodeKeyWithOffset(primaryPrefix, []byte("a"), 1),
+		encodeKeyWithOffset(primaryPrefix, []byte("a"), 256),
+		encodeKeyWithOffset(primaryPrefix, []byte("a"), headIndicator),
+		encodeKeyWithOffset(primaryPrefix, []byte("a"), tailIndicator),
+		encodeKeyWithOffset(primaryPrefix, []byte("b"), 0),
+		encodeKeyWithOffset(primaryPrefix, []byte("aa"), 0),
+		encodeKeyWithOffset(ackPrefix, []byte("a"), 0),
+	}
+
+	for i := 1; i < len(keys); i++ {
+		assert.Equal(t, -1, bytes.Compare(keys[i-1], keys[i]), "key %d should sort before key %d", i-1, i)
+	}
+}
+
+func TestNewStore_MigratesLegacyKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rq-test-store")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	legacyKey := func(prefix int, topic []byte, offset uint64) []byte {
+		key := make([]byte, 9+len(topic))
+		key[0] = byte(prefix)
+		binary.LittleEndian.PutUint64(key[1:9], offset)
+		copy(key[9:], topic)
+		return key
+	}
+	u64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, v)
+		return b
+	}
+
+	db, err := leveldb.OpenFile(dir, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(legacyKey(primaryPrefix, testTopic, headIndicator), u64(1), nil))
+	require.NoError(t, db.Put(legacyKey(primaryPrefix, testTopic, tailIndicator), u64(3), nil))
+	require.NoError(t, db.Put(legacyKey(ackPrefix, testTopic, tailIndicator), u64(1), nil))
+	require.NoError(t, db.Put(legacyKey(ackPrefix, testTopic, 0), NewValue([]byte("leased")).Encode(), nil))
+	require.NoError(t, db.Put(legacyKey(primaryPrefix, testTopic, 1), NewValue([]byte("value_1")).Encode(), nil))
+	require.NoError(t, db.Put(legacyKey(primaryPrefix, testTopic, 2), NewValue([]byte("value_2")).Encode(), nil))
+	require.NoError(t, db.Close())
+
+	s, err := NewStore(dir)
+	require.NoError(t, err)
+
+	val, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "value_1", string(val.Raw))
+	assert.Equal(t, uint64(1), offset)
+
+	require.NoError(t, s.Nack(testTopic, 0, ""))
+	val, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "leased", string(val.Raw))
+	require.NoError(t, s.Close())
+
+	// reopening an already migrated store must not rewrite it again.
+	s, err = NewStore(dir)
+	require.NoError(t, err)
+	val, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "value_2", string(val.Raw))
+	require.NoError(t, s.Close())
+}
+
+func TestTopics(t *testing.T) {
+	s := newTestStore(t)
+
+	topics, err := s.Topics()
+	require.NoError(t, err)
+	assert.Empty(t, topics)
+
+	for _, topic := range []string{"b", "a", "aa"} {
+		require.NoError(t, s.Insert([]byte(topic), NewValue([]byte("value_1"))))
+		require.NoError(t, s.Insert([]byte(topic), NewValue([]byte("value_2"))))
+	}
+
+	topics, err = s.Topics()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("aa")}, topics)
+}
+
+func TestStats(t *testing.T) {
+	s := newTestStore(t)
+
+	_, err := s.Stats(testTopic)
+	require.ErrorIs(t, err, ErrTopicNotFound)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Insert(testTopic, NewValue([]byte("value"))))
+	}
+	_, _, err = s.GetNext(testTopic)
+	require.NoError(t, err)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, &TopicStats{
+		Topic:   string(testTopic),
+		Mode:    ModeQueue,
+		Head:    1,
+		Tail:    3,
+		Ready:   2,
+		Unacked: 1,
+		Bytes:   uint64(2 * len(NewValue([]byte("value")).Encode())),
+	}, stats)
+}
+
+func TestPurge(t *testing.T) {
+	s := newTestStore(t)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Insert(testTopic, NewValue([]byte("value"))))
+	}
+	_, offset, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+
+	purged, err := s.Purge(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), purged)
+
+	stats, err := s.Stats(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Ready)
+	assert.Equal(t, uint64(1), stats.Unacked)
+
+	_, _, err = s.GetNext(testTopic)
+	require.Error(t, err)
+
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("after_purge"))))
+	val, _, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+	assert.Equal(t, "after_purge", string(val.Raw))
+
+	require.NoError(t, s.Ack(testTopic, offset))
+}
+
+func TestDeleteTopic(t *testing.T) {
+	s := newTestStore(t).(*store)
+
+	require.ErrorIs(t, s.DeleteTopic(testTopic), ErrTopicNotFound)
+
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value_1"))))
+	require.NoError(t, s.Insert(testTopic, NewValue([]byte("value_2"))))
+	require.NoError(t, s.Insert([]byte("other"), NewValue([]byte("value"))))
+	_, _, err := s.GetNext(testTopic)
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteTopic(testTopic))
+
+	for _, prefix := range []int{primaryPrefix, ackPrefix} {
+		iter := s.db.NewIterator(util.BytesPrefix(topicKeyPrefix(prefix, testTopic)), nil)
+		assert.False(t, iter.Next(), "keys left in prefix %d", prefix)
+		iter.Release()
+	}
+
+	topics, err := s.Topics()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("other")}, topics)
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	ErrNotStream         = errors.New("topic is not a stream topic")
+	ErrStream            = errors.New("messages of stream topics can't be leased")
+	ErrInvalidConsumer   = errors.New("invalid stream consumer name")
+	ErrOffsetOutOfRange  = errors.New("offset is past the end of the stream")
+	ErrNoCommittedOffset = errors.New("consumer has no committed offset")
+)
+
+// PositionKind is the kind of a position in a stream.
+type PositionKind int
+
+const (
+	// PositionEarliest is the oldest message retained by the stream.
+	PositionEarliest PositionKind = iota
+	// PositionLatest is the offset the next published message gets.
+	PositionLatest
+	// PositionOffset is a specific offset.
+	PositionOffset
+	// PositionTime is the first message published at or after a specific time.
+	PositionTime
+)
+
+// Position is a position to start reading a stream from, see Seek.
+type Position struct {
+	Kind   PositionKind
+	Offset uint64
+	Time   time.Time
+}
+
+// Earliest returns the position of the oldest message retained by a stream.
+func Earliest() Position {
+	return Position{Kind: PositionEarliest}
+}
+
+// Latest returns the position after the newest message of a stream.
+func Latest() Position {
+	return Position{Kind: PositionLatest}
+}
+
+// AtOffset returns the position of the message with the given offset.
+func AtOffset(offset uint64) Position {
+	return Position{Kind: PositionOffset, Offset: offset}
+}
+
+// AtTime returns the position of the first message published at or after t.
+func AtTime(t time.Time) Position {
+	return Position{Kind: PositionTime, Time: t}
+}
+
+// appendStream appends a value to a stream topic and trims the stream to its retention limits.
+// Streams have no priority bands, so the value is stored in the topic itself regardless of its
+// priority. It returns the offset of the value in the stream.
+func appendStream(db leveldbCommon, topic []byte, val *Value) (uint64, error) {
+	if err := validPriority(val); err != nil {
+		return 0, err
+	}
+
+	if err := initTopic(db, topic); err != nil {
+		return 0, err
+	}
+
+	offset, err := appendValue(db, primaryPrefix, topic, val)
+	if err != nil {
+		return 0, err
+	}
+
+	cfg, err := getTopicConfig(db, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := trim(db, topic, cfg, time.Now()); err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+// Read returns up to n messages of a stream topic starting at offset, without changing the
+// stream. Offsets before the oldest retained message start at the oldest message instead. It
+// returns ErrEmpty if there are no messages at or after the offset yet and ErrOffsetOutOfRange if
+// the offset is past the next offset of the stream.
+func (s *store) Read(topic []byte, offset uint64, n int) ([]*Message, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	head, tail, err := streamBounds(s.db, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > tail {
+		return nil, ErrOffsetOutOfRange
+	}
+	offset = max(offset, head)
+	if offset == tail {
+		return nil, ErrEmpty
+	}
+
+	var msgs []*Message
+	iter := s.db.NewIterator(&util.Range{
+		Start: encodeKeyWithOffset(primaryPrefix, topic, offset),
+		Limit: encodeKeyWithOffset(primaryPrefix, topic, tail),
+	}, nil)
+	for len(msgs) < n && iter.Next() {
+		_, _, msgOffset, ok := decodeKey(iter.Key())
+		if !ok {
+			continue
+		}
+
+		msgs = append(msgs, &Message{Offset: msgOffset, Value: Decode(append([]byte(nil), iter.Value()...))})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating stream: %v", err)
+	}
+
+	for _, msg := range msgs {
+		if err := decryptValue(s.keys, msg.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil, ErrEmpty
+	}
+
+	return msgs, nil
+}
+
+// Seek resolves a position of a stream topic to an offset. Offsets before the oldest retained
+// message resolve to the oldest message and a time after the newest message resolves to the next
+// offset of the stream.
+func (s *store) Seek(topic []byte, pos Position) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	head, tail, err := streamBounds(s.db, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	switch pos.Kind {
+	case PositionEarliest:
+		return head, nil
+	case PositionLatest:
+		return tail, nil
+	case PositionOffset:
+		if pos.Offset > tail {
+			return 0, ErrOffsetOutOfRange
+		}
+		return max(pos.Offset, head), nil
+	case PositionTime:
+		return offsetForTime(s.db, topic, head, tail, pos.Time)
+	default:
+		return 0, fmt.Errorf("unknown position kind %d", pos.Kind)
+	}
+}
+
+// offsetForTime returns the offset of the first message in [head, tail) published at or after t.
+// Messages are appended in publish order, so the offsets are searched with a binary search.
+func offsetForTime(db leveldbCommon, topic []byte, head, tail uint64, t time.Time) (uint64, error) {
+	lo, hi := head, tail
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		val, err := getValue(db, topic, mid)
+		if err != nil {
+			return 0, fmt.Errorf("getting message at offset [%d]: %v", mid, err)
+		}
+
+		if val.PublishedAt.Before(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo, nil
+}
+
+// CommitOffset stores the offset a stream consumer continues reading from, which is the offset
+// after the last message it has processed.
+func (s *store) CommitOffset(topic, consumer []byte, offset uint64) error {
+	if len(consumer) == 0 {
+		return ErrInvalidConsumer
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	_, tail, err := streamBounds(s.db, topic)
+	if err != nil {
+		return err
+	}
+	if offset > tail {
+		return ErrOffsetOutOfRange
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, offset)
+
+	return s.db.Put(committedKey(topic, consumer), b, nil)
+}
+
+// CommittedOffset returns the offset committed by a stream consumer. It returns
+// ErrNoCommittedOffset if the consumer hasn't committed an offset.
+func (s *store) CommittedOffset(topic, consumer []byte) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	b, err := s.db.Get(committedKey(topic, consumer), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, ErrNoCommittedOffset
+	}
+	if err != nil {
+		return 0, fmt.Errorf("getting committed offset: %v", err)
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// streamBounds returns the offset of the oldest retained message and the next offset of a stream.
+func streamBounds(db leveldbCommon, topic []byte) (uint64, uint64, error) {
+	if err := topicExists(db, topic); err != nil {
+		return 0, 0, err
+	}
+
+	cfg, err := getTopicConfig(db, topic)
+	if err != nil {
+		return 0, 0, err
+	}
+	if cfg.Mode != ModeStream {
+		return 0, 0, ErrNotStream
+	}
+
+	head, err := getPos(db, topic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tail, err := getTail(db, primaryPrefix, topic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return head, tail, nil
+}
+
+// committedOffsets returns the committed offsets of every consumer of a stream.
+func committedOffsets(db leveldbCommon, topic []byte) (map[string]uint64, error) {
+	prefix := topicKeyPrefix(offsetPrefix, topic)
+
+	var offsets map[string]uint64
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		if offsets == nil {
+			offsets = make(map[string]uint64)
+		}
+		offsets[string(iter.Key()[len(prefix):])] = binary.BigEndian.Uint64(iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating committed offsets: %v", err)
+	}
+
+	return offsets, nil
+}
+
+// deleteCommittedKeys deletes the committed offsets of a stream.
+func deleteCommittedKeys(db leveldbCommon, topic []byte) error {
+	return deletePrefix(db, topicKeyPrefix(offsetPrefix, topic))
+}
+
+func committedKey(topic, consumer []byte) []byte {
+	return append(topicKeyPrefix(offsetPrefix, topic), consumer...)
+}
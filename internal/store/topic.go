@@ -0,0 +1,405 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Mode defines how the messages of a topic are delivered to its consumers.
+type Mode string
+
+const (
+	// ModeQueue delivers every message to exactly one of the topic's consumers.
+	ModeQueue Mode = "queue"
+	// ModeFanout delivers every message to each subscription of the topic. Every subscription has
+	// its own queue, so a subscription only sees the messages published after it was created.
+	ModeFanout Mode = "fanout"
+	// ModeStream keeps every message after it's read. Consumers read from any offset of the stream
+	// and commit their own offsets instead of leasing and acknowledging messages.
+	ModeStream Mode = "stream"
+)
+
+// subscriptionSeparator separates the topic from the subscription name in the name of a
+// subscription's queue. Topic names are not allowed to contain it.
+const subscriptionSeparator = 0
+
+var (
+	ErrInvalidConfig        = errors.New("invalid topic config")
+	ErrNotFanout            = errors.New("topic is not a fan-out topic")
+	ErrInvalidSubscription  = errors.New("invalid subscription name")
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+)
+
+// TopicConfig holds the settings of a topic. Topics without a stored config use the defaults
+// returned by DefaultTopicConfig.
+type TopicConfig struct {
+	Mode Mode `json:"mode"`
+	// VisibilityTimeout is how long a consumer can hold a message before it is returned to the
+	// topic. Zero disables the timeout.
+	VisibilityTimeout Duration `json:"visibility_timeout,omitempty"`
+	// MaxDeliveries is how many times a message can be nacked or have its lease expire before it
+	// is moved to the dead-letter topic. Zero allows unlimited deliveries.
+	MaxDeliveries uint32 `json:"max_deliveries,omitempty"`
+	// DeadLetterTopic is the topic failed messages are moved to. It defaults to "<topic>.dlq".
+	DeadLetterTopic string `json:"dead_letter_topic,omitempty"`
+	// MaxAge, MaxBytes and MaxMessages limit the ready messages kept by each queue of the topic,
+	// which is the topic itself or every subscription of a fan-out topic. Messages older than
+	// MaxAge are dropped, while Overflow decides what happens when a publish exceeds MaxBytes or
+	// MaxMessages. Zero disables a limit.
+	MaxAge      Duration `json:"max_age,omitempty"`
+	MaxBytes    uint64   `json:"max_bytes,omitempty"`
+	MaxMessages uint64   `json:"max_messages,omitempty"`
+	// Overflow defaults to OverflowDropOldest.
+	Overflow Overflow `json:"overflow,omitempty"`
+	// MessageTTL is how long messages published without a TTL of their own are delivered. Expiry
+	// decides what happens to expired messages. Zero disables the default TTL.
+	MessageTTL Duration `json:"message_ttl,omitempty"`
+	Expiry     Expiry   `json:"expiry,omitempty"`
+	// DedupWindow is how long the idempotency key of a message is remembered. It defaults to 10
+	// minutes.
+	DedupWindow Duration `json:"dedup_window,omitempty"`
+	// Compression is the compression the payloads of published messages are stored with. Messages
+	// published already compressed keep their compression, so a topic can hold messages with
+	// different compressions.
+	Compression Compression `json:"compression,omitempty"`
+}
+
+func (c *TopicConfig) deadLetterTopic(topic []byte) []byte {
+	if c.DeadLetterTopic != "" {
+		return []byte(c.DeadLetterTopic)
+	}
+
+	return append(append([]byte(nil), topic...), ".dlq"...)
+}
+
+// Duration is a time.Duration that is encoded as a string such as "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+func DefaultTopicConfig() *TopicConfig {
+	return &TopicConfig{
+		Mode: ModeQueue,
+	}
+}
+
+func (c *TopicConfig) validate() error {
+	switch c.Mode {
+	case ModeQueue, ModeFanout, ModeStream:
+	default:
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidConfig, c.Mode)
+	}
+
+	if c.VisibilityTimeout < 0 {
+		return fmt.Errorf("%w: negative visibility timeout", ErrInvalidConfig)
+	}
+
+	if c.DeadLetterTopic != "" && !validTopic([]byte(c.DeadLetterTopic)) {
+		return fmt.Errorf("%w: invalid dead-letter topic", ErrInvalidConfig)
+	}
+
+	switch c.Overflow {
+	case "", OverflowDropOldest, OverflowRejectPublish:
+	default:
+		return fmt.Errorf("%w: unknown overflow policy %q", ErrInvalidConfig, c.Overflow)
+	}
+
+	if c.MaxAge < 0 {
+		return fmt.Errorf("%w: negative max age", ErrInvalidConfig)
+	}
+
+	switch c.Expiry {
+	case "", ExpiryDiscard, ExpiryDeadLetter:
+	default:
+		return fmt.Errorf("%w: unknown expiry %q", ErrInvalidConfig, c.Expiry)
+	}
+
+	if c.MessageTTL < 0 {
+		return fmt.Errorf("%w: negative message ttl", ErrInvalidConfig)
+	}
+
+	if c.DedupWindow < 0 {
+		return fmt.Errorf("%w: negative dedup window", ErrInvalidConfig)
+	}
+
+	if _, err := ParseCompression(string(c.Compression)); err != nil {
+		return fmt.Errorf("%w: unknown compression %q", ErrInvalidConfig, c.Compression)
+	}
+
+	return nil
+}
+
+// SubscriptionTopic returns the name of the queue holding the messages of a fan-out subscription.
+func SubscriptionTopic(topic, name []byte) []byte {
+	subTopic := make([]byte, 0, len(topic)+1+len(name))
+	subTopic = append(subTopic, topic...)
+	subTopic = append(subTopic, subscriptionSeparator)
+	return append(subTopic, name...)
+}
+
+func validTopic(topic []byte) bool {
+	return len(topic) > 0 && len(topic)+bandSuffixLen <= maxTopicLen &&
+		bytes.IndexByte(topic, subscriptionSeparator) == -1
+}
+
+func isSubscriptionTopic(topic []byte) bool {
+	return bytes.IndexByte(topic, subscriptionSeparator) != -1
+}
+
+// baseTopic returns the topic a queue belongs to, which for subscription queues is the fan-out
+// topic holding the subscription.
+func baseTopic(queue []byte) []byte {
+	if i := bytes.IndexByte(queue, subscriptionSeparator); i != -1 {
+		return queue[:i]
+	}
+
+	return queue
+}
+
+func (s *store) SetTopicConfig(topic []byte, cfg *TopicConfig) error {
+	if !validTopic(topic) {
+		return ErrInvalidTopic
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("encoding topic config: %v", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.withTx(func(tx leveldbCommon) error {
+		if err := initTopic(tx, topic); err != nil {
+			return err
+		}
+
+		return tx.Put(topicKeyPrefix(configPrefix, topic), b, nil)
+	})
+}
+
+// TopicConfig returns the config of a topic or the default config if none has been set.
+func (s *store) TopicConfig(topic []byte) (*TopicConfig, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return getTopicConfig(s.db, topic)
+}
+
+func getTopicConfig(db leveldbCommon, topic []byte) (*TopicConfig, error) {
+	b, err := db.Get(topicKeyPrefix(configPrefix, topic), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return DefaultTopicConfig(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting topic config: %v", err)
+	}
+
+	cfg := DefaultTopicConfig()
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("decoding topic config: %v", err)
+	}
+
+	return cfg, nil
+}
+
+// AddSubscription creates a subscription on a fan-out topic. Subscriptions that are not durable
+// are removed when the store is opened again, since their consumers can't outlive the process.
+// Adding an existing subscription is a no-op.
+func (s *store) AddSubscription(topic, name []byte, durable bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.withTx(func(tx leveldbCommon) error {
+		return addSubscription(tx, topic, name, durable)
+	})
+}
+
+func addSubscription(tx leveldbCommon, topic, name []byte, durable bool) error {
+	subTopic := SubscriptionTopic(topic, name)
+	if len(name) == 0 || len(subTopic)+bandSuffixLen > maxTopicLen ||
+		bytes.IndexByte(name, subscriptionSeparator) != -1 {
+		return ErrInvalidSubscription
+	}
+
+	cfg, err := getTopicConfig(tx, topic)
+	if err != nil {
+		return err
+	}
+	if cfg.Mode != ModeFanout {
+		return ErrNotFanout
+	}
+
+	key := subscriptionKey(topic, name)
+	exists, err := tx.Has(key, nil)
+	if err != nil {
+		return fmt.Errorf("checking existance failed: %v", err)
+	}
+	if exists {
+		return nil
+	}
+
+	if err := initTopic(tx, subTopic); err != nil {
+		return err
+	}
+
+	flag := []byte{0}
+	if durable {
+		flag[0] = 1
+	}
+
+	return tx.Put(key, flag, nil)
+}
+
+// RemoveSubscription deletes a subscription along with all of its messages and members.
+func (s *store) RemoveSubscription(topic, name []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.withTx(func(tx leveldbCommon) error {
+		key := subscriptionKey(topic, name)
+		exists, err := tx.Has(key, nil)
+		if err != nil {
+			return fmt.Errorf("checking existance failed: %v", err)
+		}
+		if !exists {
+			return ErrSubscriptionNotFound
+		}
+
+		return deleteSubscription(tx, topic, name)
+	})
+}
+
+// deleteSubscription deletes a subscription along with its messages and members.
+func deleteSubscription(db leveldbCommon, topic, name []byte) error {
+	if err := db.Delete(subscriptionKey(topic, name), nil); err != nil {
+		return err
+	}
+
+	if err := deleteTopicKeys(db, SubscriptionTopic(topic, name)); err != nil {
+		return err
+	}
+
+	return deleteMemberKeys(db, topic, name)
+}
+
+func (s *store) Subscriptions(topic []byte) ([][]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return getSubscriptions(s.db, topic)
+}
+
+func getSubscriptions(db leveldbCommon, topic []byte) ([][]byte, error) {
+	prefix := topicKeyPrefix(subPrefix, topic)
+
+	var names [][]byte
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		names = append(names, append([]byte(nil), iter.Key()[len(prefix):]...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating subscriptions: %v", err)
+	}
+
+	return names, nil
+}
+
+func subscriptionKey(topic, name []byte) []byte {
+	return append(topicKeyPrefix(subPrefix, topic), name...)
+}
+
+// fanoutValue inserts a copy of the value into the queue of every subscription of the topic. It
+// should be called within a transaction so that subscriptions never miss a message.
+func fanoutValue(db leveldbCommon, topic []byte, val *Value) error {
+	if err := initTopic(db, topic); err != nil {
+		return err
+	}
+
+	subs, err := getSubscriptions(db, topic)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		if _, err := insertValue(db, SubscriptionTopic(topic, sub), val); err != nil {
+			return fmt.Errorf("inserting value to subscription [%s]: %w", string(sub), err)
+		}
+	}
+
+	return nil
+}
+
+// deleteTopicKeys deletes all messages, leases, position indicators and usage of a topic and its
+// priority bands.
+func deleteTopicKeys(db leveldbCommon, topic []byte) error {
+	for _, prefix := range []int{primaryPrefix, ackPrefix, leasePrefix, usagePrefix} {
+		for priority := uint8(0); priority <= MaxPriority; priority++ {
+			if err := deletePrefix(db, topicKeyPrefix(prefix, priorityQueue(topic, priority))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return deleteFifoKeys(db, topic)
+}
+
+// removeEphemeralSubscriptions deletes the subscriptions which are not durable. It's called when
+// the store is opened, at which point no consumers can be connected to them.
+func removeEphemeralSubscriptions(db *leveldb.DB) error {
+	tx := newBatchTx(db)
+	iter := tx.NewIterator(util.BytesPrefix([]byte{subPrefix}), nil)
+	for iter.Next() {
+		if len(iter.Value()) > 0 && iter.Value()[0] == 1 {
+			continue
+		}
+
+		topic, name, ok := splitTopicKey(iter.Key())
+		if !ok {
+			continue
+		}
+
+		if err := deleteSubscription(tx, topic, name); err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating subscriptions: %v", err)
+	}
+
+	return tx.commit()
+}
@@ -1,27 +1,185 @@
 package store
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 var (
 	dacksSize = 4
+
+	// extendedMagic marks a value that has a header section. Legacy values start with the dacks
+	// counter, which never reaches math.MaxUint32, so the two formats can't be confused.
+	extendedMagic = []byte{0xff, 0xff, 0xff, 0xff}
 )
 
+const (
+	headerVersion = 1
+
+	tagDeadLetterTopic        = 1
+	tagDeadLetterSubscription = 2
+	tagDeadLetterFailures     = 3
+	tagDeadLetterReason       = 4
+	tagID                     = 5
+	tagPublishedAt            = 6
+	tagFirstDeliveredAt       = 7
+	tagHeader                 = 8
+	tagPriority               = 9
+	tagExpiresAt              = 10
+	tagGroupKey               = 11
+	tagCompression            = 12
+	tagKeyID                  = 13
+	tagWrappedKey             = 14
+)
+
+// Value is a message stored in a topic. Apart from Raw all of the fields are optional metadata,
+// and values without any metadata are stored in the legacy format.
 type Value struct {
 	Dacks uint32
 	Raw   []byte
+	// ID identifies the message and PublishedAt is the time it was published. Both are set by
+	// the broker when the message is published.
+	ID          uuid.UUID
+	PublishedAt time.Time
+	// FirstDeliveredAt is set when the message is leased to a consumer for the first time.
+	FirstDeliveredAt time.Time
+	// Headers holds string metadata such as the content type or a correlation ID.
+	Headers map[string]string
+	// Priority is the priority band of the message, from 0 up to MaxPriority. Messages with a
+	// higher priority are delivered first.
+	Priority uint8
+	// ExpiresAt is the time after which the message is no longer delivered. Zero never expires.
+	ExpiresAt time.Time
+	// GroupKey puts the message into a message group. Messages of the same group are delivered one
+	// at a time in publish order, see leaseGrouped.
+	GroupKey string
+	// Compression is the compression the payload is stored with. Raw always holds the
+	// uncompressed payload, see Compressed for the stored form. Values decoded with a compression
+	// keep the payload they were decoded from, so Raw must not be modified afterwards.
+	Compression Compression
+	// KeyID is the ID of the key the value's data key is wrapped with if the value is encrypted,
+	// see KeyProvider.
+	KeyID string
+	// DeadLetter is set on values that have been moved to a dead-letter topic.
+	DeadLetter *DeadLetter
+
+	packed     []byte
+	wrappedKey []byte
+	sealed     []byte
+	// locked is set on encrypted values until their payload is decrypted.
+	locked bool
 }
 
-// Encode writes a value into bytes. It simply encodes the uint32 into bytes and appends the
-// raw value after that.
+// DeadLetter describes why a value was moved to a dead-letter topic. Subscription is set if the
+// value was dead-lettered from a subscription of a fan-out topic.
+type DeadLetter struct {
+	Topic        string `json:"topic"`
+	Subscription string `json:"subscription,omitempty"`
+	Failures     uint32 `json:"failures"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// Encode writes a value into bytes. Values without metadata are encoded as the uint32 dacks
+// counter followed by the raw value. Values with metadata start with extendedMagic, the header
+// version, the dacks counter and the length of the header, followed by the header fields and the
+// raw value. Every header field is a tag byte, a uvarint length and the field's data. Compressed
+// values store the compressed payload in place of the raw value, and encrypted values the
+// encrypted payload.
 func (v *Value) Encode() []byte {
-	buf := make([]byte, dacksSize+len(v.Raw))
-	binary.LittleEndian.PutUint32(buf, v.Dacks)
-	copy(buf[dacksSize:], v.Raw)
+	header := v.encodeHeader()
+	if len(header) == 0 {
+		buf := make([]byte, dacksSize+len(v.Raw))
+		binary.LittleEndian.PutUint32(buf, v.Dacks)
+		copy(buf[dacksSize:], v.Raw)
+
+		return buf
+	}
+
+	payload := v.sealed
+	if v.KeyID == "" {
+		payload, _ = v.Compressed()
+	}
+	buf := make([]byte, 0, len(extendedMagic)+1+dacksSize+binary.MaxVarintLen64+len(header)+len(payload))
+	buf = append(buf, extendedMagic...)
+	buf = append(buf, headerVersion)
+	buf = binary.LittleEndian.AppendUint32(buf, v.Dacks)
+	buf = binary.AppendUvarint(buf, uint64(len(header)))
+	buf = append(buf, header...)
+
+	return append(buf, payload...)
+}
+
+func (v *Value) encodeHeader() []byte {
+	var header []byte
+	if v.ID != uuid.Nil {
+		header = appendField(header, tagID, v.ID[:])
+	}
+	if !v.PublishedAt.IsZero() {
+		header = appendField(header, tagPublishedAt, binary.LittleEndian.AppendUint64(nil, uint64(v.PublishedAt.UnixNano())))
+	}
+	if !v.FirstDeliveredAt.IsZero() {
+		header = appendField(header, tagFirstDeliveredAt, binary.LittleEndian.AppendUint64(nil, uint64(v.FirstDeliveredAt.UnixNano())))
+	}
+	if v.Priority != 0 {
+		header = appendField(header, tagPriority, []byte{v.Priority})
+	}
+	if !v.ExpiresAt.IsZero() {
+		header = appendField(header, tagExpiresAt, binary.LittleEndian.AppendUint64(nil, uint64(v.ExpiresAt.UnixNano())))
+	}
+	if v.GroupKey != "" {
+		header = appendField(header, tagGroupKey, []byte(v.GroupKey))
+	}
+	if id := v.Compression.id(); id != 0 {
+		header = appendField(header, tagCompression, []byte{id})
+	}
+	if v.KeyID != "" {
+		header = appendField(header, tagKeyID, []byte(v.KeyID))
+		header = appendField(header, tagWrappedKey, v.wrappedKey)
+	}
+	keys := make([]string, 0, len(v.Headers))
+	for key := range v.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		data := binary.AppendUvarint(nil, uint64(len(key)))
+		data = append(data, key...)
+		header = appendField(header, tagHeader, append(data, v.Headers[key]...))
+	}
+	if dl := v.DeadLetter; dl != nil {
+		header = appendField(header, tagDeadLetterTopic, []byte(dl.Topic))
+		if dl.Subscription != "" {
+			header = appendField(header, tagDeadLetterSubscription, []byte(dl.Subscription))
+		}
+		header = appendField(header, tagDeadLetterFailures, binary.LittleEndian.AppendUint32(nil, dl.Failures))
+		if dl.Reason != "" {
+			header = appendField(header, tagDeadLetterReason, []byte(dl.Reason))
+		}
+	}
+
+	return header
+}
 
-	return buf
+func appendField(header []byte, tag byte, data []byte) []byte {
+	header = append(header, tag)
+	header = binary.AppendUvarint(header, uint64(len(data)))
+	return append(header, data...)
+}
+
+// expired reports whether the value has expired at now.
+func (v *Value) expired(now time.Time) bool {
+	return !v.ExpiresAt.IsZero() && !now.Before(v.ExpiresAt)
 }
 
 func Decode(buf []byte) *Value {
+	if len(buf) > len(extendedMagic) && bytes.Equal(buf[:len(extendedMagic)], extendedMagic) {
+		return decodeExtended(buf[len(extendedMagic):])
+	}
+
 	dacks := binary.LittleEndian.Uint32(buf)
 
 	return &Value{
@@ -30,6 +188,97 @@ func Decode(buf []byte) *Value {
 	}
 }
 
+// decodeExtended decodes a value with a header section, after the magic bytes. Unknown header
+// fields are skipped, so that values written by newer versions can still be read.
+func decodeExtended(buf []byte) *Value {
+	buf = buf[1:] // header version
+	v := &Value{
+		Dacks: binary.LittleEndian.Uint32(buf),
+	}
+	buf = buf[dacksSize:]
+
+	headerLen, n := binary.Uvarint(buf)
+	header := buf[n : n+int(headerLen)]
+	v.Raw = buf[n+int(headerLen):]
+
+	for len(header) > 0 {
+		tag := header[0]
+		size, n := binary.Uvarint(header[1:])
+		data := header[1+n : 1+n+int(size)]
+		header = header[1+n+int(size):]
+
+		switch tag {
+		case tagDeadLetterTopic:
+			v.deadLetter().Topic = string(data)
+		case tagDeadLetterSubscription:
+			v.deadLetter().Subscription = string(data)
+		case tagDeadLetterFailures:
+			v.deadLetter().Failures = binary.LittleEndian.Uint32(data)
+		case tagDeadLetterReason:
+			v.deadLetter().Reason = string(data)
+		case tagID:
+			copy(v.ID[:], data)
+		case tagPublishedAt:
+			v.PublishedAt = time.Unix(0, int64(binary.LittleEndian.Uint64(data))).UTC()
+		case tagFirstDeliveredAt:
+			v.FirstDeliveredAt = time.Unix(0, int64(binary.LittleEndian.Uint64(data))).UTC()
+		case tagExpiresAt:
+			v.ExpiresAt = time.Unix(0, int64(binary.LittleEndian.Uint64(data))).UTC()
+		case tagHeader:
+			keyLen, n := binary.Uvarint(data)
+			if v.Headers == nil {
+				v.Headers = make(map[string]string)
+			}
+			v.Headers[string(data[n:n+int(keyLen)])] = string(data[n+int(keyLen):])
+		case tagPriority:
+			v.Priority = data[0]
+		case tagGroupKey:
+			v.GroupKey = string(data)
+		case tagCompression:
+			v.Compression = compressionFromID(data[0])
+		case tagKeyID:
+			v.KeyID = string(data)
+		case tagWrappedKey:
+			v.wrappedKey = data
+		}
+	}
+
+	// encrypted payloads are decrypted by the store, which holds the keys.
+	if v.KeyID != "" {
+		v.sealed = v.Raw
+		v.Raw = nil
+		v.locked = true
+		return v
+	}
+	v.setPayload(v.Raw)
+
+	return v
+}
+
+// setPayload sets the stored payload of the value, decompressing it if the value is compressed.
+func (v *Value) setPayload(payload []byte) {
+	if v.Compression == "" {
+		v.Raw = payload
+		return
+	}
+
+	v.packed = payload
+	// a payload that can't be decompressed is returned in its stored form.
+	if raw, err := v.Compression.decompress(payload, maxStoredSize); err == nil {
+		v.Raw = raw
+	} else {
+		v.Raw = payload
+	}
+}
+
+func (v *Value) deadLetter() *DeadLetter {
+	if v.DeadLetter == nil {
+		v.DeadLetter = &DeadLetter{}
+	}
+
+	return v.DeadLetter
+}
+
 func NewValue(data []byte) *Value {
 	return &Value{
 		Raw: data,
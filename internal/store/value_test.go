@@ -0,0 +1,122 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode_Legacy(t *testing.T) {
+	val := &Value{Dacks: 3, Raw: []byte("test_value")}
+
+	encoded := val.Encode()
+	assert.Equal(t, []byte{3, 0, 0, 0}, encoded[:dacksSize])
+	assert.Equal(t, val, Decode(encoded))
+}
+
+func TestEncode_DeadLetter(t *testing.T) {
+	val := &Value{
+		Dacks: 1,
+		Raw:   []byte("test_value"),
+		DeadLetter: &DeadLetter{
+			Topic:        "orders",
+			Subscription: "billing",
+			Failures:     5,
+			Reason:       "invalid payload",
+		},
+	}
+
+	encoded := val.Encode()
+	assert.Equal(t, extendedMagic, encoded[:len(extendedMagic)])
+	assert.Equal(t, val, Decode(encoded))
+}
+
+func TestDecode_SkipsUnknownFields(t *testing.T) {
+	val := &Value{Raw: []byte("test_value"), DeadLetter: &DeadLetter{Topic: "orders"}}
+	header := appendField(nil, 0xfe, []byte("unknown"))
+	header = append(header, val.encodeHeader()...)
+
+	encoded := append([]byte(nil), extendedMagic...)
+	encoded = append(encoded, headerVersion, 0, 0, 0, 0, byte(len(header)))
+	encoded = append(encoded, header...)
+	encoded = append(encoded, val.Raw...)
+
+	assert.Equal(t, val, Decode(encoded))
+}
+
+func TestEncode_Metadata(t *testing.T) {
+	val := &Value{
+		Raw:              []byte("test_value"),
+		ID:               uuid.New(),
+		PublishedAt:      time.Now().UTC(),
+		FirstDeliveredAt: time.Now().Add(time.Second).UTC(),
+		Priority:         7,
+		ExpiresAt:        time.Now().Add(time.Minute).UTC(),
+		GroupKey:         "order-123",
+		Headers: map[string]string{
+			"Content-Type":   "application/json",
+			"Correlation-Id": "abc",
+		},
+	}
+
+	assert.Equal(t, val, Decode(val.Encode()))
+	assert.Equal(t, val.Encode(), val.Encode())
+}
+
+func TestEncode_Compression(t *testing.T) {
+	payload := bytes.Repeat([]byte("test_value"), 100)
+
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		t.Run(string(c), func(t *testing.T) {
+			val := &Value{Raw: payload}
+			applyCompression(&TopicConfig{Compression: c}, val)
+			require.Equal(t, c, val.Compression)
+
+			encoded := val.Encode()
+			assert.Less(t, len(encoded), len(payload))
+
+			decoded := Decode(encoded)
+			assert.Equal(t, payload, decoded.Raw)
+			assert.Equal(t, c, decoded.Compression)
+
+			// the stored payload passes through without being compressed again.
+			packed, compression := decoded.Compressed()
+			assert.Equal(t, c, compression)
+
+			passed, err := NewCompressedValue(packed, compression, 0)
+			require.NoError(t, err)
+			assert.Equal(t, payload, passed.Raw)
+			assert.Equal(t, encoded, passed.Encode())
+		})
+	}
+
+	// payloads that don't get smaller are stored uncompressed.
+	val := NewValue([]byte("short"))
+	applyCompression(&TopicConfig{Compression: CompressionZstd}, val)
+	assert.Equal(t, Compression(""), val.Compression)
+
+	_, err := NewCompressedValue([]byte("not snappy"), CompressionSnappy, 0)
+	require.ErrorIs(t, err, ErrInvalidCompression)
+}
+
+func TestNewCompressedValue_TooLarge(t *testing.T) {
+	payload := bytes.Repeat([]byte("value"), 200)
+
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		_, err := NewCompressedValue(c.compress(payload), c, len(payload)-1)
+		require.ErrorIs(t, err, ErrTooLarge, c)
+
+		// zstd frames are also limited by their window, which is at least 1 KiB.
+		val, err := NewCompressedValue(c.compress(payload), c, 1<<10)
+		require.NoError(t, err, c)
+		assert.Equal(t, payload, val.Raw)
+	}
+
+	// a snappy header claiming a length of almost 2 GiB is rejected before decoding.
+	_, err := NewCompressedValue([]byte{0x80, 0x80, 0x80, 0x80, 0x07}, CompressionSnappy, 0)
+	require.ErrorIs(t, err, ErrTooLarge)
+}
@@ -0,0 +1,491 @@
+// Package rq runs an rq broker inside the process, without the HTTP server. Open opens a store in
+// a local directory along with a broker over it, and the returned Broker publishes and consumes
+// messages with the same semantics as the server. A Broker is safe for concurrent use.
+package rq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nireo/rq/internal/broker"
+	"github.com/nireo/rq/internal/consumer"
+	"github.com/nireo/rq/internal/store"
+)
+
+// Topic configs, stats and receipts are aliases of the store's types, so that callers can use them
+// without importing internal packages.
+type (
+	TopicConfig = store.TopicConfig
+	TopicStats  = store.TopicStats
+	Mode        = store.Mode
+	Duration    = store.Duration
+	Overflow    = store.Overflow
+	Expiry      = store.Expiry
+	Compression = store.Compression
+	Receipt     = store.Receipt
+	DeadLetter  = store.DeadLetter
+	KeyProvider = store.KeyProvider
+	Keyring     = store.Keyring
+)
+
+const (
+	ModeQueue  = store.ModeQueue
+	ModeFanout = store.ModeFanout
+	ModeStream = store.ModeStream
+)
+
+var (
+	ErrTopicNotFound = store.ErrTopicNotFound
+	ErrInvalidTopic  = store.ErrInvalidTopic
+	ErrInvalidConfig = store.ErrInvalidConfig
+	// ErrNotOutstanding is returned when settling a delivery which was already settled or whose
+	// subscription was closed, which returns its unsettled messages to their topic.
+	ErrNotOutstanding = consumer.ErrNotOutstanding
+	// ErrLeaseExpired is returned when settling a delivery whose lease expired, after which the
+	// message was returned to its topic.
+	ErrLeaseExpired = store.ErrKeyDoesntExist
+)
+
+// Broker is a broker running in the process over a store of its own.
+type Broker struct {
+	broker broker.Broker
+}
+
+type options struct {
+	storeOpts  []store.Option
+	brokerOpts []broker.Option
+}
+
+type Option func(*options)
+
+// WithJanitorInterval sets how often retention limits are enforced, see
+// store.WithJanitorInterval.
+func WithJanitorInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.storeOpts = append(o.storeOpts, store.WithJanitorInterval(d))
+	}
+}
+
+// WithReapInterval sets how often messages with expired leases are returned to their topics.
+func WithReapInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.brokerOpts = append(o.brokerOpts, broker.WithReapInterval(d))
+	}
+}
+
+// WithScheduleInterval sets how often scheduled messages that are due are delivered.
+func WithScheduleInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.brokerOpts = append(o.brokerOpts, broker.WithScheduleInterval(d))
+	}
+}
+
+// WithKeyProvider encrypts the stored messages with keys from the provider, see Keyring.
+func WithKeyProvider(keys KeyProvider) Option {
+	return func(o *options) {
+		o.storeOpts = append(o.storeOpts, store.WithKeyProvider(keys))
+	}
+}
+
+// Open opens the store in the directory at path, creating it if it doesn't exist, and starts a
+// broker over it. The broker has to be closed to release the store.
+func Open(path string, opts ...Option) (*Broker, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	st, err := store.NewStore(path, o.storeOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("opening store: %w", err)
+	}
+
+	return &Broker{broker: broker.NewBroker(st, o.brokerOpts...)}, nil
+}
+
+// Close stops the broker and closes its store. Subscriptions should be closed first, since their
+// unsettled messages can't be returned to their topics afterwards.
+func (b *Broker) Close() error {
+	return b.broker.Close()
+}
+
+// Message is a message delivered to a consumer or read from a stream. Times which the message
+// doesn't have are zero.
+type Message struct {
+	ID               string
+	Offset           uint64
+	Dacks            uint32
+	Priority         uint8
+	PublishedAt      time.Time
+	FirstDeliveredAt time.Time
+	ExpiresAt        time.Time
+	GroupKey         string
+	Headers          map[string]string
+	Value            []byte
+	DeadLetter       *DeadLetter
+}
+
+func newMessage(offset uint64, val *store.Value) Message {
+	return Message{
+		ID:               val.ID.String(),
+		Offset:           offset,
+		Dacks:            val.Dacks,
+		Priority:         val.Priority,
+		PublishedAt:      val.PublishedAt,
+		FirstDeliveredAt: val.FirstDeliveredAt,
+		ExpiresAt:        val.ExpiresAt,
+		GroupKey:         val.GroupKey,
+		Headers:          val.Headers,
+		Value:            val.Raw,
+		DeadLetter:       val.DeadLetter,
+	}
+}
+
+// PublishOption configures a publish.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	priority       uint8
+	headers        map[string]string
+	idempotencyKey string
+	brokerOpts     []broker.PublishOption
+}
+
+// WithPriority publishes messages with a priority up to store.MaxPriority.
+func WithPriority(priority uint8) PublishOption {
+	return func(o *publishOptions) {
+		o.priority = priority
+	}
+}
+
+// WithHeader sets a header of the published messages.
+func WithHeader(key, value string) PublishOption {
+	return func(o *publishOptions) {
+		if o.headers == nil {
+			o.headers = make(map[string]string)
+		}
+		o.headers[key] = value
+	}
+}
+
+// WithDelay delays the delivery of messages.
+func WithDelay(d time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.brokerOpts = append(o.brokerOpts, broker.WithDelay(d))
+	}
+}
+
+// WithDeliverAt delivers messages once the given time has passed.
+func WithDeliverAt(t time.Time) PublishOption {
+	return func(o *publishOptions) {
+		o.brokerOpts = append(o.brokerOpts, broker.WithDeliverAt(t))
+	}
+}
+
+// WithTTL sets how long messages are delivered before they expire.
+func WithTTL(d time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.brokerOpts = append(o.brokerOpts, broker.WithTTL(d))
+	}
+}
+
+// WithGroupKey publishes messages into a FIFO group, whose messages are delivered one at a time.
+func WithGroupKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.brokerOpts = append(o.brokerOpts, broker.WithGroupKey(key))
+	}
+}
+
+// WithIdempotencyKey deduplicates retries of a publish within the topic's dedup window. Batches
+// can't be published with an idempotency key.
+func WithIdempotencyKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+func newPublishOptions(opts []PublishOption) *publishOptions {
+	o := &publishOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+func (o *publishOptions) value(data []byte) *store.Value {
+	val := store.NewValue(data)
+	val.Priority = o.priority
+	for key, value := range o.headers {
+		if val.Headers == nil {
+			val.Headers = make(map[string]string, len(o.headers))
+		}
+		val.Headers[key] = value
+	}
+
+	return val
+}
+
+// Publish publishes a message to the topic. The receipt's offset is only set for messages
+// published with an idempotency key.
+func (b *Broker) Publish(topic string, value []byte, opts ...PublishOption) (*Receipt, error) {
+	o := newPublishOptions(opts)
+	val := o.value(value)
+
+	if o.idempotencyKey != "" {
+		return b.broker.PublishIdempotent(topic, o.idempotencyKey, val, o.brokerOpts...)
+	}
+
+	if err := b.broker.Publish(topic, val, o.brokerOpts...); err != nil {
+		return nil, err
+	}
+
+	return &Receipt{ID: val.ID}, nil
+}
+
+// PublishBatch publishes the messages to the topic atomically.
+func (b *Broker) PublishBatch(topic string, values [][]byte, opts ...PublishOption) error {
+	o := newPublishOptions(opts)
+	if o.idempotencyKey != "" {
+		return errors.New("rq: batches can't be published with an idempotency key")
+	}
+
+	vals := make([]*store.Value, len(values))
+	for i, value := range values {
+		vals[i] = o.value(value)
+	}
+
+	return b.broker.PublishBatch(topic, vals, o.brokerOpts...)
+}
+
+// DeclareTopic creates the topic or updates its config.
+func (b *Broker) DeclareTopic(topic string, cfg *TopicConfig) error {
+	return b.broker.DeclareTopic(topic, cfg)
+}
+
+// Topics returns the names of all topics, including dead-letter topics. The queues of subscriptions
+// aren't included.
+func (b *Broker) Topics() ([]string, error) {
+	return b.broker.Topics()
+}
+
+// Stats describes the topic's messages and subscriptions. It returns ErrTopicNotFound if the topic
+// doesn't exist.
+func (b *Broker) Stats(topic string) (*TopicStats, error) {
+	return b.broker.Stats(topic)
+}
+
+// Purge removes the ready messages of the topic and returns their amount.
+func (b *Broker) Purge(topic string) (uint64, error) {
+	return b.broker.Purge(topic)
+}
+
+// DeleteTopic removes the topic along with its messages, config and subscriptions. Open
+// subscriptions of the topic stay open, but their unsettled deliveries can't be settled anymore.
+func (b *Broker) DeleteTopic(topic string) error {
+	return b.broker.DeleteTopic(topic)
+}
+
+// Redrive moves up to max messages of a dead-letter topic back to the topics they failed in, or
+// all of them if max is zero. It returns the amount of messages moved to each topic.
+func (b *Broker) Redrive(dlq string, max uint64) (map[string]uint64, error) {
+	return b.broker.Redrive(dlq, max)
+}
+
+// ReadStream reads up to n messages of a stream topic starting at offset, blocking until a
+// message at or after the offset is published or ctx is done.
+func (b *Broker) ReadStream(ctx context.Context, topic string, offset uint64, n int) ([]Message, error) {
+	msgs, err := b.broker.ReadStream(ctx, topic, offset, n)
+	if err != nil {
+		return nil, err
+	}
+
+	read := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		read[i] = newMessage(msg.Offset, msg.Value)
+	}
+
+	return read, nil
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	subscription string
+	group        string
+	member       string
+	prefetch     int
+}
+
+// WithSubscription consumes a durable subscription of a fan-out topic.
+func WithSubscription(name string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.subscription = name
+	}
+}
+
+// WithGroup joins a consumer group of a fan-out topic as the member, which can't be empty.
+func WithGroup(group, member string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.group = group
+		o.member = member
+	}
+}
+
+// WithPrefetch sets how many deliveries can be left unsettled at once. It defaults to 1.
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = n
+	}
+}
+
+// Subscription delivers the messages of a topic to a consumer. Deliveries are leased until they're
+// settled with Ack or Nack, and at most the prefetch of the subscription are unsettled at once.
+type Subscription struct {
+	broker *Broker
+	topic  string
+	csm    *consumer.Consumer
+	out    chan *Delivery
+	// slots holds a value for every unsettled delivery.
+	slots  chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Subscribe consumes the messages of a topic until ctx is done or the subscription is closed.
+func (b *Broker) Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (*Subscription, error) {
+	o := &subscribeOptions{prefetch: 1}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.prefetch < 1 {
+		return nil, errors.New("rq: prefetch must be at least 1")
+	}
+	if o.group != "" && o.member == "" {
+		return nil, errors.New("rq: joining a group requires a member")
+	}
+
+	var (
+		csm *consumer.Consumer
+		err error
+	)
+	switch {
+	case o.member != "":
+		csm, err = b.broker.JoinGroup(topic, o.group, o.member)
+	case o.subscription != "":
+		csm, err = b.broker.SubscribeDurable(topic, o.subscription)
+	default:
+		csm, err = b.broker.Subscribe(topic)
+	}
+	if err != nil {
+		return nil, err
+	}
+	csm.Prefetch = o.prefetch
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		broker: b,
+		topic:  topic,
+		csm:    csm,
+		out:    make(chan *Delivery),
+		slots:  make(chan struct{}, o.prefetch),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go s.run(ctx)
+
+	return s, nil
+}
+
+// Deliveries returns the channel the messages are delivered on. It's closed once the
+// subscription ends.
+func (s *Subscription) Deliveries() <-chan *Delivery {
+	return s.out
+}
+
+// Err returns the error which ended the subscription, or nil if it was closed or its context is
+// done.
+func (s *Subscription) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Close ends the subscription, returning its unsettled messages to the topic.
+func (s *Subscription) Close() error {
+	s.cancel()
+	<-s.done
+
+	return nil
+}
+
+func (s *Subscription) run(ctx context.Context) {
+	defer close(s.done)
+	defer close(s.out)
+	defer s.broker.broker.Unsubscribe(s.topic, s.csm.ID)
+
+	for {
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		val, offset, err := s.broker.broker.Next(ctx, s.csm)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		d := &Delivery{Message: newMessage(offset, val), sub: s}
+		select {
+		case s.out <- d:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Delivery is a message delivered by a subscription.
+type Delivery struct {
+	Message
+
+	sub     *Subscription
+	settled atomic.Bool
+}
+
+// Ack acknowledges the message, removing it from its topic.
+func (d *Delivery) Ack() error {
+	return d.settle(func() error { return d.sub.csm.Ack(d.Offset) })
+}
+
+// Nack returns the message to its topic to be delivered again. The reason is recorded if the
+// message ends up in a dead-letter topic.
+func (d *Delivery) Nack(reason string) error {
+	return d.settle(func() error { return d.sub.csm.Nack(d.Offset, reason) })
+}
+
+func (d *Delivery) settle(fn func() error) error {
+	if d.settled.Load() {
+		return ErrNotOutstanding
+	}
+
+	// a message whose lease expired is no longer outstanding either.
+	err := fn()
+	if err != nil && !errors.Is(err, ErrLeaseExpired) {
+		return err
+	}
+
+	if d.settled.CompareAndSwap(false, true) {
+		<-d.sub.slots
+	}
+
+	return err
+}
@@ -0,0 +1,137 @@
+package rq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBroker(t *testing.T) *Broker {
+	t.Helper()
+
+	b, err := Open(t.TempDir(), WithReapInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+
+	return b
+}
+
+func receive(t *testing.T, sub *Subscription) *Delivery {
+	t.Helper()
+
+	select {
+	case d, ok := <-sub.Deliveries():
+		require.True(t, ok, "deliveries closed")
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+		return nil
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := newTestBroker(t)
+
+	receipt, err := b.Publish("orders", []byte("first"), WithHeader("Trace", "1"), WithIdempotencyKey("k"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, receipt.ID)
+	assert.False(t, receipt.Duplicate)
+
+	dup, err := b.Publish("orders", []byte("first"), WithIdempotencyKey("k"))
+	require.NoError(t, err)
+	assert.True(t, dup.Duplicate)
+	assert.Equal(t, receipt.ID, dup.ID)
+
+	sub, err := b.Subscribe(context.Background(), "orders")
+	require.NoError(t, err)
+	defer sub.Close()
+
+	d := receive(t, sub)
+	assert.Equal(t, receipt.ID.String(), d.ID)
+	assert.Equal(t, []byte("first"), d.Value)
+	assert.Equal(t, "1", d.Headers["Trace"])
+
+	require.NoError(t, d.Nack("retry"))
+	assert.ErrorIs(t, d.Ack(), ErrNotOutstanding)
+
+	d = receive(t, sub)
+	assert.Equal(t, receipt.ID.String(), d.ID)
+	assert.Equal(t, uint32(1), d.Dacks)
+	require.NoError(t, d.Ack())
+
+	require.NoError(t, b.PublishBatch("orders", [][]byte{[]byte("a"), []byte("b")}))
+	assert.Equal(t, []byte("a"), receive(t, sub).Value)
+}
+
+func TestSubscribe_Prefetch(t *testing.T) {
+	b := newTestBroker(t)
+
+	for _, v := range []string{"a", "b", "c"} {
+		_, err := b.Publish("jobs", []byte(v))
+		require.NoError(t, err)
+	}
+
+	sub, err := b.Subscribe(context.Background(), "jobs", WithPrefetch(2))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	first, second := receive(t, sub), receive(t, sub)
+	select {
+	case d := <-sub.Deliveries():
+		t.Fatalf("delivered %q past the prefetch", d.Value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, first.Ack())
+	third := receive(t, sub)
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, []string{string(first.Value), string(second.Value), string(third.Value)})
+}
+
+func TestSubscribe_Cancel(t *testing.T) {
+	b := newTestBroker(t)
+
+	_, err := b.Publish("jobs", []byte("a"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := b.Subscribe(ctx, "jobs")
+	require.NoError(t, err)
+
+	d := receive(t, sub)
+	cancel()
+
+	_, ok := <-sub.Deliveries()
+	assert.False(t, ok)
+	assert.NoError(t, sub.Err())
+	assert.Error(t, d.Ack())
+
+	stats, err := b.Stats("jobs")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Ready)
+
+	purged, err := b.Purge("jobs")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), purged)
+}
+
+func TestErrors(t *testing.T) {
+	b := newTestBroker(t)
+
+	_, err := b.Subscribe(context.Background(), "jobs", WithPrefetch(0))
+	assert.Error(t, err)
+
+	_, err = b.Stats("missing")
+	assert.ErrorIs(t, err, ErrTopicNotFound)
+
+	_, err = b.Subscribe(context.Background(), "jobs", WithSubscription("audit"))
+	assert.Error(t, err)
+
+	_, err = b.Subscribe(context.Background(), "jobs", WithGroup("workers", ""))
+	assert.Error(t, err)
+
+	err = b.PublishBatch("jobs", [][]byte{[]byte("a")}, WithIdempotencyKey("k"))
+	assert.Error(t, err)
+}